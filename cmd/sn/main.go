@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/Nakray/sn/internal/config"
 	"github.com/Nakray/sn/internal/database"
@@ -17,6 +19,7 @@ import (
 
 func main() {
 	configPath := flag.String("config", "config.json", "Path to configuration file")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for running tasks and requests on shutdown")
 	flag.Parse()
 
 	// Load configuration
@@ -39,10 +42,27 @@ func main() {
 
 	log.Println("Database connected successfully")
 
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(context.Background(), db, flag.Args()[1:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	if err := db.CheckSchema(context.Background()); err != nil {
+		log.Fatalf("Refusing to start: %v (run `sn migrate up`)", err)
+	}
+
+	if flag.Arg(0) == "replay" {
+		if err := runReplay(context.Background(), db, &cfg, flag.Args()[1:]); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
+
 	// Initialize monitoring service
 	monService := monitoring.NewService(db, &cfg)
 	monService.Start()
-	defer monService.Stop()
 
 	log.Printf("Monitoring service started with %d workers\n", cfg.Monitoring.Workers)
 
@@ -61,4 +81,14 @@ func main() {
 	<-sigChan
 
 	fmt.Println("\nShutting down gracefully...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown error: %v", err)
+	}
+	if err := monService.Stop(ctx); err != nil {
+		log.Printf("Monitoring service did not stop in time: %v", err)
+	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/Nakray/sn/internal/config"
+	"github.com/Nakray/sn/internal/database"
+	"github.com/Nakray/sn/internal/database/memstore"
+	"github.com/Nakray/sn/internal/vk"
+)
+
+const replayUsage = "usage: sn replay --cassette file --task N"
+
+// runReplay implements the "sn replay" subcommand. It reruns the collection
+// of a task against a recorded cassette and prints what would have been
+// stored. Nothing is written to the database.
+func runReplay(ctx context.Context, db database.TaskStore, cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cassettePath := fs.String("cassette", "", "Cassette file recorded with vk.record_dir")
+	taskID := fs.Int64("task", 0, "ID of the monitoring task to replay")
+	if err := fs.Parse(args); err != nil || *cassettePath == "" || *taskID == 0 {
+		return errors.New(replayUsage)
+	}
+
+	cassette, err := vk.OpenCassette(*cassettePath)
+	if err != nil {
+		return err
+	}
+
+	task, err := db.GetMonitoringTaskContext(ctx, *taskID)
+	if err != nil {
+		return fmt.Errorf("task %d: %w", *taskID, err)
+	}
+
+	filters, err := database.ParseTaskFilters(task.Filters, task.FilterLimits)
+	if err != nil {
+		return fmt.Errorf("task %d: %w", *taskID, err)
+	}
+
+	// Recorded responses need no pacing: keep the number of attempts so
+	// that recorded retries are consumed, but do not wait between them.
+	retry := vk.RetryPolicy{MaxAttempts: vk.DefaultRetryPolicy.MaxAttempts}
+	if cfg.VK.Retry.MaxAttempts > 0 {
+		retry.MaxAttempts = cfg.VK.Retry.MaxAttempts
+	}
+
+	client, err := vk.NewClient("replay", nil,
+		vk.WithCassette(cassette),
+		vk.WithLimiters(vk.NewLimiterRegistry(vk.RateLimits{RequestsPerSecond: 1000, Burst: 1000})),
+		vk.WithRetryPolicy(retry),
+		vk.WithAPIVersion(cfg.VK.APIVersion),
+	)
+	if err != nil {
+		return err
+	}
+
+	store := memstore.New()
+	collector := vk.NewCollector(client, store)
+	collector.SetMaxItems(cfg.VK.MaxItems)
+	collector.SetFilters(filters)
+
+	result, collectErr := collector.CollectEntity(ctx, task.OwnerType, task.OwnerID)
+	if result != nil {
+		for _, step := range result.Steps {
+			fmt.Printf("step     %-14s %-7s %d items, %d/%d requests failed\n", step.Name, step.Status(), step.Items, step.Failed, step.Requests)
+			if step.Err != nil {
+				fmt.Printf("         %-14s %s: %v\n", "", step.Err.Class, step.Err.Err)
+			}
+		}
+		if collectErr == nil {
+			if policy, err := database.ParseStepPolicy(task.StepPolicy); err == nil {
+				status, failed := policy.Outcome(result.RunSteps())
+				fmt.Printf("outcome  %s %v\n", status, failed)
+			}
+		}
+	}
+
+	owner := database.Owner{Type: task.OwnerType, ID: task.OwnerID}
+	for _, rel := range store.Relations(owner) {
+		details, _ := json.Marshal(rel.Details)
+		fmt.Printf("relation %-14s %s: %d IDs\n", rel.RelationType, details, len(rel.IDs))
+	}
+	for _, objectType := range database.ObjectTypes() {
+		if n := len(store.Objects(objectType.Name)); n > 0 {
+			fmt.Printf("objects  %-14s %d\n", objectType.Name, n)
+		}
+	}
+	if n := cassette.Remaining(); n > 0 {
+		fmt.Printf("%d recorded requests were not replayed\n", n)
+	}
+
+	return collectErr
+}
@@ -1,11 +1,11 @@
 package config
 
 type Config struct {
-	Database        string            `json:"database"`
-	Server          ServerConfig      `json:"server"`
-	Monitoring      MonitoringConfig  `json:"monitoring"`
-	VK              VKConfig          `json:"vk"`
-	RelevanceHours  int               `json:"relevance_hours"`
+	Database       string           `json:"database"`
+	Server         ServerConfig     `json:"server"`
+	Monitoring     MonitoringConfig `json:"monitoring"`
+	VK             VKConfig         `json:"vk"`
+	RelevanceHours int              `json:"relevance_hours"`
 }
 
 type ServerConfig struct {
@@ -13,10 +13,51 @@ type ServerConfig struct {
 }
 
 type MonitoringConfig struct {
+	// IntervalMinutes is the longest the dispatcher sleeps without being
+	// notified of a task change.
 	IntervalMinutes int `json:"interval_minutes"`
 	Workers         int `json:"workers"`
+	LeaseSeconds    int `json:"lease_seconds"`
 }
 
 type VKConfig struct {
 	APIVersion string `json:"api_version"`
+	// MaxItems caps paginated lists per API method, e.g. "groups.getMembers".
+	// A cap of zero or less means no cap.
+	MaxItems  map[string]int  `json:"max_items"`
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	Retry     RetryConfig     `json:"retry"`
+	// RecordDir, when set, makes every task run record its VK traffic to a
+	// cassette file in this directory for "sn replay".
+	RecordDir   string            `json:"record_dir"`
+	Incremental IncrementalConfig `json:"incremental"`
+}
+
+// IncrementalConfig makes walls be collected incrementally between
+// periodic full syncs. Zero durations keep the defaults.
+type IncrementalConfig struct {
+	Enabled bool `json:"enabled"`
+	// HotWindowHours is how far back likes and comments are refreshed.
+	HotWindowHours int `json:"hot_window_hours"`
+	// FullSyncHours is how often the whole wall is fetched again.
+	FullSyncHours int `json:"full_sync_hours"`
+}
+
+// RateLimitConfig limits requests per access token across all workers.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	// Methods sets per-method rates, e.g. {"wall.get": 1}.
+	Methods map[string]float64 `json:"methods"`
+	// PerProxy keeps separate limits for the same token behind different proxies.
+	PerProxy bool `json:"per_proxy"`
+}
+
+// RetryConfig controls how failed VK requests are repeated. Zero values
+// keep the defaults.
+type RetryConfig struct {
+	MaxAttempts int     `json:"max_attempts"`
+	BaseDelayMS int     `json:"base_delay_ms"`
+	MaxDelayMS  int     `json:"max_delay_ms"`
+	Jitter      float64 `json:"jitter"`
 }
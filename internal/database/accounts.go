@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"time"
@@ -20,6 +21,10 @@ type Account struct {
 }
 
 func (db *DB) GetAvailableAccount(socialNetworkType string, groupID int) (*Account, error) {
+	return db.GetAvailableAccountContext(context.Background(), socialNetworkType, groupID)
+}
+
+func (db *DB) GetAvailableAccountContext(ctx context.Context, socialNetworkType string, groupID int) (*Account, error) {
 	query := `
 		SELECT "ID", "SocialNetworkType", "Login", "Password", "Session", 
 		       "Proxy", "IsBlocked", "Info", "UnavailableUntil", "GroupID"
@@ -36,7 +41,7 @@ func (db *DB) GetAvailableAccount(socialNetworkType string, groupID int) (*Accou
 	var sessionJSON []byte
 	var unavailableUntil sql.NullTime
 
-	err := db.conn.QueryRow(query, socialNetworkType, groupID).Scan(
+	err := db.conn.QueryRowContext(ctx, query, socialNetworkType, groupID).Scan(
 		&acc.ID,
 		&acc.SocialNetworkType,
 		&acc.Login,
@@ -65,30 +70,46 @@ func (db *DB) GetAvailableAccount(socialNetworkType string, groupID int) (*Accou
 }
 
 func (db *DB) UpdateAccountSession(accountID int64, session map[string]interface{}) error {
+	return db.UpdateAccountSessionContext(context.Background(), accountID, session)
+}
+
+func (db *DB) UpdateAccountSessionContext(ctx context.Context, accountID int64, session map[string]interface{}) error {
 	sessionJSON, err := json.Marshal(session)
 	if err != nil {
 		return err
 	}
 
 	query := `UPDATE public."Accounts" SET "Session" = $1, "IsChanged" = true WHERE "ID" = $2`
-	_, err = db.conn.Exec(query, sessionJSON, accountID)
+	_, err = db.conn.ExecContext(ctx, query, sessionJSON, accountID)
 	return err
 }
 
 func (db *DB) MarkAccountBlocked(accountID int64, info string) error {
+	return db.MarkAccountBlockedContext(context.Background(), accountID, info)
+}
+
+func (db *DB) MarkAccountBlockedContext(ctx context.Context, accountID int64, info string) error {
 	query := `UPDATE public."Accounts" SET "IsBlocked" = true, "Info" = $1, "IsChanged" = true WHERE "ID" = $2`
-	_, err := db.conn.Exec(query, info, accountID)
+	_, err := db.conn.ExecContext(ctx, query, info, accountID)
 	return err
 }
 
 func (db *DB) SetAccountUnavailable(accountID int64, duration time.Duration) error {
+	return db.SetAccountUnavailableContext(context.Background(), accountID, duration)
+}
+
+func (db *DB) SetAccountUnavailableContext(ctx context.Context, accountID int64, duration time.Duration) error {
 	until := time.Now().Add(duration)
 	query := `UPDATE public."Accounts" SET "UnavailableUntil" = $1, "IsChanged" = true WHERE "ID" = $2`
-	_, err := db.conn.Exec(query, until, accountID)
+	_, err := db.conn.ExecContext(ctx, query, until, accountID)
 	return err
 }
 
 func (db *DB) ListAccounts() ([]Account, error) {
+	return db.ListAccountsContext(context.Background())
+}
+
+func (db *DB) ListAccountsContext(ctx context.Context) ([]Account, error) {
 	query := `
 		SELECT "ID", "SocialNetworkType", "Login", "Password", "Session", 
 		       "Proxy", "IsBlocked", "Info", "UnavailableUntil", "GroupID"
@@ -96,7 +117,7 @@ func (db *DB) ListAccounts() ([]Account, error) {
 		ORDER BY "ID" DESC
 	`
 
-	rows, err := db.conn.Query(query)
+	rows, err := db.conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -139,6 +160,10 @@ func (db *DB) ListAccounts() ([]Account, error) {
 }
 
 func (db *DB) CreateAccount(acc *Account) error {
+	return db.CreateAccountContext(context.Background(), acc)
+}
+
+func (db *DB) CreateAccountContext(ctx context.Context, acc *Account) error {
 	sessionJSON, _ := json.Marshal(acc.Session)
 
 	query := `
@@ -148,7 +173,7 @@ func (db *DB) CreateAccount(acc *Account) error {
 		RETURNING "ID"
 	`
 
-	return db.conn.QueryRow(query,
+	return db.conn.QueryRowContext(ctx, query,
 		acc.SocialNetworkType,
 		acc.Login,
 		acc.Password,
@@ -161,7 +186,11 @@ func (db *DB) CreateAccount(acc *Account) error {
 }
 
 func (db *DB) DeleteAccount(accountID int64) error {
+	return db.DeleteAccountContext(context.Background(), accountID)
+}
+
+func (db *DB) DeleteAccountContext(ctx context.Context, accountID int64) error {
 	query := `DELETE FROM public."Accounts" WHERE "ID" = $1`
-	_, err := db.conn.Exec(query, accountID)
+	_, err := db.conn.ExecContext(ctx, query, accountID)
 	return err
 }
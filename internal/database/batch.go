@@ -0,0 +1,544 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// BatchObject is an object write buffered by a Batch. Details and Data are
+// in their decoded JSON form.
+type BatchObject struct {
+	SocialNetworkType string
+	Owner             Owner
+	ObjectType        string
+	Details           map[string]interface{}
+	Data              map[string]interface{}
+}
+
+// BatchRelation is a relation write buffered by a Batch.
+type BatchRelation struct {
+	SocialNetworkType string
+	Owner             Owner
+	RelationType      RelationType
+	Details           map[string]interface{}
+	IDs               []int64
+}
+
+// Batch buffers the writes of one collection run so that they are stored
+// together, in one transaction, by a BatchWriter. It implements Writer and
+// CursorStore; cursors are read from the store passed to NewBatch unless
+// the batch holds a newer one.
+type Batch struct {
+	cursors CursorStore
+
+	mu        sync.Mutex
+	objects   []BatchObject
+	relations []BatchRelation
+	saved     []Cursor
+}
+
+var (
+	_ Writer      = (*Batch)(nil)
+	_ CursorStore = (*Batch)(nil)
+)
+
+// NewBatch returns an empty batch. cursors may be nil when the batch is
+// not used for incremental collection.
+func NewBatch(cursors CursorStore) *Batch {
+	return &Batch{cursors: cursors}
+}
+
+// WriteObjectContext validates an object and adds it to the batch.
+func (b *Batch) WriteObjectContext(ctx context.Context, socialNetworkType string, owner Owner, objectType string, details map[string]interface{}, data map[string]interface{}) error {
+	details, err := normalizeJSON(details)
+	if err != nil {
+		return err
+	}
+	data, err = normalizeJSON(data)
+	if err != nil {
+		return err
+	}
+	if _, err := ValidateObject(objectType, details, data); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.objects = append(b.objects, BatchObject{
+		SocialNetworkType: socialNetworkType,
+		Owner:             owner,
+		ObjectType:        objectType,
+		Details:           details,
+		Data:              data,
+	})
+	return nil
+}
+
+// WriteRelationsContext adds a relation list to the batch.
+func (b *Batch) WriteRelationsContext(ctx context.Context, socialNetworkType string, owner Owner, relationType RelationType, details map[string]interface{}, ids []int64) error {
+	details, err := normalizeJSON(details)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.relations = append(b.relations, BatchRelation{
+		SocialNetworkType: socialNetworkType,
+		Owner:             owner,
+		RelationType:      relationType,
+		Details:           details,
+		IDs:               append([]int64(nil), ids...),
+	})
+	return nil
+}
+
+// GetCursorContext returns the cursor saved to the batch last, or the one
+// in the underlying store.
+func (b *Batch) GetCursorContext(ctx context.Context, socialNetworkType string, owner Owner, kind CollectKind) (*Cursor, error) {
+	b.mu.Lock()
+	for i := len(b.saved) - 1; i >= 0; i-- {
+		c := b.saved[i]
+		if c.SocialNetworkType == socialNetworkType && c.Owner == owner && c.Kind == kind {
+			b.mu.Unlock()
+			c.IDs = append([]int64(nil), c.IDs...)
+			return &c, nil
+		}
+	}
+	b.mu.Unlock()
+
+	if b.cursors == nil {
+		return nil, ErrCursorNotFound
+	}
+	return b.cursors.GetCursorContext(ctx, socialNetworkType, owner, kind)
+}
+
+// SaveCursorContext adds a cursor to the batch.
+func (b *Batch) SaveCursorContext(ctx context.Context, cursor *Cursor) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := *cursor
+	c.IDs = append([]int64(nil), cursor.IDs...)
+	b.saved = append(b.saved, c)
+	return nil
+}
+
+// Objects returns the buffered object writes in the order they were made.
+func (b *Batch) Objects() []BatchObject {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]BatchObject(nil), b.objects...)
+}
+
+// Relations returns the buffered relation writes in the order they were
+// made.
+func (b *Batch) Relations() []BatchRelation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]BatchRelation(nil), b.relations...)
+}
+
+// Cursors returns the buffered cursors in the order they were saved.
+func (b *Batch) Cursors() []Cursor {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Cursor(nil), b.saved...)
+}
+
+// Len returns the number of buffered writes.
+func (b *Batch) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.objects) + len(b.relations) + len(b.saved)
+}
+
+// BatchStats reports what storing a batch did and how long it took.
+type BatchStats struct {
+	// Objects counts the objects in the batch, Written those inserted or
+	// changed; the rest were unchanged.
+	Objects int
+	Written int
+	// Relations counts the relation lists, Changes the change records
+	// they produced.
+	Relations int
+	Changes   int
+	Cursors   int
+	Duration  time.Duration
+}
+
+// Rate returns the objects and relation lists stored per second.
+func (s BatchStats) Rate() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Objects+s.Relations) / s.Duration.Seconds()
+}
+
+func (s BatchStats) String() string {
+	return fmt.Sprintf("%d objects (%d written), %d relations (%d changes), %d cursors in %v (%.0f/s)",
+		s.Objects, s.Written, s.Relations, s.Changes, s.Cursors, s.Duration.Round(time.Millisecond), s.Rate())
+}
+
+func (db *DB) WriteBatch(batch *Batch) (BatchStats, error) {
+	return db.WriteBatchContext(context.Background(), batch)
+}
+
+// WriteBatchContext stores a batch in one transaction with the same
+// semantics as the single writes: unchanged objects are skipped, changed
+// ones are archived to "ObjectHistory", and relation changes are recorded.
+// Rows are loaded with COPY into temporary staging tables and merged with
+// one statement per table, so the number of round trips does not grow
+// with the batch. Repeated writes of the same key keep the last one.
+func (db *DB) WriteBatchContext(ctx context.Context, batch *Batch) (BatchStats, error) {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return BatchStats{}, err
+	}
+	defer tx.Rollback()
+
+	stats, err := writeBatch(ctx, tx, batch)
+	if err != nil {
+		return stats, err
+	}
+	return stats, tx.Commit()
+}
+
+// writeBatch stores a batch within tx.
+func writeBatch(ctx context.Context, tx *sql.Tx, batch *Batch) (BatchStats, error) {
+	start := time.Now()
+	var stats BatchStats
+
+	byType := make(map[string][]BatchObject)
+	for _, obj := range batch.Objects() {
+		byType[obj.ObjectType] = append(byType[obj.ObjectType], obj)
+	}
+	types := make([]string, 0, len(byType))
+	for name := range byType {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+
+	for _, name := range types {
+		t, ok := LookupObjectType(name)
+		if !ok {
+			return stats, &ValidationError{Field: "ObjectType", Message: fmt.Sprintf("unknown object type %q", name)}
+		}
+		objects := lastObjectWrites(byType[name])
+		written, err := writeObjectBatch(ctx, tx, t, objects, start)
+		if err != nil {
+			return stats, fmt.Errorf("objects %s: %w", name, err)
+		}
+		stats.Objects += len(objects)
+		stats.Written += written
+	}
+
+	relations := lastRelationWrites(batch.Relations())
+	changes, err := writeRelationBatch(ctx, tx, relations, start)
+	if err != nil {
+		return stats, fmt.Errorf("relations: %w", err)
+	}
+	stats.Relations = len(relations)
+	stats.Changes = changes
+
+	for _, cursor := range batch.Cursors() {
+		if err := saveCursor(ctx, tx, &cursor); err != nil {
+			return stats, fmt.Errorf("cursors: %w", err)
+		}
+		stats.Cursors++
+	}
+
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// lastObjectWrites drops all but the last write of each object, keeping
+// the order of the remaining ones.
+func lastObjectWrites(objects []BatchObject) []BatchObject {
+	last := make(map[string]int, len(objects))
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		details, _ := json.Marshal(obj.Details)
+		keys[i] = fmt.Sprintf("%s|%s|%d|%s", obj.SocialNetworkType, obj.Owner.Type, obj.Owner.ID, details)
+		last[keys[i]] = i
+	}
+
+	result := objects[:0:0]
+	for i, obj := range objects {
+		if last[keys[i]] == i {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
+
+// lastRelationWrites drops all but the last write of each relation list,
+// keeping the order of the remaining ones.
+func lastRelationWrites(relations []BatchRelation) []BatchRelation {
+	last := make(map[string]int, len(relations))
+	keys := make([]string, len(relations))
+	for i, rel := range relations {
+		details, _ := json.Marshal(RelationKeyDetails(rel.Details))
+		keys[i] = fmt.Sprintf("%s|%s|%d|%s|%s", rel.SocialNetworkType, rel.Owner.Type, rel.Owner.ID, rel.RelationType, details)
+		last[keys[i]] = i
+	}
+
+	result := relations[:0:0]
+	for i, rel := range relations {
+		if last[keys[i]] == i {
+			result = append(result, rel)
+		}
+	}
+	return result
+}
+
+// copyRows loads rows with a COPY statement built by pq.CopyIn.
+func copyRows(ctx context.Context, tx *sql.Tx, copyStmt string, rows [][]interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, copyStmt)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+// writeObjectBatch merges objects of one type and returns how many were
+// inserted or changed.
+func writeObjectBatch(ctx context.Context, tx *sql.Tx, t ObjectType, objects []BatchObject, now time.Time) (int, error) {
+	_, err := tx.ExecContext(ctx, `
+		CREATE TEMP TABLE IF NOT EXISTS "ObjectStage" (
+			"Seq"               integer NOT NULL,
+			"SocialNetworkType" text NOT NULL,
+			"OwnerType"         text NOT NULL,
+			"OwnerID"           bigint NOT NULL,
+			"Details"           jsonb NOT NULL,
+			"Data"              jsonb NOT NULL,
+			"Hash"              text NOT NULL
+		) ON COMMIT DROP;
+		TRUNCATE "ObjectStage";
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	rows := make([][]interface{}, len(objects))
+	for i, obj := range objects {
+		details, err := json.Marshal(obj.Details)
+		if err != nil {
+			return 0, err
+		}
+		data, err := json.Marshal(obj.Data)
+		if err != nil {
+			return 0, err
+		}
+		hash, err := t.Hash(obj.Data)
+		if err != nil {
+			return 0, err
+		}
+		// COPY would send []byte as bytea, so JSON goes as text.
+		rows[i] = []interface{}{i, obj.SocialNetworkType, string(obj.Owner.Type), obj.Owner.ID, string(details), string(data), hash}
+	}
+	err = copyRows(ctx, tx, pq.CopyIn("ObjectStage", "Seq", "SocialNetworkType", "OwnerType", "OwnerID", "Details", "Data", "Hash"), rows)
+	if err != nil {
+		return 0, err
+	}
+
+	table := t.Table()
+	const join = `o."SocialNetworkType" = s."SocialNetworkType" AND o."OwnerType" = s."OwnerType"
+		AND o."OwnerID" = s."OwnerID" AND o."Details" = s."Details"`
+
+	// Rows whose data is equal but for volatile fields are refreshed
+	// without being archived. Their hash is equal too, unless they were
+	// written before hashing or hashed before a field became volatile.
+	// A nil array would be sent as NULL, which matches nothing.
+	volatile := pq.Array(append([]string{}, t.Volatile...))
+	_, err = tx.ExecContext(ctx, `
+		UPDATE `+table+` o SET "Hash" = s."Hash", "Data" = s."Data",
+			"Timestamp" = CASE WHEN o."Data" IS DISTINCT FROM s."Data" THEN $2 ELSE o."Timestamp" END
+		FROM "ObjectStage" s
+		WHERE `+join+` AND (o."Hash" IS DISTINCT FROM s."Hash" OR o."Data" IS DISTINCT FROM s."Data")
+			AND o."Data" - $1::text[] = s."Data" - $1::text[]
+	`, volatile, now)
+	if err != nil {
+		return 0, err
+	}
+
+	changed, err := tx.QueryContext(ctx, `
+		SELECT s."Seq", o."Data", o."Timestamp"
+		FROM "ObjectStage" s JOIN `+table+` o ON `+join+`
+		WHERE o."Hash" IS DISTINCT FROM s."Hash"
+		FOR UPDATE OF o
+	`)
+	if err != nil {
+		return 0, err
+	}
+	var history [][]interface{}
+	for changed.Next() {
+		var seq int
+		var oldData []byte
+		var validFrom time.Time
+		if err := changed.Scan(&seq, &oldData, &validFrom); err != nil {
+			changed.Close()
+			return 0, err
+		}
+
+		var old map[string]interface{}
+		if err := json.Unmarshal(oldData, &old); err != nil {
+			changed.Close()
+			return 0, err
+		}
+		diff, err := json.Marshal(t.Diff(old, objects[seq].Data))
+		if err != nil {
+			changed.Close()
+			return 0, err
+		}
+
+		obj := objects[seq]
+		details := rows[seq][4]
+		history = append(history, []interface{}{t.Name, obj.SocialNetworkType, string(obj.Owner.Type), obj.Owner.ID, details, string(oldData), validFrom, now, string(diff)})
+	}
+	changed.Close()
+	if err := changed.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(history) > 0 {
+		err := copyRows(ctx, tx, pq.CopyInSchema("public", "ObjectHistory", "ObjectType", "SocialNetworkType", "OwnerType", "OwnerID", "Details", "Data", "ValidFrom", "ReplacedAt", "Diff"), history)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO `+table+`
+		("Timestamp", "SocialNetworkType", "OwnerType", "OwnerID", "Details", "Data", "Hash")
+		SELECT $1::timestamptz, s."SocialNetworkType", s."OwnerType", s."OwnerID", s."Details", s."Data", s."Hash"
+		FROM "ObjectStage" s LEFT JOIN `+table+` o ON `+join+`
+		WHERE o."Hash" IS DISTINCT FROM s."Hash"
+		ON CONFLICT ("SocialNetworkType", "OwnerType", "OwnerID", "Details")
+		DO UPDATE SET "Timestamp" = EXCLUDED."Timestamp", "Data" = EXCLUDED."Data", "Hash" = EXCLUDED."Hash", "IsChanged" = true
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+	written, err := res.RowsAffected()
+	return int(written), err
+}
+
+// writeRelationBatch merges relation lists and returns the number of
+// change records it added.
+func writeRelationBatch(ctx context.Context, tx *sql.Tx, relations []BatchRelation, now time.Time) (int, error) {
+	if len(relations) == 0 {
+		return 0, nil
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		CREATE TEMP TABLE IF NOT EXISTS "RelationStage" (
+			"Seq"               integer NOT NULL,
+			"SocialNetworkType" text NOT NULL,
+			"OwnerType"         text NOT NULL,
+			"OwnerID"           bigint NOT NULL,
+			"RelationType"      text NOT NULL,
+			"Details"           jsonb NOT NULL,
+			"KeyDetails"        jsonb NOT NULL,
+			"IDs"               bigint[] NOT NULL
+		) ON COMMIT DROP;
+		TRUNCATE "RelationStage";
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]string, len(relations))
+	rows := make([][]interface{}, len(relations))
+	for i, rel := range relations {
+		details, err := json.Marshal(rel.Details)
+		if err != nil {
+			return 0, err
+		}
+		key, err := json.Marshal(RelationKeyDetails(rel.Details))
+		if err != nil {
+			return 0, err
+		}
+		keys[i] = string(key)
+		rows[i] = []interface{}{i, rel.SocialNetworkType, string(rel.Owner.Type), rel.Owner.ID, string(rel.RelationType), string(details), keys[i], pq.Array(nonNil(rel.IDs))}
+	}
+	err = copyRows(ctx, tx, pq.CopyIn("RelationStage", "Seq", "SocialNetworkType", "OwnerType", "OwnerID", "RelationType", "Details", "KeyDetails", "IDs"), rows)
+	if err != nil {
+		return 0, err
+	}
+
+	join := `r."SocialNetworkType" = s."SocialNetworkType" AND r."OwnerType" = s."OwnerType"
+		AND r."OwnerID" = s."OwnerID" AND r."RelationType" = s."RelationType"
+		AND ` + strings.ReplaceAll(relationKeyDetails, `"Details"`, `r."Details"`) + ` = s."KeyDetails"`
+
+	previous, err := tx.QueryContext(ctx, `
+		SELECT s."Seq", r."Details", r."IDs"
+		FROM "RelationStage" s JOIN public."Relations" r ON `+join+`
+		FOR UPDATE OF r
+	`)
+	if err != nil {
+		return 0, err
+	}
+	var changes [][]interface{}
+	for previous.Next() {
+		var seq int
+		var prevDetailsJSON []byte
+		var prevIDs []int64
+		if err := previous.Scan(&seq, &prevDetailsJSON, pq.Array(&prevIDs)); err != nil {
+			previous.Close()
+			return 0, err
+		}
+
+		var prevDetails map[string]interface{}
+		json.Unmarshal(prevDetailsJSON, &prevDetails)
+
+		rel := relations[seq]
+		added, removed := DiffRelationIDs(prevIDs, rel.IDs, RelationComplete(prevDetails), RelationComplete(rel.Details))
+		if len(added) > 0 || len(removed) > 0 {
+			changes = append(changes, []interface{}{now, rel.SocialNetworkType, string(rel.Owner.Type), rel.Owner.ID, string(rel.RelationType), keys[seq], pq.Array(nonNil(added)), pq.Array(nonNil(removed))})
+		}
+	}
+	previous.Close()
+	if err := previous.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(changes) > 0 {
+		err := copyRows(ctx, tx, pq.CopyInSchema("public", "RelationChanges", "Timestamp", "SocialNetworkType", "OwnerType", "OwnerID", "RelationType", "Details", "Added", "Removed"), changes)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO public."Relations"
+		("Timestamp", "SocialNetworkType", "OwnerType", "OwnerID", "RelationType", "Details", "IDs")
+		SELECT $1::timestamptz, "SocialNetworkType", "OwnerType", "OwnerID", "RelationType", "Details", "IDs"
+		FROM "RelationStage"
+		ON CONFLICT `+relationConflict+`
+		DO UPDATE SET "Timestamp" = EXCLUDED."Timestamp", "Details" = EXCLUDED."Details", "IDs" = EXCLUDED."IDs"
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(changes), nil
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrCursorNotFound is returned when nothing has been collected for a
+// cursor yet.
+var ErrCursorNotFound = errors.New("cursor not found")
+
+// Cursor records how far a list has been collected, so that later runs
+// only fetch what is new.
+type Cursor struct {
+	SocialNetworkType string
+	Owner             Owner
+	Kind              CollectKind
+	// NewestID and NewestDate describe the newest item seen.
+	NewestID   int64
+	NewestDate time.Time
+	// IDs is the known list, newest first, as last written as a relation.
+	IDs []int64
+	// Complete is false when the last full sync was cut short.
+	Complete bool
+	// LastFullSync is when the whole list was last fetched.
+	LastFullSync time.Time
+}
+
+func (db *DB) GetCursor(socialNetworkType string, owner Owner, kind CollectKind) (*Cursor, error) {
+	return db.GetCursorContext(context.Background(), socialNetworkType, owner, kind)
+}
+
+func (db *DB) GetCursorContext(ctx context.Context, socialNetworkType string, owner Owner, kind CollectKind) (*Cursor, error) {
+	query := `
+		SELECT "NewestID", "NewestDate", "IDs", "Complete", "LastFullSync"
+		FROM public."Cursors"
+		WHERE "SocialNetworkType" = $1 AND "OwnerType" = $2 AND "OwnerID" = $3 AND "Kind" = $4
+	`
+
+	cursor := Cursor{SocialNetworkType: socialNetworkType, Owner: owner, Kind: kind}
+	err := db.conn.QueryRowContext(ctx, query, socialNetworkType, owner.Type, owner.ID, kind).Scan(
+		&cursor.NewestID,
+		&cursor.NewestDate,
+		pq.Array(&cursor.IDs),
+		&cursor.Complete,
+		&cursor.LastFullSync,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrCursorNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursor, nil
+}
+
+func (db *DB) SaveCursor(cursor *Cursor) error {
+	return db.SaveCursorContext(context.Background(), cursor)
+}
+
+// SaveCursorContext creates or replaces a cursor.
+func (db *DB) SaveCursorContext(ctx context.Context, cursor *Cursor) error {
+	return saveCursor(ctx, db.conn, cursor)
+}
+
+// execer is what saveCursor needs of *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func saveCursor(ctx context.Context, conn execer, cursor *Cursor) error {
+	query := `
+		INSERT INTO public."Cursors"
+		("SocialNetworkType", "OwnerType", "OwnerID", "Kind", "NewestID", "NewestDate",
+		 "IDs", "Complete", "LastFullSync", "UpdatedAt")
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now())
+		ON CONFLICT ("SocialNetworkType", "OwnerType", "OwnerID", "Kind")
+		DO UPDATE SET
+			"NewestID" = EXCLUDED."NewestID",
+			"NewestDate" = EXCLUDED."NewestDate",
+			"IDs" = EXCLUDED."IDs",
+			"Complete" = EXCLUDED."Complete",
+			"LastFullSync" = EXCLUDED."LastFullSync",
+			"UpdatedAt" = now()
+	`
+
+	ids := cursor.IDs
+	if ids == nil {
+		ids = []int64{}
+	}
+
+	_, err := conn.ExecContext(ctx, query,
+		cursor.SocialNetworkType,
+		cursor.Owner.Type,
+		cursor.Owner.ID,
+		cursor.Kind,
+		cursor.NewestID,
+		cursor.NewestDate,
+		pq.Array(ids),
+		cursor.Complete,
+		cursor.LastFullSync,
+	)
+	return err
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"github.com/lib/pq"
@@ -9,6 +10,8 @@ import (
 
 type DB struct {
 	conn *sql.DB
+	// connStr opens the extra connections of listeners.
+	connStr string
 }
 
 type OwnerType string
@@ -35,6 +38,10 @@ const (
 	RelationTypePhotoLike    RelationType = "photo.like"
 	RelationTypePostComment  RelationType = "post.comment"
 	RelationTypePhotoComment RelationType = "photo.comment"
+	RelationTypeMember       RelationType = "member"
+	RelationTypeAlbum        RelationType = "album"
+	RelationTypeTopic        RelationType = "topic"
+	RelationTypeTopicComment RelationType = "topic.comment"
 )
 
 func New(connStr string) (*DB, error) {
@@ -51,7 +58,7 @@ func New(connStr string) (*DB, error) {
 		return nil, err
 	}
 
-	return &DB{conn: conn}, nil
+	return &DB{conn: conn, connStr: connStr}, nil
 }
 
 func (db *DB) Close() error {
@@ -59,42 +66,194 @@ func (db *DB) Close() error {
 }
 
 func (db *DB) WriteRelations(socialNetworkType string, owner Owner, relationType RelationType, details map[string]interface{}, ids []int64) error {
+	return db.WriteRelationsContext(context.Background(), socialNetworkType, owner, relationType, details, ids)
+}
+
+// WriteRelationsContext replaces a relation list and records the IDs added
+// and removed since the previous write in "RelationChanges". Lists are
+// identified by their details without the completeness flag, so a list
+// that becomes complete or incomplete replaces its previous row.
+func (db *DB) WriteRelationsContext(ctx context.Context, socialNetworkType string, owner Owner, relationType RelationType, details map[string]interface{}, ids []int64) error {
 	detailsJSON, err := json.Marshal(details)
 	if err != nil {
 		return err
 	}
+	keyJSON, err := json.Marshal(RelationKeyDetails(details))
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
 	query := `
+		SELECT "Details", "IDs" FROM public."Relations"
+		WHERE "SocialNetworkType" = $1 AND "OwnerType" = $2 AND "OwnerID" = $3
+		  AND "RelationType" = $4 AND ` + relationKeyDetails + ` = $5::jsonb
+		FOR UPDATE
+	`
+	var prevDetailsJSON []byte
+	var prevIDs []int64
+	err = tx.QueryRowContext(ctx, query, socialNetworkType, owner.Type, owner.ID, relationType, keyJSON).Scan(&prevDetailsJSON, pq.Array(&prevIDs))
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	now := time.Now()
+	if err == nil {
+		var prevDetails map[string]interface{}
+		json.Unmarshal(prevDetailsJSON, &prevDetails)
+
+		added, removed := DiffRelationIDs(prevIDs, ids, RelationComplete(prevDetails), RelationComplete(details))
+		if len(added) > 0 || len(removed) > 0 {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO public."RelationChanges"
+				("Timestamp", "SocialNetworkType", "OwnerType", "OwnerID", "RelationType", "Details", "Added", "Removed")
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			`, now, socialNetworkType, owner.Type, owner.ID, relationType, keyJSON, pq.Array(nonNil(added)), pq.Array(nonNil(removed)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	query = `
 		INSERT INTO public."Relations" 
 		("Timestamp", "SocialNetworkType", "OwnerType", "OwnerID", "RelationType", "Details", "IDs")
 		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		ON CONFLICT ("SocialNetworkType", "OwnerType", "OwnerID", "RelationType", "Details")
-		DO UPDATE SET "Timestamp" = EXCLUDED."Timestamp", "IDs" = EXCLUDED."IDs"
+		ON CONFLICT ` + relationConflict + `
+		DO UPDATE SET "Timestamp" = EXCLUDED."Timestamp", "Details" = EXCLUDED."Details", "IDs" = EXCLUDED."IDs"
 	`
 
-	_, err = db.conn.Exec(query, time.Now(), socialNetworkType, owner.Type, owner.ID, relationType, detailsJSON, ids)
-	return err
+	_, err = tx.ExecContext(ctx, query, now, socialNetworkType, owner.Type, owner.ID, relationType, detailsJSON, pq.Array(nonNil(ids)))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// nonNil returns ids, or an empty slice for nil, which pq.Array would
+// store as NULL.
+func nonNil(ids []int64) []int64 {
+	if ids == nil {
+		return []int64{}
+	}
+	return ids
 }
 
 func (db *DB) WriteObject(socialNetworkType string, owner Owner, objectType string, details map[string]interface{}, data map[string]interface{}) error {
+	return db.WriteObjectContext(context.Background(), socialNetworkType, owner, objectType, details, data)
+}
+
+// WriteObjectContext stores an object. Objects whose content hash is
+// unchanged only have their volatile fields refreshed; a changed object is
+// archived to ObjectHistory together with the field changes before it is
+// replaced.
+func (db *DB) WriteObjectContext(ctx context.Context, socialNetworkType string, owner Owner, objectType string, details map[string]interface{}, data map[string]interface{}) error {
 	detailsJSON, err := json.Marshal(details)
 	if err != nil {
 		return err
 	}
 
+	data, err = normalizeJSON(data)
+	if err != nil {
+		return err
+	}
+	decodedDetails, err := normalizeJSON(details)
+	if err != nil {
+		return err
+	}
+	t, err := ValidateObject(objectType, decodedDetails, data)
+	if err != nil {
+		return err
+	}
 	dataJSON, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
+	hash, err := t.Hash(data)
+	if err != nil {
+		return err
+	}
 
-	query := `
-		INSERT INTO public."Objects_` + objectType + `" 
-		("Timestamp", "SocialNetworkType", "OwnerType", "OwnerID", "Details", "Data")
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT ("SocialNetworkType", "OwnerType", "OwnerID", "Details")
-		DO UPDATE SET "Timestamp" = EXCLUDED."Timestamp", "Data" = EXCLUDED."Data", "IsChanged" = true
-	`
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	table := t.Table()
+	now := time.Now()
+
+	var oldHash sql.NullString
+	var oldDataJSON []byte
+	var oldTimestamp time.Time
+	var sameData bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT "Hash", CASE WHEN "Hash" IS DISTINCT FROM $5 THEN "Data" END, "Timestamp", "Data" = $6::jsonb
+		FROM `+table+`
+		WHERE "SocialNetworkType" = $1 AND "OwnerType" = $2 AND "OwnerID" = $3 AND "Details" = $4
+		FOR UPDATE
+	`, socialNetworkType, owner.Type, owner.ID, detailsJSON, hash, dataJSON).Scan(&oldHash, &oldDataJSON, &oldTimestamp, &sameData)
+
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO `+table+`
+			("Timestamp", "SocialNetworkType", "OwnerType", "OwnerID", "Details", "Data", "Hash")
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT ("SocialNetworkType", "OwnerType", "OwnerID", "Details")
+			DO UPDATE SET "Timestamp" = EXCLUDED."Timestamp", "Data" = EXCLUDED."Data", "Hash" = EXCLUDED."Hash", "IsChanged" = true
+		`, now, socialNetworkType, owner.Type, owner.ID, detailsJSON, dataJSON, hash)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	case err != nil:
+		return err
+	case oldHash.Valid && oldHash.String == hash && sameData:
+		return nil
+	}
+
+	// An equal hash means that at most volatile fields changed: the data
+	// is refreshed, but nothing is archived. Rows written before hashing
+	// have no hash yet, and rows hashed before a field became volatile
+	// have a stale one; they are diffed to find out.
+	var diff []FieldChange
+	if !oldHash.Valid || oldHash.String != hash {
+		var oldData map[string]interface{}
+		if err := json.Unmarshal(oldDataJSON, &oldData); err != nil {
+			return err
+		}
+		diff = t.Diff(oldData, data)
+	}
+	if len(diff) > 0 {
+		diffJSON, err := json.Marshal(diff)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO public."ObjectHistory"
+			("ObjectType", "SocialNetworkType", "OwnerType", "OwnerID", "Details", "Data", "ValidFrom", "ReplacedAt", "Diff")
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`, objectType, socialNetworkType, owner.Type, owner.ID, detailsJSON, oldDataJSON, oldTimestamp, now, diffJSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `UPDATE ` + table + ` SET "Hash" = $5, "Timestamp" = $6, "Data" = $7`
+	if len(diff) > 0 {
+		query += `, "IsChanged" = true`
+	}
+	query += ` WHERE "SocialNetworkType" = $1 AND "OwnerType" = $2 AND "OwnerID" = $3 AND "Details" = $4`
+	if _, err := tx.ExecContext(ctx, query, socialNetworkType, owner.Type, owner.ID, detailsJSON, hash, now, dataJSON); err != nil {
+		return err
+	}
 
-	_, err = db.conn.Exec(query, time.Now(), socialNetworkType, owner.Type, owner.ID, detailsJSON, dataJSON)
-	return err
+	return tx.Commit()
 }
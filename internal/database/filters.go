@@ -0,0 +1,209 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CollectKind names a kind of relation or object a task can collect.
+type CollectKind string
+
+const (
+	KindFriends   CollectKind = "friends"
+	KindFollowers CollectKind = "followers"
+	KindGroups    CollectKind = "groups"
+	KindMembers   CollectKind = "members"
+	KindPosts     CollectKind = "posts"
+	KindLikes     CollectKind = "likes"
+	KindComments  CollectKind = "comments"
+	KindPhotos    CollectKind = "photos"
+	KindTopics    CollectKind = "topics"
+)
+
+// CollectKinds lists every kind. Kinds that do not apply to the owner of
+// a task, such as members for a user, are ignored.
+var CollectKinds = []CollectKind{
+	KindFriends, KindFollowers, KindGroups, KindMembers, KindPosts,
+	KindLikes, KindComments, KindPhotos, KindTopics,
+}
+
+// datedKinds are the kinds whose items have a date and can be limited to a
+// date range.
+var datedKinds = map[CollectKind]bool{
+	KindPosts:    true,
+	KindComments: true,
+	KindPhotos:   true,
+	KindTopics:   true,
+}
+
+// filterSpec is the JSON schema of the "Filters" column:
+//
+//	{
+//	  "kinds": ["friends", "posts", "likes"],
+//	  "since": {"posts": "2024-01-01T00:00:00Z"},
+//	  "until": {"posts": "2024-07-01T00:00:00Z"},
+//	  "max_age_days": {"comments": 30}
+//	}
+//
+// Every field is optional. Without "kinds" everything is collected.
+type filterSpec struct {
+	Kinds      []CollectKind             `json:"kinds"`
+	Since      map[CollectKind]time.Time `json:"since"`
+	Until      map[CollectKind]time.Time `json:"until"`
+	MaxAgeDays map[CollectKind]float64   `json:"max_age_days"`
+}
+
+// TaskFilters is the parsed form of the Filters and FilterLimits of a
+// task. The zero value collects everything with the default limits.
+type TaskFilters struct {
+	kinds  map[CollectKind]bool
+	limits map[CollectKind]int
+	since  map[CollectKind]time.Time
+	until  map[CollectKind]time.Time
+	maxAge map[CollectKind]time.Duration
+}
+
+// ParseTaskFilters parses and validates the Filters and FilterLimits of a
+// task. FilterLimits maps kinds to the maximum number of items collected
+// per list, e.g. {"friends": 1000, "likes": 500}. Errors are
+// *ValidationError.
+func ParseTaskFilters(filters, limits map[string]interface{}) (*TaskFilters, error) {
+	var spec filterSpec
+	if err := decodeStrict(filters, &spec); err != nil {
+		return nil, &ValidationError{Field: "Filters", Message: err.Error()}
+	}
+
+	f := &TaskFilters{
+		since:  spec.Since,
+		until:  spec.Until,
+		maxAge: make(map[CollectKind]time.Duration, len(spec.MaxAgeDays)),
+	}
+
+	if spec.Kinds != nil {
+		f.kinds = make(map[CollectKind]bool, len(spec.Kinds))
+		for _, kind := range spec.Kinds {
+			if !knownKind(kind) {
+				return nil, &ValidationError{Field: "Filters", Message: fmt.Sprintf("unknown kind %q in kinds (known: %s)", kind, kindList())}
+			}
+			f.kinds[kind] = true
+		}
+	}
+
+	dated := []struct {
+		field string
+		kinds []CollectKind
+	}{
+		{"since", mapKeys(spec.Since)},
+		{"until", mapKeys(spec.Until)},
+		{"max_age_days", mapKeys(spec.MaxAgeDays)},
+	}
+	for _, d := range dated {
+		for _, kind := range d.kinds {
+			if !datedKinds[kind] {
+				return nil, &ValidationError{Field: "Filters", Message: fmt.Sprintf("%s: kind %q has no dates", d.field, kind)}
+			}
+		}
+	}
+	for kind, since := range spec.Since {
+		if until, ok := spec.Until[kind]; ok && !since.Before(until) {
+			return nil, &ValidationError{Field: "Filters", Message: fmt.Sprintf("since must be before until for %q", kind)}
+		}
+	}
+	for kind, days := range spec.MaxAgeDays {
+		if days <= 0 {
+			return nil, &ValidationError{Field: "Filters", Message: fmt.Sprintf("max_age_days for %q must be positive", kind)}
+		}
+		f.maxAge[kind] = time.Duration(days * float64(24*time.Hour))
+	}
+
+	if err := decodeStrict(limits, &f.limits); err != nil {
+		return nil, &ValidationError{Field: "FilterLimits", Message: err.Error()}
+	}
+	for kind, limit := range f.limits {
+		if !knownKind(kind) {
+			return nil, &ValidationError{Field: "FilterLimits", Message: fmt.Sprintf("unknown kind %q (known: %s)", kind, kindList())}
+		}
+		if limit <= 0 {
+			return nil, &ValidationError{Field: "FilterLimits", Message: fmt.Sprintf("limit for %q must be positive", kind)}
+		}
+	}
+
+	return f, nil
+}
+
+// Collects reports whether kind is to be collected.
+func (f *TaskFilters) Collects(kind CollectKind) bool {
+	return f == nil || f.kinds == nil || f.kinds[kind]
+}
+
+// Limit returns the item limit set for kind, or zero if there is none.
+func (f *TaskFilters) Limit(kind CollectKind) int {
+	if f == nil {
+		return 0
+	}
+	return f.limits[kind]
+}
+
+// Window returns the date range of kind at time now. A zero since or until
+// leaves that end open. max_age_days moves since forward when it is later
+// than the configured one.
+func (f *TaskFilters) Window(kind CollectKind, now time.Time) (since, until time.Time) {
+	if f == nil {
+		return time.Time{}, time.Time{}
+	}
+
+	since = f.since[kind]
+	if maxAge, ok := f.maxAge[kind]; ok {
+		if oldest := now.Add(-maxAge); oldest.After(since) {
+			since = oldest
+		}
+	}
+	return since, f.until[kind]
+}
+
+// decodeStrict converts a JSON object stored as a map into v, rejecting
+// unknown fields.
+func decodeStrict(m map[string]interface{}, v interface{}) error {
+	if m == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func knownKind(kind CollectKind) bool {
+	for _, k := range CollectKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func kindList() string {
+	names := make([]string, len(CollectKinds))
+	for i, kind := range CollectKinds {
+		names[i] = string(kind)
+	}
+	return strings.Join(names, ", ")
+}
+
+func mapKeys[V any](m map[CollectKind]V) []CollectKind {
+	keys := make([]CollectKind, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
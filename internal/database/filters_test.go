@@ -0,0 +1,159 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// jsonMap decodes a JSON object the way task columns are read.
+func jsonMap(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+
+	if s == "" {
+		return nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestParseTaskFiltersErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters string
+		limits  string
+		field   string // of the ValidationError, empty if valid
+	}{
+		{"none", "", "", ""},
+		{"empty", `{}`, `{}`, ""},
+		{"kinds", `{"kinds": ["friends", "posts"]}`, "", ""},
+		{"no kinds", `{"kinds": []}`, "", ""},
+		{"unknown kind", `{"kinds": ["friends", "videos"]}`, "", "Filters"},
+		{"unknown field", `{"kind": ["friends"]}`, "", "Filters"},
+		{"kinds not a list", `{"kinds": "friends"}`, "", "Filters"},
+		{"since", `{"since": {"posts": "2024-01-01T00:00:00Z"}}`, "", ""},
+		{"since and until", `{"since": {"posts": "2024-01-01T00:00:00Z"}, "until": {"posts": "2024-07-01T00:00:00Z"}}`, "", ""},
+		{"since after until", `{"since": {"posts": "2024-07-01T00:00:00Z"}, "until": {"posts": "2024-01-01T00:00:00Z"}}`, "", "Filters"},
+		{"since equals until", `{"since": {"posts": "2024-01-01T00:00:00Z"}, "until": {"posts": "2024-01-01T00:00:00Z"}}`, "", "Filters"},
+		{"bad date", `{"since": {"posts": "yesterday"}}`, "", "Filters"},
+		{"undated kind", `{"since": {"friends": "2024-01-01T00:00:00Z"}}`, "", "Filters"},
+		{"undated max age", `{"max_age_days": {"likes": 7}}`, "", "Filters"},
+		{"max age", `{"max_age_days": {"comments": 30}}`, "", ""},
+		{"fractional max age", `{"max_age_days": {"comments": 0.5}}`, "", ""},
+		{"zero max age", `{"max_age_days": {"comments": 0}}`, "", "Filters"},
+		{"negative max age", `{"max_age_days": {"comments": -1}}`, "", "Filters"},
+		{"limits", "", `{"friends": 1000, "likes": 500}`, ""},
+		{"unknown limit kind", "", `{"videos": 10}`, "FilterLimits"},
+		{"zero limit", "", `{"friends": 0}`, "FilterLimits"},
+		{"negative limit", "", `{"friends": -5}`, "FilterLimits"},
+		{"fractional limit", "", `{"friends": 1.5}`, "FilterLimits"},
+		{"limit not a number", "", `{"friends": "many"}`, "FilterLimits"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseTaskFilters(jsonMap(t, tt.filters), jsonMap(t, tt.limits))
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if f == nil {
+					t.Fatal("got nil filters")
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("got %v, want a *ValidationError", err)
+			}
+			if verr.Field != tt.field {
+				t.Errorf("got field %q, want %q", verr.Field, tt.field)
+			}
+		})
+	}
+}
+
+func TestTaskFiltersCollects(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters string
+		kind    CollectKind
+		want    bool
+	}{
+		{"everything by default", "", KindMembers, true},
+		{"listed", `{"kinds": ["friends", "posts"]}`, KindPosts, true},
+		{"not listed", `{"kinds": ["friends", "posts"]}`, KindLikes, false},
+		{"empty list", `{"kinds": []}`, KindFriends, false},
+		{"dates only", `{"since": {"posts": "2024-01-01T00:00:00Z"}}`, KindFriends, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseTaskFilters(jsonMap(t, tt.filters), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Collects(tt.kind); got != tt.want {
+				t.Errorf("Collects(%s) = %v, want %v", tt.kind, got, tt.want)
+			}
+		})
+	}
+
+	var nilFilters *TaskFilters
+	if !nilFilters.Collects(KindFriends) || nilFilters.Limit(KindFriends) != 0 {
+		t.Error("nil filters do not collect everything without limits")
+	}
+}
+
+func TestTaskFiltersLimit(t *testing.T) {
+	f, err := ParseTaskFilters(nil, jsonMap(t, `{"friends": 1000, "likes": 500}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kind, want := range map[CollectKind]int{KindFriends: 1000, KindLikes: 500, KindPosts: 0} {
+		if got := f.Limit(kind); got != want {
+			t.Errorf("Limit(%s) = %d, want %d", kind, got, want)
+		}
+	}
+}
+
+func TestTaskFiltersWindow(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	jul := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		filters   string
+		kind      CollectKind
+		wantSince time.Time
+		wantUntil time.Time
+	}{
+		{"open", "", KindPosts, time.Time{}, time.Time{}},
+		{"since", `{"since": {"posts": "2024-01-01T00:00:00Z"}}`, KindPosts, jan, time.Time{}},
+		{"other kind", `{"since": {"posts": "2024-01-01T00:00:00Z"}}`, KindPhotos, time.Time{}, time.Time{}},
+		{"until", `{"until": {"posts": "2024-07-01T00:00:00Z"}}`, KindPosts, time.Time{}, jul},
+		{"max age", `{"max_age_days": {"comments": 10}}`, KindComments, now.AddDate(0, 0, -10), time.Time{}},
+		{"max age later than since", `{"since": {"posts": "2024-01-01T00:00:00Z"}, "max_age_days": {"posts": 7}}`, KindPosts, now.AddDate(0, 0, -7), time.Time{}},
+		{"since later than max age", `{"since": {"posts": "2024-01-01T00:00:00Z"}, "max_age_days": {"posts": 365}}`, KindPosts, jan, time.Time{}},
+		{"max age and until", `{"until": {"posts": "2024-07-01T00:00:00Z"}, "max_age_days": {"posts": 1}}`, KindPosts, now.AddDate(0, 0, -1), jul},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseTaskFilters(jsonMap(t, tt.filters), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			since, until := f.Window(tt.kind, now)
+			if !since.Equal(tt.wantSince) || !until.Equal(tt.wantUntil) {
+				t.Errorf("got [%v, %v), want [%v, %v)", since, until, tt.wantSince, tt.wantUntil)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package memstore
+
+import (
+	"context"
+
+	"github.com/Nakray/sn/internal/database"
+)
+
+type cursorKey struct {
+	socialNetworkType string
+	owner             database.Owner
+	kind              database.CollectKind
+}
+
+func (s *Store) GetCursorContext(ctx context.Context, socialNetworkType string, owner database.Owner, kind database.CollectKind) (*database.Cursor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cursor, ok := s.cursors[cursorKey{socialNetworkType, owner, kind}]
+	if !ok {
+		return nil, database.ErrCursorNotFound
+	}
+	cursor.IDs = append([]int64(nil), cursor.IDs...)
+	return &cursor, nil
+}
+
+func (s *Store) SaveCursorContext(ctx context.Context, cursor *database.Cursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *cursor
+	saved.IDs = append([]int64(nil), cursor.IDs...)
+	s.cursors[cursorKey{cursor.SocialNetworkType, cursor.Owner, cursor.Kind}] = saved
+	return nil
+}
@@ -0,0 +1,607 @@
+// Package memstore is an in-memory implementation of database.Store with
+// the same upsert, leasing and validation semantics as the PostgreSQL
+// backend. It lets the collector and the scheduler run without a database.
+package memstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Nakray/sn/internal/database"
+)
+
+// Relation is a stored relation list.
+type Relation struct {
+	Timestamp         time.Time
+	SocialNetworkType string
+	Owner             database.Owner
+	RelationType      database.RelationType
+	Details           map[string]interface{}
+	IDs               []int64
+}
+
+// Object is a stored object.
+type Object struct {
+	Timestamp         time.Time
+	SocialNetworkType string
+	Owner             database.Owner
+	ObjectType        string
+	Details           map[string]interface{}
+	Data              map[string]interface{}
+	Hash              string
+	IsChanged         bool
+}
+
+type taskRecord struct {
+	task database.MonitoringTask
+	// unlocked mirrors the "IsUnlocked" column: nil for plain periodic
+	// tasks, false or true for unlockable ones.
+	unlocked *bool
+}
+
+// Store keeps all data in maps guarded by a single mutex.
+type Store struct {
+	mu            sync.Mutex
+	relations     map[string]*Relation
+	objects       map[string]*Object
+	accounts      map[int64]*database.Account
+	tasks         map[int64]*taskRecord
+	cursors       map[cursorKey]database.Cursor
+	changes       []database.RelationChange
+	history       []database.ObjectVersion
+	runs          []database.TaskRun
+	nextChangeID  int64
+	nextVersionID int64
+	nextRunID     int64
+	nextAccountID int64
+	nextTaskID    int64
+	listeners     []chan struct{}
+}
+
+var _ database.Store = (*Store)(nil)
+
+func New() *Store {
+	return &Store{
+		relations: make(map[string]*Relation),
+		objects:   make(map[string]*Object),
+		accounts:  make(map[int64]*database.Account),
+		tasks:     make(map[int64]*taskRecord),
+		cursors:   make(map[cursorKey]database.Cursor),
+	}
+}
+
+// detailsKey encodes details the way they are compared by the unique keys
+// of the PostgreSQL tables. encoding/json sorts map keys, so equal details
+// give equal keys.
+func detailsKey(details map[string]interface{}) (string, error) {
+	b, err := json.Marshal(details)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// cloneMap deep-copies a JSON-like map by round-tripping it through JSON,
+// which also normalizes numbers to float64 as a read from jsonb would.
+func cloneMap(m map[string]interface{}) (map[string]interface{}, error) {
+	if m == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func relationKey(socialNetworkType string, owner database.Owner, relationType database.RelationType, details string) string {
+	return fmt.Sprintf("%s|%s|%d|%s|%s", socialNetworkType, owner.Type, owner.ID, relationType, details)
+}
+
+func objectKey(socialNetworkType string, owner database.Owner, objectType string, details string) string {
+	return fmt.Sprintf("%s|%s|%s|%d|%s", objectType, socialNetworkType, owner.Type, owner.ID, details)
+}
+
+// WriteRelationsContext replaces a relation list and records the change
+// against the previous one, like the PostgreSQL backend. Lists are keyed
+// by their details without the completeness flag.
+func (s *Store) WriteRelationsContext(ctx context.Context, socialNetworkType string, owner database.Owner, relationType database.RelationType, details map[string]interface{}, ids []int64) error {
+	keyDetails := database.RelationKeyDetails(details)
+	key, err := detailsKey(keyDetails)
+	if err != nil {
+		return err
+	}
+	stored, err := cloneMap(details)
+	if err != nil {
+		return err
+	}
+	storedKey, err := cloneMap(keyDetails)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writeRelations(time.Now(), socialNetworkType, owner, relationType, key, stored, storedKey, ids)
+	return nil
+}
+
+// writeRelations stores a relation list. s.mu must be held.
+func (s *Store) writeRelations(now time.Time, socialNetworkType string, owner database.Owner, relationType database.RelationType, key string, details, storedKey map[string]interface{}, ids []int64) int {
+	changes := 0
+	rk := relationKey(socialNetworkType, owner, relationType, key)
+	if prev, ok := s.relations[rk]; ok {
+		added, removed := database.DiffRelationIDs(prev.IDs, ids, database.RelationComplete(prev.Details), database.RelationComplete(details))
+		if len(added) > 0 || len(removed) > 0 {
+			s.nextChangeID++
+			s.changes = append(s.changes, database.RelationChange{
+				ID:                s.nextChangeID,
+				Timestamp:         now,
+				SocialNetworkType: socialNetworkType,
+				Owner:             owner,
+				RelationType:      relationType,
+				Details:           storedKey,
+				Added:             added,
+				Removed:           removed,
+			})
+			changes++
+		}
+	}
+
+	s.relations[rk] = &Relation{
+		Timestamp:         now,
+		SocialNetworkType: socialNetworkType,
+		Owner:             owner,
+		RelationType:      relationType,
+		Details:           details,
+		IDs:               append([]int64(nil), ids...),
+	}
+	return changes
+}
+
+func (s *Store) WriteObjectContext(ctx context.Context, socialNetworkType string, owner database.Owner, objectType string, details map[string]interface{}, data map[string]interface{}) error {
+	key, err := detailsKey(details)
+	if err != nil {
+		return err
+	}
+	storedDetails, err := cloneMap(details)
+	if err != nil {
+		return err
+	}
+	storedData, err := cloneMap(data)
+	if err != nil {
+		return err
+	}
+	t, err := database.ValidateObject(objectType, storedDetails, storedData)
+	if err != nil {
+		return err
+	}
+	hash, err := t.Hash(storedData)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writeObject(time.Now(), socialNetworkType, owner, t, key, storedDetails, storedData, hash)
+	return nil
+}
+
+// writeObject stores an object of type t and reports whether it was
+// written. An object with an unchanged hash only has its volatile fields
+// refreshed and does not count as written. s.mu must be held.
+func (s *Store) writeObject(now time.Time, socialNetworkType string, owner database.Owner, t database.ObjectType, key string, storedDetails, storedData map[string]interface{}, hash string) bool {
+	k := objectKey(socialNetworkType, owner, t.Name, key)
+	if old, ok := s.objects[k]; ok {
+		if old.Hash == hash {
+			if !reflect.DeepEqual(old.Data, storedData) {
+				old.Data = storedData
+				old.Timestamp = now
+			}
+			return false
+		}
+		s.nextVersionID++
+		oldDetails, _ := cloneMap(old.Details)
+		s.history = append(s.history, database.ObjectVersion{
+			ID:                s.nextVersionID,
+			ObjectType:        t.Name,
+			SocialNetworkType: socialNetworkType,
+			Owner:             owner,
+			Details:           oldDetails,
+			Data:              old.Data,
+			ValidFrom:         old.Timestamp,
+			ReplacedAt:        now,
+			Diff:              t.Diff(old.Data, storedData),
+		})
+	}
+
+	s.objects[k] = &Object{
+		Timestamp:         now,
+		SocialNetworkType: socialNetworkType,
+		Owner:             owner,
+		ObjectType:        t.Name,
+		Details:           storedDetails,
+		Data:              storedData,
+		Hash:              hash,
+		IsChanged:         true,
+	}
+	return true
+}
+
+// WriteBatchContext stores a batch under a single lock, so that it is seen
+// as a whole, like the PostgreSQL backend does with a transaction.
+func (s *Store) WriteBatchContext(ctx context.Context, batch *database.Batch) (database.BatchStats, error) {
+	start := time.Now()
+	writes, err := prepareBatch(batch)
+	if err != nil {
+		return database.BatchStats{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applyBatch(start, writes), nil
+}
+
+type objectWrite struct {
+	obj  database.BatchObject
+	t    database.ObjectType
+	key  string
+	hash string
+}
+
+type relationWrite struct {
+	rel      database.BatchRelation
+	key      string
+	keyStore map[string]interface{}
+}
+
+// batchWrites is a batch validated and encoded for applyBatch.
+type batchWrites struct {
+	objects   []objectWrite
+	relations []relationWrite
+	cursors   []database.Cursor
+}
+
+// prepareBatch validates and encodes the writes of batch without holding
+// s.mu. Nothing of a batch that fails validation is stored.
+func prepareBatch(batch *database.Batch) (*batchWrites, error) {
+	objects := batch.Objects()
+	writes := &batchWrites{
+		objects: make([]objectWrite, len(objects)),
+		cursors: batch.Cursors(),
+	}
+	for i, obj := range objects {
+		t, err := database.ValidateObject(obj.ObjectType, obj.Details, obj.Data)
+		if err != nil {
+			return nil, err
+		}
+		key, err := detailsKey(obj.Details)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := t.Hash(obj.Data)
+		if err != nil {
+			return nil, err
+		}
+		obj.Details, _ = cloneMap(obj.Details)
+		obj.Data, _ = cloneMap(obj.Data)
+		writes.objects[i] = objectWrite{obj: obj, t: t, key: key, hash: hash}
+	}
+
+	relations := batch.Relations()
+	writes.relations = make([]relationWrite, len(relations))
+	for i, rel := range relations {
+		keyDetails := database.RelationKeyDetails(rel.Details)
+		key, err := detailsKey(keyDetails)
+		if err != nil {
+			return nil, err
+		}
+		rel.Details, _ = cloneMap(rel.Details)
+		storedKey, _ := cloneMap(keyDetails)
+		writes.relations[i] = relationWrite{rel: rel, key: key, keyStore: storedKey}
+	}
+	return writes, nil
+}
+
+// applyBatch stores prepared writes. s.mu must be held.
+func (s *Store) applyBatch(start time.Time, writes *batchWrites) database.BatchStats {
+	var stats database.BatchStats
+
+	now := time.Now()
+	written := make(map[string]bool)
+	for _, w := range writes.objects {
+		k := objectKey(w.obj.SocialNetworkType, w.obj.Owner, w.obj.ObjectType, w.key)
+		if s.writeObject(now, w.obj.SocialNetworkType, w.obj.Owner, w.t, w.key, w.obj.Details, w.obj.Data, w.hash) {
+			written[k] = true
+		} else if _, ok := written[k]; !ok {
+			written[k] = false
+		}
+	}
+	stats.Objects = len(written)
+	for _, ok := range written {
+		if ok {
+			stats.Written++
+		}
+	}
+
+	lists := make(map[string]bool)
+	for _, w := range writes.relations {
+		stats.Changes += s.writeRelations(now, w.rel.SocialNetworkType, w.rel.Owner, w.rel.RelationType, w.key, w.rel.Details, w.keyStore, w.rel.IDs)
+		lists[relationKey(w.rel.SocialNetworkType, w.rel.Owner, w.rel.RelationType, w.key)] = true
+	}
+	stats.Relations = len(lists)
+
+	for _, cursor := range writes.cursors {
+		cursor.IDs = append([]int64(nil), cursor.IDs...)
+		s.cursors[cursorKey{cursor.SocialNetworkType, cursor.Owner, cursor.Kind}] = cursor
+		stats.Cursors++
+	}
+
+	stats.Duration = time.Since(start)
+	return stats
+}
+
+// Relation returns the stored IDs of a relation. The completeness flag in
+// details is ignored.
+func (s *Store) Relation(socialNetworkType string, owner database.Owner, relationType database.RelationType, details map[string]interface{}) ([]int64, bool) {
+	key, err := detailsKey(database.RelationKeyDetails(details))
+	if err != nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rel, ok := s.relations[relationKey(socialNetworkType, owner, relationType, key)]
+	if !ok {
+		return nil, false
+	}
+	return append([]int64(nil), rel.IDs...), true
+}
+
+// Relations returns copies of all stored relations of owner.
+func (s *Store) Relations(owner database.Owner) []Relation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []Relation
+	for _, rel := range s.relations {
+		if rel.Owner == owner {
+			r := *rel
+			r.IDs = append([]int64(nil), rel.IDs...)
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// Object returns the stored data of an object.
+func (s *Store) Object(socialNetworkType string, owner database.Owner, objectType string, details map[string]interface{}) (map[string]interface{}, bool) {
+	key, err := detailsKey(details)
+	if err != nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[objectKey(socialNetworkType, owner, objectType, key)]
+	if !ok {
+		return nil, false
+	}
+	data, _ := cloneMap(obj.Data)
+	return data, true
+}
+
+// Objects returns copies of all stored objects of the given type.
+func (s *Store) Objects(objectType string) []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []Object
+	for _, obj := range s.objects {
+		if obj.ObjectType == objectType {
+			o := *obj
+			o.Data, _ = cloneMap(obj.Data)
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+func copyAccount(acc *database.Account) *database.Account {
+	c := *acc
+	c.Session, _ = cloneMap(acc.Session)
+	return &c
+}
+
+func (s *Store) GetAvailableAccountContext(ctx context.Context, socialNetworkType string, groupID int) (*database.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var candidates []*database.Account
+	for _, acc := range s.accounts {
+		if acc.SocialNetworkType != socialNetworkType || acc.GroupID != groupID || acc.IsBlocked {
+			continue
+		}
+		if acc.UnavailableUntil != nil && !acc.UnavailableUntil.Before(now) {
+			continue
+		}
+		candidates = append(candidates, acc)
+	}
+
+	if len(candidates) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	// Map iteration order is random, which mirrors ORDER BY RANDOM().
+	return copyAccount(candidates[0]), nil
+}
+
+func (s *Store) UpdateAccountSessionContext(ctx context.Context, accountID int64, session map[string]interface{}) error {
+	stored, err := cloneMap(session)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acc, ok := s.accounts[accountID]; ok {
+		acc.Session = stored
+	}
+	return nil
+}
+
+func (s *Store) MarkAccountBlockedContext(ctx context.Context, accountID int64, info string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acc, ok := s.accounts[accountID]; ok {
+		acc.IsBlocked = true
+		acc.Info = &info
+	}
+	return nil
+}
+
+func (s *Store) SetAccountUnavailableContext(ctx context.Context, accountID int64, duration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acc, ok := s.accounts[accountID]; ok {
+		until := time.Now().Add(duration)
+		acc.UnavailableUntil = &until
+	}
+	return nil
+}
+
+func (s *Store) ListAccountsContext(ctx context.Context) ([]database.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := make([]database.Account, 0, len(s.accounts))
+	for _, acc := range s.accounts {
+		accounts = append(accounts, *copyAccount(acc))
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].ID > accounts[j].ID
+	})
+	return accounts, nil
+}
+
+func (s *Store) CreateAccountContext(ctx context.Context, acc *database.Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextAccountID++
+	acc.ID = s.nextAccountID
+	s.accounts[acc.ID] = copyAccount(acc)
+	return nil
+}
+
+func (s *Store) DeleteAccountContext(ctx context.Context, accountID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.accounts, accountID)
+	return nil
+}
+
+func (s *Store) ListRelationChangesContext(ctx context.Context, filter database.RelationChangeFilter) ([]database.RelationChange, error) {
+	var key string
+	if filter.Details != nil {
+		var err error
+		if key, err = detailsKey(database.RelationKeyDetails(filter.Details)); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []database.RelationChange
+	for _, change := range s.changes {
+		switch {
+		case filter.SocialNetworkType != "" && change.SocialNetworkType != filter.SocialNetworkType,
+			filter.Owner.Type != "" && change.Owner.Type != filter.Owner.Type,
+			filter.Owner.ID != 0 && change.Owner.ID != filter.Owner.ID,
+			filter.RelationType != "" && change.RelationType != filter.RelationType,
+			!filter.Since.IsZero() && change.Timestamp.Before(filter.Since),
+			!filter.Until.IsZero() && !change.Timestamp.Before(filter.Until):
+			continue
+		}
+		if filter.Details != nil {
+			if changeKey, _ := detailsKey(change.Details); changeKey != key {
+				continue
+			}
+		}
+
+		c := change
+		c.Details, _ = cloneMap(change.Details)
+		c.Added = append([]int64(nil), change.Added...)
+		c.Removed = append([]int64(nil), change.Removed...)
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func (s *Store) ListObjectHistoryContext(ctx context.Context, filter database.ObjectHistoryFilter) ([]database.ObjectVersion, error) {
+	var key string
+	if filter.Details != nil {
+		var err error
+		if key, err = detailsKey(filter.Details); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []database.ObjectVersion
+	for i := len(s.history) - 1; i >= 0 && len(result) < limit; i-- {
+		version := s.history[i]
+		switch {
+		case filter.ObjectType != "" && version.ObjectType != filter.ObjectType,
+			filter.SocialNetworkType != "" && version.SocialNetworkType != filter.SocialNetworkType,
+			filter.Owner.Type != "" && version.Owner.Type != filter.Owner.Type,
+			filter.Owner.ID != 0 && version.Owner.ID != filter.Owner.ID,
+			!filter.Since.IsZero() && version.ReplacedAt.Before(filter.Since),
+			!filter.Until.IsZero() && !version.ReplacedAt.Before(filter.Until):
+			continue
+		}
+		if filter.Details != nil {
+			if versionKey, _ := detailsKey(version.Details); versionKey != key {
+				continue
+			}
+		}
+
+		v := version
+		v.Details, _ = cloneMap(version.Details)
+		v.Data, _ = cloneMap(version.Data)
+		v.Diff = append([]database.FieldChange(nil), version.Diff...)
+		result = append(result, v)
+	}
+	return result, nil
+}
@@ -0,0 +1,608 @@
+package memstore_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Nakray/sn/internal/database"
+	"github.com/Nakray/sn/internal/database/memstore"
+	"github.com/Nakray/sn/internal/vk"
+	"github.com/Nakray/sn/internal/vk/vktest"
+)
+
+const lease = time.Minute
+
+func newClient(t *testing.T, srv *vktest.Server) *vk.Client {
+	t.Helper()
+
+	client, err := vk.NewClient("token", nil,
+		vk.WithEndpoint(srv.Endpoint()),
+		vk.WithLimiters(vk.NewLimiterRegistry(vk.RateLimits{RequestsPerSecond: 10000, Burst: 1000})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// newTask stores task together with an account for its account group.
+func newTask(t *testing.T, store *memstore.Store, task database.MonitoringTask) *database.MonitoringTask {
+	t.Helper()
+
+	ctx := context.Background()
+	if err := store.CreateAccountContext(ctx, &database.Account{SocialNetworkType: "vkontakte", Login: "login"}); err != nil {
+		t.Fatal(err)
+	}
+	if task.SocialNetworkType == "" {
+		task.SocialNetworkType = "vkontakte"
+	}
+	if task.OwnerType == "" {
+		task.OwnerType = database.OwnerTypeUser
+		task.OwnerID = 1
+	}
+	if err := store.CreateMonitoringTaskContext(ctx, &task); err != nil {
+		t.Fatal(err)
+	}
+	return &task
+}
+
+// claim claims the due tasks as owner and fails unless it gets want of
+// them.
+func claim(t *testing.T, store *memstore.Store, owner string, want int) []database.MonitoringTask {
+	t.Helper()
+
+	tasks, err := store.ClaimDueMonitoringTasksContext(context.Background(), owner, lease, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != want {
+		t.Fatalf("%s claimed %d tasks, want %d", owner, len(tasks), want)
+	}
+	return tasks
+}
+
+func checkRelation(t *testing.T, store *memstore.Store, owner database.Owner, relationType database.RelationType, details map[string]interface{}, want ...int64) {
+	t.Helper()
+
+	// The collector writes lists that belong to no item with only the
+	// completeness flag, which leaves empty key details.
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	ids, ok := store.Relation("vkontakte", owner, relationType, details)
+	if !ok {
+		t.Errorf("%s %v: not stored", relationType, details)
+		return
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) != len(want) {
+		t.Errorf("%s %v: got %v, want %v", relationType, details, ids, want)
+		return
+	}
+	for i := range ids {
+		if ids[i] != want[i] {
+			t.Errorf("%s %v: got %v, want %v", relationType, details, ids, want)
+			return
+		}
+	}
+}
+
+func checkSteps(t *testing.T, result *vk.CollectResult) {
+	t.Helper()
+
+	if len(result.Steps) == 0 {
+		t.Fatal("no steps recorded")
+	}
+	for _, step := range result.Steps {
+		if step.Status() != database.StepOK {
+			t.Errorf("step %s: %s: %v", step.Name, step.Status(), step.Err)
+		}
+	}
+}
+
+func TestCollectUser(t *testing.T) {
+	srv := vktest.NewServer()
+	defer srv.Close()
+	srv.AddUser(1, map[string]interface{}{"first_name": "Pavel"})
+	srv.SetFriends(1, []int64{2, 3})
+	srv.SetUserGroups(1, []int64{10})
+	srv.SetFollowers(1, []int64{4})
+	postID := srv.AddPost(1, map[string]interface{}{"text": "hello", "date": 1700000000})
+	srv.SetLikes(vktest.LikeKey{Type: "post", OwnerID: 1, ItemID: postID}, []int64{2, 4})
+	srv.AddComment(1, "post", postID, map[string]interface{}{"from_id": 3, "text": "hi"})
+	srv.AddPhoto(1, "profile", map[string]interface{}{"date": 1700000000})
+	srv.SetLikes(vktest.LikeKey{Type: "photo", OwnerID: 1, ItemID: 1}, []int64{3})
+
+	store := memstore.New()
+	col := vk.NewCollector(newClient(t, srv), store)
+	result, err := col.CollectUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSteps(t, result)
+
+	owner := database.Owner{Type: database.OwnerTypeUser, ID: 1}
+	if user, ok := store.Object("vkontakte", owner, "user", nil); !ok || user["first_name"] != "Pavel" {
+		t.Errorf("got user %v", user)
+	}
+	if _, ok := store.Object("vkontakte", owner, "post", map[string]interface{}{"id": postID}); !ok {
+		t.Errorf("post %d not stored", postID)
+	}
+	if n := len(store.Objects("comment")); n != 1 {
+		t.Errorf("stored %d comments, want 1", n)
+	}
+	checkRelation(t, store, owner, database.RelationTypeFriend, nil, 2, 3)
+	checkRelation(t, store, owner, database.RelationTypeGroup, nil, 10)
+	checkRelation(t, store, owner, database.RelationTypeFollower, nil, 4)
+	checkRelation(t, store, owner, database.RelationTypePost, nil, postID)
+	checkRelation(t, store, owner, database.RelationTypePostLike, map[string]interface{}{"post_id": postID}, 2, 4)
+	checkRelation(t, store, owner, database.RelationTypePostComment, map[string]interface{}{"post_id": postID}, 3)
+	checkRelation(t, store, owner, database.RelationTypePhoto, nil, 1)
+	checkRelation(t, store, owner, database.RelationTypePhotoLike, map[string]interface{}{"photo_id": 1}, 3)
+
+	// A second run records the changes of the friend list.
+	srv.SetFriends(1, []int64{2, 5})
+	if _, err := col.CollectUser(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	checkRelation(t, store, owner, database.RelationTypeFriend, nil, 2, 5)
+	changes, err := store.ListRelationChangesContext(context.Background(), database.RelationChangeFilter{
+		SocialNetworkType: "vkontakte",
+		Owner:             owner,
+		RelationType:      database.RelationTypeFriend,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, removed := database.NetRelationChanges(changes)
+	if len(added) != 1 || added[0] != 5 || len(removed) != 1 || removed[0] != 3 {
+		t.Errorf("got added %v and removed %v, want [5] and [3]", added, removed)
+	}
+}
+
+func TestCollectGroupInTaskRun(t *testing.T) {
+	srv := vktest.NewServer()
+	defer srv.Close()
+	srv.AddGroup(5, map[string]interface{}{"name": "Club"})
+	srv.SetMembers(5, []int64{1, 2, 3})
+	srv.AddPost(-5, map[string]interface{}{"text": "news"})
+	srv.AddAlbum(-5, map[string]interface{}{"title": "Album"})
+	srv.AddPhoto(-5, "1", map[string]interface{}{})
+	srv.AddPhoto(-5, "1", map[string]interface{}{})
+	topicID := srv.AddTopic(5, map[string]interface{}{"title": "Rules"})
+	srv.AddComment(-5, "topic", topicID, map[string]interface{}{"from_id": 7, "text": "ok"})
+
+	store := memstore.New()
+	task := newTask(t, store, database.MonitoringTask{OwnerType: database.OwnerTypeGroup, OwnerID: 5, Period: 60})
+	claimed := claim(t, store, "worker-1", 1)[0]
+
+	ctx := context.Background()
+	batch := database.NewBatch(store)
+	col := vk.NewCollector(newClient(t, srv), batch)
+	result, err := col.CollectGroup(ctx, claimed.OwnerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSteps(t, result)
+
+	owner := database.Owner{Type: database.OwnerTypeGroup, ID: 5}
+	if _, ok := store.Relation("vkontakte", owner, database.RelationTypeMember, map[string]interface{}{}); ok {
+		t.Fatal("batch was written before the run was committed")
+	}
+
+	run := &database.TaskRun{TaskID: task.ID, Worker: "worker-1", StartedAt: time.Now(), FinishedAt: time.Now(), Status: database.RunSucceeded}
+	for _, step := range result.Steps {
+		run.Steps = append(run.Steps, step.RunStep())
+	}
+	if err := store.CommitTaskRunContext(ctx, run, batch); err != nil {
+		t.Fatal(err)
+	}
+	if run.Relations == 0 || run.Objects == 0 {
+		t.Errorf("run stored %d objects and %d relations", run.Objects, run.Relations)
+	}
+
+	if group, ok := store.Object("vkontakte", owner, "group", nil); !ok || group["name"] != "Club" {
+		t.Errorf("got group %v", group)
+	}
+	checkRelation(t, store, owner, database.RelationTypeMember, nil, 1, 2, 3)
+	checkRelation(t, store, owner, database.RelationTypePost, nil, 1)
+	checkRelation(t, store, owner, database.RelationTypeAlbum, nil, 1)
+	checkRelation(t, store, owner, database.RelationTypePhoto, map[string]interface{}{"album_id": 1}, 1, 2)
+	checkRelation(t, store, owner, database.RelationTypeTopic, nil, topicID)
+	checkRelation(t, store, owner, database.RelationTypeTopicComment, map[string]interface{}{"topic_id": topicID}, 7)
+
+	runs, err := store.ListTaskRunsContext(ctx, task.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Status != database.RunSucceeded || len(runs[0].Steps) != len(result.Steps) {
+		t.Errorf("got runs %+v", runs)
+	}
+}
+
+func TestTaskSuccessCycle(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	task := newTask(t, store, database.MonitoringTask{Period: 60})
+	if task.NextRunAt == nil || task.NextRunAt.After(time.Now()) {
+		t.Fatalf("new task is not due: NextRunAt %v", task.NextRunAt)
+	}
+
+	claimed := claim(t, store, "worker-1", 1)[0]
+	if claimed.LeaseOwner == nil || *claimed.LeaseOwner != "worker-1" {
+		t.Fatalf("got lease owner %v", claimed.LeaseOwner)
+	}
+	claim(t, store, "worker-2", 0)
+
+	expires := *claimed.LeaseExpiresAt
+	time.Sleep(time.Millisecond)
+	if err := store.RenewTaskLeaseContext(ctx, &claimed, "worker-1", lease); err != nil {
+		t.Fatal(err)
+	}
+	if !claimed.LeaseExpiresAt.After(expires) {
+		t.Errorf("lease was not extended: %v, then %v", expires, claimed.LeaseExpiresAt)
+	}
+	if err := store.RenewTaskLeaseContext(ctx, &claimed, "worker-2", lease); !errors.Is(err, database.ErrLeaseLost) {
+		t.Errorf("renewed the lease of another worker: %v", err)
+	}
+
+	before := time.Now()
+	if err := store.UpdateTaskLastTimestampContext(ctx, &claimed, database.TaskStatusSuccess); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.GetMonitoringTaskContext(ctx, task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LeaseOwner != nil || stored.LeaseExpiresAt != nil {
+		t.Errorf("lease was not released: %v until %v", stored.LeaseOwner, stored.LeaseExpiresAt)
+	}
+	if stored.NextRunAt == nil || stored.NextRunAt.Before(before.Add(time.Hour)) {
+		t.Errorf("got NextRunAt %v, want a period from now", stored.NextRunAt)
+	}
+
+	// The next run is an hour away.
+	claim(t, store, "worker-1", 0)
+	next, err := store.NextTaskRunContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil || !next.Equal(*stored.NextRunAt) {
+		t.Errorf("got next run %v, want %v", next, stored.NextRunAt)
+	}
+}
+
+func TestTaskNextRunAt(t *testing.T) {
+	store := memstore.New()
+	runAt := time.Now().Add(time.Hour)
+	newTask(t, store, database.MonitoringTask{RunAt: &runAt})
+	claim(t, store, "worker-1", 0)
+
+	paused := newTask(t, store, database.MonitoringTask{Period: 60})
+	if _, err := store.SetMonitoringTaskPausedContext(context.Background(), paused.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	claim(t, store, "worker-1", 0)
+
+	past := time.Now().Add(-time.Minute)
+	due := newTask(t, store, database.MonitoringTask{RunAt: &past})
+	if got := claim(t, store, "worker-1", 1)[0]; got.ID != due.ID {
+		t.Errorf("claimed task %d, want %d", got.ID, due.ID)
+	}
+}
+
+func TestNextTaskRunLease(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	past := time.Now().Add(-time.Minute)
+	task := newTask(t, store, database.MonitoringTask{RunAt: &past})
+
+	// A held lease delays the next run until it expires.
+	tasks, err := store.ClaimDueMonitoringTasksContext(ctx, "worker-1", lease, 1)
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("claimed %d tasks: %v", len(tasks), err)
+	}
+	next, err := store.NextTaskRunContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil || !next.Equal(*tasks[0].LeaseExpiresAt) {
+		t.Errorf("got next run %v, want the end of the lease %v", next, tasks[0].LeaseExpiresAt)
+	}
+
+	// The lease of a crashed worker has expired; the task is due at its
+	// NextRunAt again.
+	if err := store.RenewTaskLeaseContext(ctx, &tasks[0], "worker-1", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	next, err = store.NextTaskRunContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil || !next.Equal(*task.NextRunAt) {
+		t.Errorf("got next run %v, want NextRunAt %v", next, task.NextRunAt)
+	}
+	claim(t, store, "worker-2", 1)
+}
+
+func TestTaskFailureCycle(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	task := newTask(t, store, database.MonitoringTask{Period: 60, MaxAttempts: 2, RetryBackoff: 600})
+
+	claimed := claim(t, store, "worker-1", 1)[0]
+	before := time.Now()
+	if err := store.RecordTaskFailureContext(ctx, &claimed, "boom"); err != nil {
+		t.Fatal(err)
+	}
+	if claimed.IsDead || claimed.FailureCount != 1 {
+		t.Fatalf("got dead %v after %d failures", claimed.IsDead, claimed.FailureCount)
+	}
+	if claimed.NextRunAt == nil || claimed.NextRunAt.Before(before.Add(10*time.Minute)) {
+		t.Errorf("got NextRunAt %v, want the retry in 10 minutes", claimed.NextRunAt)
+	}
+	claim(t, store, "worker-1", 0)
+
+	// Bring the retry forward; the failure count stays.
+	now := time.Now()
+	if _, err := store.UpdateMonitoringTaskContext(ctx, task.ID, database.TaskUpdate{RunAt: &now}); err != nil {
+		t.Fatal(err)
+	}
+	claimed = claim(t, store, "worker-1", 1)[0]
+	if claimed.FailureCount != 1 {
+		t.Fatalf("got failure count %d, want 1", claimed.FailureCount)
+	}
+	if err := store.RecordTaskFailureContext(ctx, &claimed, "boom again"); err != nil {
+		t.Fatal(err)
+	}
+	if !claimed.IsDead || claimed.NextRunAt != nil {
+		t.Fatalf("task is not dead after %d of %d attempts", claimed.FailureCount, task.MaxAttempts)
+	}
+
+	// Dead tasks are never claimed and do not wake the dispatcher.
+	claim(t, store, "worker-1", 0)
+	if next, err := store.NextTaskRunContext(ctx); err != nil || next != nil {
+		t.Errorf("got next run %v, %v for a dead task", next, err)
+	}
+
+	requeued, err := store.RequeueMonitoringTaskContext(ctx, task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued.IsDead || requeued.FailureCount != 0 || requeued.LastError == nil || *requeued.LastError != "boom again" {
+		t.Errorf("got requeued task %+v", requeued)
+	}
+	claimed = claim(t, store, "worker-1", 1)[0]
+	if err := store.UpdateTaskLastTimestampContext(ctx, &claimed, database.TaskStatusSuccess); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.GetMonitoringTaskContext(ctx, task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LastError != nil || stored.FailureCount != 0 {
+		t.Errorf("success kept error %v and %d failures", stored.LastError, stored.FailureCount)
+	}
+}
+
+func TestTaskDeadAfterDefaultAttempts(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	task := newTask(t, store, database.MonitoringTask{Period: 60})
+
+	for failures := 1; failures <= database.DefaultMaxAttempts; failures++ {
+		claimed := claim(t, store, "worker-1", 1)[0]
+		before := time.Now()
+		if err := store.RecordTaskFailureContext(ctx, &claimed, "boom"); err != nil {
+			t.Fatal(err)
+		}
+		if claimed.FailureCount != failures {
+			t.Fatalf("got failure count %d, want %d", claimed.FailureCount, failures)
+		}
+		if failures == database.DefaultMaxAttempts {
+			if !claimed.IsDead || claimed.NextRunAt != nil || *claimed.LastStatus != database.TaskStatusDead {
+				t.Fatalf("task is not dead after %d failures", failures)
+			}
+			break
+		}
+		if claimed.IsDead {
+			t.Fatalf("task is dead after %d failures", failures)
+		}
+		delay, _ := task.RetryDelay(failures)
+		if want := database.DefaultRetryBackoff << (failures - 1); delay != want {
+			t.Errorf("failure %d: got delay %v, want %v", failures, delay, want)
+		}
+		if claimed.NextRunAt == nil || claimed.NextRunAt.Before(before.Add(delay)) {
+			t.Errorf("failure %d: got NextRunAt %v, want the retry in %v", failures, claimed.NextRunAt, delay)
+		}
+
+		// Bring the retry forward; the failure count stays.
+		now := time.Now()
+		if _, err := store.UpdateMonitoringTaskContext(ctx, task.ID, database.TaskUpdate{RunAt: &now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	claim(t, store, "worker-1", 0)
+}
+
+func TestRequeueLockedTask(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	locked := newTask(t, store, database.MonitoringTask{Period: 60, IsUnlockable: true})
+	claim(t, store, "worker-1", 0)
+
+	requeued, err := store.RequeueMonitoringTaskContext(ctx, locked.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued.NextRunAt != nil {
+		t.Errorf("requeued locked task runs at %v, want no run", requeued.NextRunAt)
+	}
+	claim(t, store, "worker-1", 0)
+	if next, err := store.NextTaskRunContext(ctx); err != nil || next != nil {
+		t.Errorf("NextTaskRun = %v, %v, want no run", next, err)
+	}
+
+	unlocker := newTask(t, store, database.MonitoringTask{Period: 60, UnlockIDs: []int64{locked.ID}})
+	claimed := claim(t, store, "worker-1", 1)[0]
+	if claimed.ID != unlocker.ID {
+		t.Fatalf("claimed task %d, want %d", claimed.ID, unlocker.ID)
+	}
+	if err := store.UpdateTaskLastTimestampContext(ctx, &claimed, database.TaskStatusSuccess); err != nil {
+		t.Fatal(err)
+	}
+	if claimed := claim(t, store, "worker-1", 1)[0]; claimed.ID != locked.ID {
+		t.Errorf("claimed task %d, want the unlocked task %d", claimed.ID, locked.ID)
+	}
+}
+
+func TestTaskLeaseLost(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	task := newTask(t, store, database.MonitoringTask{Period: 60})
+
+	tasks, err := store.ClaimDueMonitoringTasksContext(ctx, "worker-1", time.Millisecond, 10)
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("claimed %d tasks: %v", len(tasks), err)
+	}
+	stale := tasks[0]
+	time.Sleep(5 * time.Millisecond)
+	claimed := claim(t, store, "worker-2", 1)[0]
+
+	if err := store.RenewTaskLeaseContext(ctx, &stale, "worker-1", lease); !errors.Is(err, database.ErrLeaseLost) {
+		t.Errorf("renewing a lost lease: got %v, want %v", err, database.ErrLeaseLost)
+	}
+
+	batch := database.NewBatch(store)
+	owner := database.Owner{Type: database.OwnerTypeUser, ID: 1}
+	if err := batch.WriteRelationsContext(ctx, "vkontakte", owner, database.RelationTypeFriend, map[string]interface{}{"complete": true}, []int64{2}); err != nil {
+		t.Fatal(err)
+	}
+	run := &database.TaskRun{TaskID: task.ID, Worker: "worker-1", Status: database.RunSucceeded}
+	if err := store.CommitTaskRunContext(ctx, run, batch); !errors.Is(err, database.ErrLeaseLost) {
+		t.Errorf("committing without the lease: got %v, want %v", err, database.ErrLeaseLost)
+	}
+	if _, ok := store.Relation("vkontakte", owner, database.RelationTypeFriend, map[string]interface{}{}); ok {
+		t.Error("data of a run without the lease was stored")
+	}
+	if err := store.RecordTaskFailureContext(ctx, &stale, "late"); !errors.Is(err, database.ErrLeaseLost) {
+		t.Errorf("failing without the lease: got %v, want %v", err, database.ErrLeaseLost)
+	}
+	if err := store.UpdateTaskLastTimestampContext(ctx, &stale, database.TaskStatusSuccess); !errors.Is(err, database.ErrLeaseLost) {
+		t.Errorf("finishing without the lease: got %v, want %v", err, database.ErrLeaseLost)
+	}
+
+	run.Worker = "worker-2"
+	if err := store.CommitTaskRunContext(ctx, run, batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateTaskLastTimestampContext(ctx, &claimed, database.TaskStatusSuccess); err != nil {
+		t.Fatal(err)
+	}
+	checkRelation(t, store, owner, database.RelationTypeFriend, nil, 2)
+}
+
+func TestVolatileFieldsNotArchived(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	owner := database.Owner{Type: database.OwnerTypeUser, ID: 1}
+	write := func(name string, lastSeen int) {
+		t.Helper()
+		data := map[string]interface{}{
+			"id":         1,
+			"first_name": name,
+			"last_seen":  map[string]interface{}{"time": lastSeen},
+		}
+		if err := store.WriteObjectContext(ctx, "vkontakte", owner, "user", nil, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history := func() []database.ObjectVersion {
+		t.Helper()
+		versions, err := store.ListObjectHistoryContext(ctx, database.ObjectHistoryFilter{
+			ObjectType:        "user",
+			SocialNetworkType: "vkontakte",
+			Owner:             owner,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return versions
+	}
+
+	write("Pavel", 100)
+	write("Pavel", 200)
+	if versions := history(); len(versions) != 0 {
+		t.Fatalf("a change of last_seen alone archived %d versions", len(versions))
+	}
+
+	write("Paul", 300)
+	versions := history()
+	if len(versions) != 1 {
+		t.Fatalf("got %d archived versions, want 1", len(versions))
+	}
+	want := []database.FieldChange{{Path: "first_name", Op: database.FieldChanged, Old: "Pavel", New: "Paul"}}
+	if !reflect.DeepEqual(versions[0].Diff, want) {
+		t.Errorf("got diff %v, want %v", versions[0].Diff, want)
+	}
+	data, _ := store.Object("vkontakte", owner, "user", nil)
+	if lastSeen, _ := data["last_seen"].(map[string]interface{}); lastSeen["time"] != float64(300) {
+		t.Errorf("stored last_seen %v, want the latest", data["last_seen"])
+	}
+}
+
+func TestVolatileFieldsRefreshed(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	owner := database.Owner{Type: database.OwnerTypeGroup, ID: 5}
+	details := map[string]interface{}{"id": 12}
+	post := func(likes int) map[string]interface{} {
+		return map[string]interface{}{"id": 12, "text": "post", "likes": map[string]interface{}{"count": likes}}
+	}
+	likes := func() interface{} {
+		t.Helper()
+		data, ok := store.Object("vkontakte", owner, "post", details)
+		if !ok {
+			t.Fatal("post not stored")
+		}
+		return data["likes"].(map[string]interface{})["count"]
+	}
+
+	if err := store.WriteObjectContext(ctx, "vkontakte", owner, "post", details, post(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteObjectContext(ctx, "vkontakte", owner, "post", details, post(2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := likes(); got != float64(2) {
+		t.Errorf("single write: stored %v likes, want 2", got)
+	}
+
+	batch := database.NewBatch(store)
+	if err := batch.WriteObjectContext(ctx, "vkontakte", owner, "post", details, post(3)); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := store.WriteBatchContext(ctx, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 0 {
+		t.Errorf("a likes-only change counted as %d written", stats.Written)
+	}
+	if got := likes(); got != float64(3) {
+		t.Errorf("batch write: stored %v likes, want 3", got)
+	}
+
+	versions, err := store.ListObjectHistoryContext(ctx, database.ObjectHistoryFilter{ObjectType: "post", Owner: owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("likes-only changes archived %d versions", len(versions))
+	}
+}
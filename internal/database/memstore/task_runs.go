@@ -0,0 +1,68 @@
+package memstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/Nakray/sn/internal/database"
+)
+
+// CommitTaskRunContext stores batch and records run while run.Worker holds
+// the lease on the task. A batch that fails validation or a lost lease
+// stores nothing and records no run, as the PostgreSQL backend rolls both
+// back.
+func (s *Store) CommitTaskRunContext(ctx context.Context, run *database.TaskRun, batch *database.Batch) error {
+	start := time.Now()
+	var writes *batchWrites
+	if batch != nil {
+		var err error
+		if writes, err = prepareBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.tasks[run.TaskID]
+	if !ok {
+		return database.ErrTaskNotFound
+	}
+	if !r.heldBy(&run.Worker) {
+		return database.ErrLeaseLost
+	}
+	if writes != nil {
+		run.SetStats(s.applyBatch(start, writes))
+	}
+	s.nextRunID++
+	run.ID = s.nextRunID
+	s.runs = append(s.runs, *copyRun(run))
+	return nil
+}
+
+// ListTaskRunsContext returns the latest runs of a task, newest first.
+func (s *Store) ListTaskRunsContext(ctx context.Context, taskID int64, limit int) ([]database.TaskRun, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []database.TaskRun
+	for i := len(s.runs) - 1; i >= 0 && len(result) < limit; i-- {
+		if s.runs[i].TaskID == taskID {
+			result = append(result, *copyRun(&s.runs[i]))
+		}
+	}
+	return result, nil
+}
+
+func copyRun(run *database.TaskRun) *database.TaskRun {
+	c := *run
+	c.Steps = append([]database.TaskRunStep(nil), run.Steps...)
+	return &c
+}
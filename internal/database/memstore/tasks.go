@@ -0,0 +1,483 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Nakray/sn/internal/database"
+)
+
+func (r *taskRecord) snapshot() *database.MonitoringTask {
+	t := r.task
+	t.Filters, _ = cloneMap(r.task.Filters)
+	t.FilterLimits, _ = cloneMap(r.task.FilterLimits)
+	t.StepPolicy, _ = cloneMap(r.task.StepPolicy)
+	t.UnlockIDs = append([]int64(nil), r.task.UnlockIDs...)
+	t.IsUnlockable = r.unlocked != nil
+	return &t
+}
+
+// leased reports whether a worker holds the lease of the task at now.
+func (r *taskRecord) leased(now time.Time) bool {
+	return r.task.LeaseExpiresAt != nil && !r.task.LeaseExpiresAt.Before(now)
+}
+
+// locked reports whether the task waits for another task to unlock it.
+func (r *taskRecord) locked() bool {
+	return r.unlocked != nil && !*r.unlocked
+}
+
+func (r *taskRecord) isDue(now time.Time) bool {
+	if r.task.IsPaused || r.task.IsDead || r.task.NextRunAt == nil || r.locked() || r.leased(now) {
+		return false
+	}
+	return !r.task.NextRunAt.After(now)
+}
+
+func (s *Store) ClaimDueMonitoringTasksContext(ctx context.Context, owner string, lease time.Duration, limit int) ([]database.MonitoringTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var due []*taskRecord
+	for _, r := range s.tasks {
+		if r.isDue(now) {
+			due = append(due, r)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].task.NextRunAt.Before(*due[j].task.NextRunAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	tasks := make([]database.MonitoringTask, 0, len(due))
+	for _, r := range due {
+		leaseOwner := owner
+		expiresAt := now.Add(lease)
+		r.task.LeaseOwner = &leaseOwner
+		r.task.LeaseExpiresAt = &expiresAt
+		tasks = append(tasks, *r.snapshot())
+	}
+	return tasks, nil
+}
+
+// heldBy reports whether the lease on r belongs to owner, treating two
+// missing owners as equal like IS NOT DISTINCT FROM does.
+func (r *taskRecord) heldBy(owner *string) bool {
+	if r.task.LeaseOwner == nil || owner == nil {
+		return r.task.LeaseOwner == nil && owner == nil
+	}
+	return *r.task.LeaseOwner == *owner
+}
+
+func (s *Store) RenewTaskLeaseContext(ctx context.Context, task *database.MonitoringTask, owner string, lease time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.tasks[task.ID]
+	if !ok || !r.heldBy(&owner) {
+		return database.ErrLeaseLost
+	}
+
+	expiresAt := time.Now().Add(lease)
+	r.task.LeaseExpiresAt = &expiresAt
+	task.LeaseExpiresAt = &expiresAt
+	return nil
+}
+
+func (s *Store) UpdateTaskLastTimestampContext(ctx context.Context, task *database.MonitoringTask, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.tasks[task.ID]
+	if !ok || !r.heldBy(task.LeaseOwner) {
+		return database.ErrLeaseLost
+	}
+
+	success := status == database.TaskStatusSuccess
+	now := time.Now()
+	r.task.LastTimestamp = now
+	r.task.NextRunAt = task.NextRun(now, now)
+	r.task.LastStatus = &status
+	r.task.LeaseOwner = nil
+	r.task.LeaseExpiresAt = nil
+	r.task.FailureCount = 0
+	r.task.RetryAt = nil
+	r.task.LastError = nil
+	if r.unlocked != nil {
+		unlocked := false
+		r.unlocked = &unlocked
+	}
+
+	if success {
+		for _, id := range task.UnlockIDs {
+			if other, ok := s.tasks[id]; ok {
+				unlocked := true
+				other.unlocked = &unlocked
+				other.task.NextRunAt = &now
+			}
+		}
+	}
+	s.notifyTasks()
+	return nil
+}
+
+func (s *Store) RecordTaskInterruptedContext(ctx context.Context, task *database.MonitoringTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.tasks[task.ID]
+	if !ok || !r.heldBy(task.LeaseOwner) {
+		return database.ErrLeaseLost
+	}
+
+	status := database.TaskStatusInterrupted
+	r.task.LastStatus = &status
+	r.task.LeaseOwner = nil
+	r.task.LeaseExpiresAt = nil
+	return nil
+}
+
+func (s *Store) RecordTaskFailureContext(ctx context.Context, task *database.MonitoringTask, errText string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.tasks[task.ID]
+	if !ok || !r.heldBy(task.LeaseOwner) {
+		return database.ErrLeaseLost
+	}
+
+	failures := task.FailureCount + 1
+	delay, dead := task.RetryDelay(failures)
+	status := database.TaskStatusFailed
+	var retryAt *time.Time
+	if dead {
+		status = database.TaskStatusDead
+	} else {
+		at := time.Now().Add(delay)
+		retryAt = &at
+	}
+
+	r.task.LastStatus = &status
+	r.task.FailureCount = failures
+	r.task.IsDead = dead
+	r.task.RetryAt = retryAt
+	r.task.NextRunAt = retryAt
+	r.task.LastError = &errText
+	r.task.LeaseOwner = nil
+	r.task.LeaseExpiresAt = nil
+
+	task.LastStatus = r.task.LastStatus
+	task.FailureCount = failures
+	task.IsDead = dead
+	task.RetryAt = retryAt
+	task.NextRunAt = retryAt
+	task.LastError = r.task.LastError
+	task.LeaseOwner = nil
+	task.LeaseExpiresAt = nil
+	s.notifyTasks()
+	return nil
+}
+
+func (s *Store) ListMonitoringTasksContext(ctx context.Context, filter database.TaskFilter) ([]database.MonitoringTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks := []database.MonitoringTask{}
+	for _, r := range s.tasks {
+		t := r.task
+		if filter.SocialNetworkType != "" && t.SocialNetworkType != filter.SocialNetworkType {
+			continue
+		}
+		if filter.OwnerType != "" && t.OwnerType != filter.OwnerType {
+			continue
+		}
+		if filter.OwnerID != 0 && t.OwnerID != filter.OwnerID {
+			continue
+		}
+		if filter.Paused != nil && t.IsPaused != *filter.Paused {
+			continue
+		}
+		if filter.Dead != nil && t.IsDead != *filter.Dead {
+			continue
+		}
+		tasks = append(tasks, *r.snapshot())
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].ID > tasks[j].ID
+	})
+
+	limit, offset := filter.Page()
+	if offset > len(tasks) {
+		offset = len(tasks)
+	}
+	tasks = tasks[offset:]
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	return tasks, nil
+}
+
+func (s *Store) GetMonitoringTaskContext(ctx context.Context, taskID int64) (*database.MonitoringTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.tasks[taskID]
+	if !ok {
+		return nil, database.ErrTaskNotFound
+	}
+	return r.snapshot(), nil
+}
+
+// validateAccountGroup must be called with s.mu held.
+func (s *Store) validateAccountGroup(socialNetworkType string, groupID int) error {
+	for _, acc := range s.accounts {
+		if acc.SocialNetworkType == socialNetworkType && acc.GroupID == groupID {
+			return nil
+		}
+	}
+	return &database.ValidationError{
+		Field:   "AccountGroupID",
+		Message: fmt.Sprintf("no %s accounts in group %d", socialNetworkType, groupID),
+	}
+}
+
+func (s *Store) CreateMonitoringTaskContext(ctx context.Context, task *database.MonitoringTask) error {
+	if err := database.ValidateTask(task); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.validateAccountGroup(task.SocialNetworkType, task.AccountGroupID); err != nil {
+		return err
+	}
+
+	s.nextTaskID++
+	r := &taskRecord{task: *task}
+	r.task.ID = s.nextTaskID
+	r.task.LastTimestamp = time.Time{}
+	r.task.LastStatus = nil
+	r.task.LeaseOwner = nil
+	r.task.LeaseExpiresAt = nil
+	r.task.FailureCount = 0
+	r.task.RetryAt = nil
+	r.task.IsDead = false
+	r.task.LastError = nil
+	r.task.Schedule = nilIfEmpty(task.Schedule)
+	r.task.Timezone = nilIfEmpty(task.Timezone)
+	r.task.NextRunAt = task.NextRun(time.Time{}, time.Now())
+	if task.IsUnlockable {
+		unlocked := false
+		r.unlocked = &unlocked
+	}
+	r.task = *r.snapshot()
+	s.tasks[r.task.ID] = r
+	s.notifyTasks()
+
+	*task = *r.snapshot()
+	return nil
+}
+
+func (s *Store) UpdateMonitoringTaskContext(ctx context.Context, taskID int64, update database.TaskUpdate) (*database.MonitoringTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.tasks[taskID]
+	if !ok {
+		return nil, database.ErrTaskNotFound
+	}
+
+	updated := *r.snapshot()
+	if update.Period != nil {
+		updated.Period = *update.Period
+	}
+	if update.AccountGroupID != nil {
+		updated.AccountGroupID = *update.AccountGroupID
+	}
+	if update.Filters != nil {
+		updated.Filters, _ = cloneMap(*update.Filters)
+	}
+	if update.FilterLimits != nil {
+		updated.FilterLimits, _ = cloneMap(*update.FilterLimits)
+	}
+	if update.StepPolicy != nil {
+		updated.StepPolicy, _ = cloneMap(*update.StepPolicy)
+	}
+	if update.MaxAttempts != nil {
+		updated.MaxAttempts = *update.MaxAttempts
+	}
+	if update.RetryBackoff != nil {
+		updated.RetryBackoff = *update.RetryBackoff
+	}
+	if update.UnlockIDs != nil {
+		updated.UnlockIDs = append([]int64(nil), (*update.UnlockIDs)...)
+	}
+	if update.Schedule != nil {
+		updated.Schedule = nilIfEmpty(update.Schedule)
+	}
+	if update.Timezone != nil {
+		updated.Timezone = nilIfEmpty(update.Timezone)
+	}
+	if update.RunAt != nil {
+		updated.RunAt = update.RunAt
+		if update.RunAt.IsZero() {
+			updated.RunAt = nil
+		}
+	}
+	rescheduled := update.Period != nil || update.Schedule != nil || update.Timezone != nil || update.RunAt != nil
+	if rescheduled && !updated.IsUnlockable {
+		updated.NextRunAt = updated.NextRun(updated.LastTimestamp, time.Now())
+	}
+
+	if err := database.ValidateTask(&updated); err != nil {
+		return nil, err
+	}
+	if update.AccountGroupID != nil {
+		if err := s.validateAccountGroup(updated.SocialNetworkType, updated.AccountGroupID); err != nil {
+			return nil, err
+		}
+	}
+
+	r.task = updated
+	if rescheduled {
+		s.notifyTasks()
+	}
+	return r.snapshot(), nil
+}
+
+func (s *Store) DeleteMonitoringTaskContext(ctx context.Context, taskID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tasks[taskID]; !ok {
+		return database.ErrTaskNotFound
+	}
+	delete(s.tasks, taskID)
+
+	// Runs are deleted with their task.
+	runs := s.runs[:0]
+	for _, run := range s.runs {
+		if run.TaskID != taskID {
+			runs = append(runs, run)
+		}
+	}
+	s.runs = runs
+	return nil
+}
+
+func (s *Store) SetMonitoringTaskPausedContext(ctx context.Context, taskID int64, paused bool) (*database.MonitoringTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.tasks[taskID]
+	if !ok {
+		return nil, database.ErrTaskNotFound
+	}
+	r.task.IsPaused = paused
+	s.notifyTasks()
+	return r.snapshot(), nil
+}
+
+func (s *Store) RequeueMonitoringTaskContext(ctx context.Context, taskID int64) (*database.MonitoringTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.tasks[taskID]
+	if !ok {
+		return nil, database.ErrTaskNotFound
+	}
+	now := time.Now()
+	r.task.IsDead = false
+	r.task.FailureCount = 0
+	r.task.RetryAt = nil
+	r.task.NextRunAt = &now
+	if r.locked() {
+		r.task.NextRunAt = nil
+	}
+	s.notifyTasks()
+	return r.snapshot(), nil
+}
+
+func nilIfEmpty(s *string) *string {
+	if s == nil || *s == "" {
+		return nil
+	}
+	v := *s
+	return &v
+}
+
+func (s *Store) NextTaskRunContext(ctx context.Context) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var next *time.Time
+	for _, r := range s.tasks {
+		if r.task.IsPaused || r.task.IsDead || r.task.NextRunAt == nil || r.locked() {
+			continue
+		}
+		at := *r.task.NextRunAt
+		if r.leased(now) && r.task.LeaseExpiresAt.After(at) {
+			at = *r.task.LeaseExpiresAt
+		}
+		if next == nil || at.Before(*next) {
+			next = &at
+		}
+	}
+	return next, nil
+}
+
+func (s *Store) TaskChanges(ctx context.Context) (<-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	listener := make(chan struct{}, 1)
+	s.listeners = append(s.listeners, listener)
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		defer s.removeListener(listener)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-listener:
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func (s *Store) removeListener(listener chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, l := range s.listeners {
+		if l == listener {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// notifyTasks wakes up the listeners of TaskChanges, like the "Tasks_notify"
+// trigger does. It must be called with s.mu held.
+func (s *Store) notifyTasks() {
+	for _, l := range s.listeners {
+		select {
+		case l <- struct{}{}:
+		default:
+		}
+	}
+}
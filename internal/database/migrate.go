@@ -0,0 +1,351 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock key held while migrating, so that
+// two processes never apply the same migration.
+const migrationLockID = 0x736e6d6967
+
+// ErrSchemaOutdated is returned by CheckSchema when migrations are pending.
+var ErrSchemaOutdated = errors.New("database schema is out of date")
+
+// Migration is one versioned schema change. Files are named
+// NNNN_name.up.sql and NNNN_name.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState is a migration together with when it was applied.
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		versionStr, migrationName, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q: %w", name, err)
+		}
+
+		body, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: migrationName}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// ensureMigrationTable creates the table of applied migrations. It runs on
+// the connection holding the migration lock, so that concurrent runs do
+// not race to create it.
+func ensureMigrationTable(ctx context.Context, conn *sql.Conn) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS public."SchemaMigrations" (
+			"Version"   integer PRIMARY KEY,
+			"Name"      text NOT NULL,
+			"AppliedAt" timestamptz NOT NULL DEFAULT now()
+		)
+	`
+	_, err := conn.ExecContext(ctx, query)
+	return err
+}
+
+// appliedMigrations returns the applied migrations by version. A database
+// without the migrations table has none.
+func (db *DB) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	var exists bool
+	if err := db.conn.QueryRowContext(ctx, `SELECT to_regclass('public."SchemaMigrations"') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time)
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := db.conn.QueryContext(ctx, `SELECT "Version", "AppliedAt" FROM public."SchemaMigrations"`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// MigrationStatus lists all known migrations and whether they are applied.
+// It does not change the database.
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i].Migration = m
+		if at, ok := applied[m.Version]; ok {
+			states[i].AppliedAt = &at
+		}
+	}
+
+	return states, nil
+}
+
+// withMigrationLock runs fn on a dedicated connection holding the
+// migration advisory lock.
+func (db *DB) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	return fn(conn)
+}
+
+// MigrateUp applies all pending migrations in order, each in its own
+// transaction, and returns the ones it applied. It then creates the tables
+// of registered object types that are missing.
+func (db *DB) MigrateUp(ctx context.Context) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	err = db.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		if err := ensureMigrationTable(ctx, conn); err != nil {
+			return err
+		}
+		applied, err := db.appliedMigrations(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+
+			err := runInTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx,
+					`INSERT INTO public."SchemaMigrations" ("Version", "Name") VALUES ($1, $2)`,
+					m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+
+		return runInTx(ctx, conn, func(tx *sql.Tx) error {
+			return createObjectTables(ctx, tx)
+		})
+	})
+
+	return done, err
+}
+
+// createObjectTables creates the tables of registered object types that
+// have none yet.
+func createObjectTables(ctx context.Context, tx *sql.Tx) error {
+	for _, t := range ObjectTypes() {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(objectTableDDL, t.Table())); err != nil {
+			return fmt.Errorf("object type %s: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// dropObjectTables drops the tables of all registered object types.
+func dropObjectTables(ctx context.Context, tx *sql.Tx) error {
+	for _, t := range ObjectTypes() {
+		if _, err := tx.ExecContext(ctx, `DROP TABLE IF EXISTS `+t.Table()); err != nil {
+			return fmt.Errorf("object type %s: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown reverts the last steps applied migrations and returns the
+// ones it reverted. The tables of object types that only the registry
+// creates are not part of any migration: they outlive a partial rollback
+// and are dropped when the first migration is reverted.
+func (db *DB) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	err = db.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		if err := ensureMigrationTable(ctx, conn); err != nil {
+			return err
+		}
+		applied, err := db.appliedMigrations(ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s cannot be reverted", m.Version, m.Name)
+			}
+
+			err := runInTx(ctx, conn, func(tx *sql.Tx) error {
+				if i == 0 {
+					if err := dropObjectTables(ctx, tx); err != nil {
+						return err
+					}
+				}
+				if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `DELETE FROM public."SchemaMigrations" WHERE "Version" = $1`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+
+	return done, err
+}
+
+// CheckSchema returns ErrSchemaOutdated if any embedded migration has not
+// been applied or a registered object type has no table.
+func (db *DB) CheckSchema(ctx context.Context) error {
+	states, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, state := range states {
+		if state.AppliedAt == nil {
+			pending = append(pending, fmt.Sprintf("%04d_%s", state.Version, state.Name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: pending migrations %s", ErrSchemaOutdated, strings.Join(pending, ", "))
+	}
+
+	var missing []string
+	for _, t := range ObjectTypes() {
+		var exists bool
+		if err := db.conn.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, t.Table()).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			missing = append(missing, t.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: no tables for object types %s", ErrSchemaOutdated, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func runInTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS monitoring."Tasks";
+DROP TABLE IF EXISTS public."Objects_photo";
+DROP TABLE IF EXISTS public."Objects_post";
+DROP TABLE IF EXISTS public."Objects_group";
+DROP TABLE IF EXISTS public."Objects_user";
+DROP TABLE IF EXISTS public."Relations";
+DROP TABLE IF EXISTS public."Accounts";
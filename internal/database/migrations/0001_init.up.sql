@@ -0,0 +1,55 @@
+CREATE SCHEMA IF NOT EXISTS monitoring;
+
+CREATE TABLE IF NOT EXISTS public."Accounts" (
+    "ID"                bigserial PRIMARY KEY,
+    "SocialNetworkType" text NOT NULL,
+    "Login"             text NOT NULL,
+    "Password"          text NOT NULL,
+    "Session"           jsonb,
+    "Proxy"             text,
+    "IsBlocked"         boolean NOT NULL DEFAULT false,
+    "Info"              text,
+    "UnavailableUntil"  timestamptz,
+    "GroupID"           integer NOT NULL DEFAULT 0,
+    "IsChanged"         boolean NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS public."Relations" (
+    "Timestamp"         timestamptz NOT NULL,
+    "SocialNetworkType" text NOT NULL,
+    "OwnerType"         text NOT NULL,
+    "OwnerID"           bigint NOT NULL,
+    "RelationType"      text NOT NULL,
+    "Details"           jsonb NOT NULL DEFAULT 'null',
+    "IDs"               bigint[] NOT NULL DEFAULT '{}',
+    UNIQUE ("SocialNetworkType", "OwnerType", "OwnerID", "RelationType", "Details")
+);
+
+CREATE TABLE IF NOT EXISTS public."Objects_user" (
+    "Timestamp"         timestamptz NOT NULL,
+    "SocialNetworkType" text NOT NULL,
+    "OwnerType"         text NOT NULL,
+    "OwnerID"           bigint NOT NULL,
+    "Details"           jsonb NOT NULL DEFAULT 'null',
+    "Data"              jsonb NOT NULL,
+    "IsChanged"         boolean NOT NULL DEFAULT true,
+    UNIQUE ("SocialNetworkType", "OwnerType", "OwnerID", "Details")
+);
+
+CREATE TABLE IF NOT EXISTS public."Objects_group" (LIKE public."Objects_user" INCLUDING ALL);
+CREATE TABLE IF NOT EXISTS public."Objects_post" (LIKE public."Objects_user" INCLUDING ALL);
+CREATE TABLE IF NOT EXISTS public."Objects_photo" (LIKE public."Objects_user" INCLUDING ALL);
+
+CREATE TABLE IF NOT EXISTS monitoring."Tasks" (
+    "ID"                bigserial PRIMARY KEY,
+    "SocialNetworkType" text NOT NULL,
+    "OwnerType"         text NOT NULL,
+    "OwnerID"           bigint NOT NULL,
+    "Period"            integer NOT NULL,
+    "LastTimestamp"     timestamptz NOT NULL DEFAULT '-infinity',
+    "Filters"           jsonb,
+    "FilterLimits"      jsonb,
+    "AccountGroupID"    integer NOT NULL DEFAULT 0,
+    "IsUnlocked"        boolean,
+    "UnlockIDs"         jsonb
+);
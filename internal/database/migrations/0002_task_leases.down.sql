@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS monitoring."Tasks_LeaseExpiresAt_idx";
+
+ALTER TABLE monitoring."Tasks"
+    DROP COLUMN IF EXISTS "LeaseExpiresAt",
+    DROP COLUMN IF EXISTS "LeaseOwner";
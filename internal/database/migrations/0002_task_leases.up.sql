@@ -0,0 +1,5 @@
+ALTER TABLE monitoring."Tasks"
+    ADD COLUMN IF NOT EXISTS "LeaseOwner" text,
+    ADD COLUMN IF NOT EXISTS "LeaseExpiresAt" timestamptz;
+
+CREATE INDEX IF NOT EXISTS "Tasks_LeaseExpiresAt_idx" ON monitoring."Tasks" ("LeaseExpiresAt");
@@ -0,0 +1 @@
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "LastStatus";
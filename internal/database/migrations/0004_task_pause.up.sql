@@ -0,0 +1 @@
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "IsPaused" boolean NOT NULL DEFAULT false;
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS public."Objects_comment" (LIKE public."Objects_user" INCLUDING ALL);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public."Objects_topic";
+DROP TABLE IF EXISTS public."Objects_album";
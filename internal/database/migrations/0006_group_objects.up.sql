@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS public."Objects_album" (LIKE public."Objects_user" INCLUDING ALL);
+CREATE TABLE IF NOT EXISTS public."Objects_topic" (LIKE public."Objects_user" INCLUDING ALL);
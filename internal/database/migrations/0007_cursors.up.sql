@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS public."Cursors" (
+    "SocialNetworkType" text NOT NULL,
+    "OwnerType"         text NOT NULL,
+    "OwnerID"           bigint NOT NULL,
+    "Kind"              text NOT NULL,
+    "NewestID"          bigint NOT NULL DEFAULT 0,
+    "NewestDate"        timestamptz NOT NULL DEFAULT '-infinity',
+    "IDs"               bigint[] NOT NULL DEFAULT '{}',
+    "Complete"          boolean NOT NULL DEFAULT false,
+    "LastFullSync"      timestamptz NOT NULL DEFAULT '-infinity',
+    "UpdatedAt"         timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY ("SocialNetworkType", "OwnerType", "OwnerID", "Kind")
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS public."RelationChanges" (
+    "ID"                bigserial PRIMARY KEY,
+    "Timestamp"         timestamptz NOT NULL,
+    "SocialNetworkType" text NOT NULL,
+    "OwnerType"         text NOT NULL,
+    "OwnerID"           bigint NOT NULL,
+    "RelationType"      text NOT NULL,
+    "Details"           jsonb NOT NULL DEFAULT 'null',
+    "Added"             bigint[] NOT NULL DEFAULT '{}',
+    "Removed"           bigint[] NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS "RelationChanges_Owner_idx"
+    ON public."RelationChanges" ("OwnerType", "OwnerID", "RelationType", "Timestamp");
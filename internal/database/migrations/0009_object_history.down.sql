@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS public."ObjectHistory";
+
+ALTER TABLE public."Objects_topic" DROP COLUMN IF EXISTS "Hash";
+ALTER TABLE public."Objects_album" DROP COLUMN IF EXISTS "Hash";
+ALTER TABLE public."Objects_comment" DROP COLUMN IF EXISTS "Hash";
+ALTER TABLE public."Objects_photo" DROP COLUMN IF EXISTS "Hash";
+ALTER TABLE public."Objects_post" DROP COLUMN IF EXISTS "Hash";
+ALTER TABLE public."Objects_group" DROP COLUMN IF EXISTS "Hash";
+ALTER TABLE public."Objects_user" DROP COLUMN IF EXISTS "Hash";
@@ -0,0 +1,23 @@
+ALTER TABLE public."Objects_user" ADD COLUMN IF NOT EXISTS "Hash" text;
+ALTER TABLE public."Objects_group" ADD COLUMN IF NOT EXISTS "Hash" text;
+ALTER TABLE public."Objects_post" ADD COLUMN IF NOT EXISTS "Hash" text;
+ALTER TABLE public."Objects_photo" ADD COLUMN IF NOT EXISTS "Hash" text;
+ALTER TABLE public."Objects_comment" ADD COLUMN IF NOT EXISTS "Hash" text;
+ALTER TABLE public."Objects_album" ADD COLUMN IF NOT EXISTS "Hash" text;
+ALTER TABLE public."Objects_topic" ADD COLUMN IF NOT EXISTS "Hash" text;
+
+CREATE TABLE IF NOT EXISTS public."ObjectHistory" (
+    "ID"                bigserial PRIMARY KEY,
+    "ObjectType"        text NOT NULL,
+    "SocialNetworkType" text NOT NULL,
+    "OwnerType"         text NOT NULL,
+    "OwnerID"           bigint NOT NULL,
+    "Details"           jsonb NOT NULL DEFAULT 'null',
+    "Data"              jsonb NOT NULL DEFAULT 'null',
+    "ValidFrom"         timestamptz NOT NULL,
+    "ReplacedAt"        timestamptz NOT NULL,
+    "Diff"              jsonb NOT NULL DEFAULT '[]'
+);
+
+CREATE INDEX IF NOT EXISTS "ObjectHistory_Owner_idx"
+    ON public."ObjectHistory" ("ObjectType", "OwnerType", "OwnerID", "ReplacedAt");
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS monitoring."TaskRuns" (
+    "ID"              bigserial PRIMARY KEY,
+    "TaskID"          bigint NOT NULL REFERENCES monitoring."Tasks" ("ID") ON DELETE CASCADE,
+    "Worker"          text NOT NULL DEFAULT '',
+    "StartedAt"       timestamptz NOT NULL,
+    "FinishedAt"      timestamptz NOT NULL,
+    "Status"          text NOT NULL,
+    "AccountID"       bigint,
+    "Proxy"           text,
+    "APICalls"        integer NOT NULL DEFAULT 0,
+    "Objects"         integer NOT NULL DEFAULT 0,
+    "ObjectsWritten"  integer NOT NULL DEFAULT 0,
+    "Relations"       integer NOT NULL DEFAULT 0,
+    "RelationChanges" integer NOT NULL DEFAULT 0,
+    "Steps"           jsonb NOT NULL DEFAULT '[]',
+    "Error"           text
+);
+
+CREATE INDEX IF NOT EXISTS "TaskRuns_TaskID_idx"
+    ON monitoring."TaskRuns" ("TaskID", "StartedAt");
@@ -0,0 +1 @@
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "StepPolicy" jsonb;
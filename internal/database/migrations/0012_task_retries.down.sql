@@ -0,0 +1,6 @@
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "LastError";
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "IsDead";
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "RetryAt";
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "FailureCount";
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "RetryBackoff";
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "MaxAttempts";
@@ -0,0 +1,6 @@
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "MaxAttempts" integer NOT NULL DEFAULT 0;
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "RetryBackoff" integer NOT NULL DEFAULT 0;
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "FailureCount" integer NOT NULL DEFAULT 0;
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "RetryAt" timestamptz;
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "IsDead" boolean NOT NULL DEFAULT false;
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "LastError" text;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS monitoring."Tasks_NextRunAt_idx";
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "NextRunAt";
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "RunAt";
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "Timezone";
+ALTER TABLE monitoring."Tasks" DROP COLUMN IF EXISTS "Schedule";
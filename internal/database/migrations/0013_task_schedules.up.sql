@@ -0,0 +1,18 @@
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "Schedule" text;
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "Timezone" text;
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "RunAt" timestamptz;
+ALTER TABLE monitoring."Tasks" ADD COLUMN IF NOT EXISTS "NextRunAt" timestamptz;
+
+-- Tasks locked until another task unlocks them, dead tasks and finished
+-- one-shot tasks have no next run.
+UPDATE monitoring."Tasks"
+SET "NextRunAt" = CASE
+    WHEN "IsDead" THEN NULL
+    WHEN "RetryAt" IS NOT NULL THEN "RetryAt"
+    WHEN "IsUnlocked" IS NULL THEN "LastTimestamp" + ("Period" * INTERVAL '1 minute')
+    WHEN "IsUnlocked" THEN now()
+END;
+
+CREATE INDEX IF NOT EXISTS "Tasks_NextRunAt_idx"
+    ON monitoring."Tasks" ("NextRunAt")
+    WHERE NOT "IsPaused" AND NOT "IsDead";
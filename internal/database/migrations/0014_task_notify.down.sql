@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS "Tasks_notify" ON monitoring."Tasks";
+DROP FUNCTION IF EXISTS monitoring.notify_task_change();
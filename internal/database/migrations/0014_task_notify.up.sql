@@ -0,0 +1,13 @@
+-- Wakes up schedulers listening on "monitoring_tasks" when a task is
+-- created or its next run may have moved.
+CREATE OR REPLACE FUNCTION monitoring.notify_task_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('monitoring_tasks', NEW."ID"::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS "Tasks_notify" ON monitoring."Tasks";
+CREATE TRIGGER "Tasks_notify"
+    AFTER INSERT OR UPDATE OF "NextRunAt", "IsPaused", "IsDead", "IsUnlocked" ON monitoring."Tasks"
+    FOR EACH ROW EXECUTE PROCEDURE monitoring.notify_task_change();
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS public."Relations_Key_idx";
+ALTER TABLE public."Relations"
+    ADD UNIQUE ("SocialNetworkType", "OwnerType", "OwnerID", "RelationType", "Details");
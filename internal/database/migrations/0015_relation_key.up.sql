@@ -0,0 +1,27 @@
+-- Relation lists are identified by their details without the "complete"
+-- flag. Lists written while the flag was part of the key may have a row
+-- for each value of it; the newest one is kept.
+DELETE FROM public."Relations" r
+USING public."Relations" n
+WHERE n."SocialNetworkType" = r."SocialNetworkType" AND n."OwnerType" = r."OwnerType"
+  AND n."OwnerID" = r."OwnerID" AND n."RelationType" = r."RelationType"
+  AND (CASE WHEN jsonb_typeof(n."Details") = 'object' THEN n."Details" - 'complete' ELSE n."Details" END)
+    = (CASE WHEN jsonb_typeof(r."Details") = 'object' THEN r."Details" - 'complete' ELSE r."Details" END)
+  AND (n."Timestamp", n.ctid) > (r."Timestamp", r.ctid);
+
+DO $$
+DECLARE
+    name text;
+BEGIN
+    FOR name IN
+        SELECT conname FROM pg_constraint
+        WHERE conrelid = 'public."Relations"'::regclass AND contype = 'u'
+    LOOP
+        EXECUTE format('ALTER TABLE public."Relations" DROP CONSTRAINT %I', name);
+    END LOOP;
+END $$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS "Relations_Key_idx" ON public."Relations" (
+    "SocialNetworkType", "OwnerType", "OwnerID", "RelationType",
+    (CASE WHEN jsonb_typeof("Details") = 'object' THEN "Details" - 'complete' ELSE "Details" END)
+);
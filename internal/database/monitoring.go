@@ -1,38 +1,169 @@
 package database
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"time"
-	"strings"
-	
+
 	"github.com/lib/pq"
 )
 
+// Outcomes of a task run stored in "LastStatus".
+const (
+	TaskStatusSuccess     = "success"
+	TaskStatusPartial     = "partial"
+	TaskStatusFailed      = "failed"
+	TaskStatusInterrupted = "interrupted"
+	TaskStatusDead        = "dead"
+)
+
+// ErrLeaseLost is returned when a task lease has expired and has been
+// claimed by another worker.
+var ErrLeaseLost = errors.New("task lease lost")
+
 type MonitoringTask struct {
-	ID                 int64
-	SocialNetworkType  string
-	OwnerType          OwnerType
-	OwnerID            int64
-	Period             int
-	LastTimestamp      time.Time
-	Filters            map[string]interface{}
-	FilterLimits       map[string]interface{}
-	AccountGroupID     int
-	IsUnlockable       bool
-	UnlockIDs          []int64
+	ID                int64
+	SocialNetworkType string
+	OwnerType         OwnerType
+	OwnerID           int64
+	Period            int
+	LastTimestamp     time.Time
+	Filters           map[string]interface{}
+	FilterLimits      map[string]interface{}
+	StepPolicy        map[string]interface{}
+	AccountGroupID    int
+	IsUnlockable      bool
+	UnlockIDs         []int64
+	IsPaused          bool
+	LastStatus        *string
+	LeaseOwner        *string
+	LeaseExpiresAt    *time.Time
+	// A task runs every Period minutes or on a cron Schedule evaluated in
+	// Timezone, and once at RunAt if set. NextRunAt is kept up to date by
+	// the store, see NextRun.
+	Schedule  *string
+	Timezone  *string
+	RunAt     *time.Time
+	NextRunAt *time.Time
+	// Retry settings, see RetryDelay. Zero means the default.
+	MaxAttempts  int
+	RetryBackoff int // seconds
+	// Consecutive failures, when the task is tried again and whether it
+	// has given up.
+	FailureCount int
+	RetryAt      *time.Time
+	IsDead       bool
+	LastError    *string
 }
 
-func (db *DB) GetDueMonitoringTasks() ([]MonitoringTask, error) {
+// taskColumns lists the columns read by scanTask, in order.
+const taskColumns = `"ID", "SocialNetworkType", "OwnerType", "OwnerID", "Period",
+	"LastTimestamp", "Filters", "FilterLimits", "StepPolicy", "AccountGroupID",
+	"IsUnlocked" IS NOT NULL, "UnlockIDs", "IsPaused", "LastStatus",
+	"LeaseOwner", "LeaseExpiresAt", "MaxAttempts", "RetryBackoff",
+	"FailureCount", "RetryAt", "IsDead", "LastError", "Schedule", "Timezone",
+	"RunAt", "NextRunAt"`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTask(row rowScanner) (*MonitoringTask, error) {
+	var task MonitoringTask
+	var filtersJSON, filterLimitsJSON, stepPolicyJSON []byte
+	var unlockIDsJSON []byte
+	var leaseExpiresAt, retryAt, runAt, nextRunAt sql.NullTime
+
+	err := row.Scan(
+		&task.ID,
+		&task.SocialNetworkType,
+		&task.OwnerType,
+		&task.OwnerID,
+		&task.Period,
+		&task.LastTimestamp,
+		&filtersJSON,
+		&filterLimitsJSON,
+		&stepPolicyJSON,
+		&task.AccountGroupID,
+		&task.IsUnlockable,
+		&unlockIDsJSON,
+		&task.IsPaused,
+		&task.LastStatus,
+		&task.LeaseOwner,
+		&leaseExpiresAt,
+		&task.MaxAttempts,
+		&task.RetryBackoff,
+		&task.FailureCount,
+		&retryAt,
+		&task.IsDead,
+		&task.LastError,
+		&task.Schedule,
+		&task.Timezone,
+		&runAt,
+		&nextRunAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(filtersJSON) > 0 {
+		json.Unmarshal(filtersJSON, &task.Filters)
+	}
+	if len(filterLimitsJSON) > 0 {
+		json.Unmarshal(filterLimitsJSON, &task.FilterLimits)
+	}
+	if len(stepPolicyJSON) > 0 {
+		json.Unmarshal(stepPolicyJSON, &task.StepPolicy)
+	}
+	if len(unlockIDsJSON) > 0 {
+		json.Unmarshal(unlockIDsJSON, &task.UnlockIDs)
+	}
+	if leaseExpiresAt.Valid {
+		task.LeaseExpiresAt = &leaseExpiresAt.Time
+	}
+	if retryAt.Valid {
+		task.RetryAt = &retryAt.Time
+	}
+	if runAt.Valid {
+		task.RunAt = &runAt.Time
+	}
+	if nextRunAt.Valid {
+		task.NextRunAt = &nextRunAt.Time
+	}
+
+	return &task, nil
+}
+
+// ClaimDueMonitoringTasks atomically leases up to limit due tasks to owner.
+// Tasks leased by someone else are skipped until their lease expires, so
+// several workers and several processes can share one database. A task is
+// due when its NextRunAt has passed; paused and dead tasks and tasks
+// waiting to be unlocked are never claimed.
+func (db *DB) ClaimDueMonitoringTasks(owner string, lease time.Duration, limit int) ([]MonitoringTask, error) {
+	return db.ClaimDueMonitoringTasksContext(context.Background(), owner, lease, limit)
+}
+
+func (db *DB) ClaimDueMonitoringTasksContext(ctx context.Context, owner string, lease time.Duration, limit int) ([]MonitoringTask, error) {
 	query := `
-		SELECT now(), "ID", "SocialNetworkType", "OwnerType", "OwnerID", "Period",
-		       "LastTimestamp", "Filters", "FilterLimits", "AccountGroupID",
-		       "IsUnlocked" IS NOT NULL, "UnlockIDs"
-		FROM monitoring."Tasks"
-		WHERE (("IsUnlocked" IS NULL AND ("LastTimestamp" + ("Period" * INTERVAL '1 minute')) <= now()) OR "IsUnlocked" = true)
-		LIMIT 100
-	`
+		WITH due AS (
+			SELECT "ID" AS "DueID"
+			FROM monitoring."Tasks"
+			WHERE "NextRunAt" <= now() AND NOT "IsPaused" AND NOT "IsDead"
+			  AND "IsUnlocked" IS NOT FALSE
+			  AND ("LeaseExpiresAt" IS NULL OR "LeaseExpiresAt" < now())
+			ORDER BY "NextRunAt"
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE monitoring."Tasks"
+		SET "LeaseOwner" = $1, "LeaseExpiresAt" = now() + ($2 * INTERVAL '1 millisecond')
+		FROM due
+		WHERE "ID" = due."DueID"
+		RETURNING ` + taskColumns
 
-	rows, err := db.conn.Query(query)
+	rows, err := db.conn.QueryContext(ctx, query, owner, lease.Milliseconds(), limit)
 	if err != nil {
 		return nil, err
 	}
@@ -40,69 +171,111 @@ func (db *DB) GetDueMonitoringTasks() ([]MonitoringTask, error) {
 
 	var tasks []MonitoringTask
 	for rows.Next() {
-		var task MonitoringTask
-		var filtersJSON, filterLimitsJSON []byte
-		var unlockIDsJSON []byte
-		var now time.Time
-
-		err := rows.Scan(
-			&now,
-			&task.ID,
-			&task.SocialNetworkType,
-			&task.OwnerType,
-			&task.OwnerID,
-			&task.Period,
-			&task.LastTimestamp,
-			&filtersJSON,
-			&filterLimitsJSON,
-			&task.AccountGroupID,
-			&task.IsUnlockable,
-			&unlockIDsJSON,
-		)
+		task, err := scanTask(rows)
 		if err != nil {
 			return nil, err
 		}
+		tasks = append(tasks, *task)
+	}
 
-		if len(filtersJSON) > 0 {
-			json.Unmarshal(filtersJSON, &task.Filters)
-		}
-		if len(filterLimitsJSON) > 0 {
-			json.Unmarshal(filterLimitsJSON, &task.FilterLimits)
-		}
-		if len(unlockIDsJSON) > 0 {
-			json.Unmarshal(unlockIDsJSON, &task.UnlockIDs)
-		}
+	return tasks, rows.Err()
+}
 
-		tasks = append(tasks, task)
+// RenewTaskLease extends the lease held by owner. It returns ErrLeaseLost if
+// the lease is no longer held by owner.
+func (db *DB) RenewTaskLease(task *MonitoringTask, owner string, lease time.Duration) error {
+	return db.RenewTaskLeaseContext(context.Background(), task, owner, lease)
+}
+
+func (db *DB) RenewTaskLeaseContext(ctx context.Context, task *MonitoringTask, owner string, lease time.Duration) error {
+	query := `
+		UPDATE monitoring."Tasks"
+		SET "LeaseExpiresAt" = now() + ($3 * INTERVAL '1 millisecond')
+		WHERE "ID" = $1 AND "LeaseOwner" = $2
+		RETURNING "LeaseExpiresAt"
+	`
+
+	var expiresAt time.Time
+	err := db.conn.QueryRowContext(ctx, query, task.ID, owner, lease.Milliseconds()).Scan(&expiresAt)
+	if err == sql.ErrNoRows {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return err
 	}
 
-	return tasks, rows.Err()
+	task.LeaseExpiresAt = &expiresAt
+	return nil
+}
+
+// UpdateTaskLastTimestamp records a finished run with status, one of
+// TaskStatusSuccess and TaskStatusPartial, resets the failure count and
+// releases the lease held by task.LeaseOwner. The next run is computed
+// from the schedule of task; an unlocked task is locked again. Only a fully
+// successful run unlocks the tasks in task.UnlockIDs, which are due right
+// away. Failed runs are recorded with RecordTaskFailure.
+func (db *DB) UpdateTaskLastTimestamp(task *MonitoringTask, status string) error {
+	return db.UpdateTaskLastTimestampContext(context.Background(), task, status)
 }
 
-func (db *DB) UpdateTaskLastTimestamp(task *MonitoringTask, success bool) error {
-	var queryParts []string
-	var args []interface{}
-	
-	// Build UPDATE query for LastTimestamp
-	queryParts = append(queryParts, `UPDATE monitoring."Tasks" SET "LastTimestamp" = NOW()`)
-	
-	if success && task.IsUnlockable {
-		queryParts = append(queryParts, `, "IsUnlocked" = false`)
-	}
-	
-	queryParts = append(queryParts, ` WHERE "ID" = $1;`)
-	args = append(args, task.ID)
-	
-	// Add unlock query if needed
+func (db *DB) UpdateTaskLastTimestampContext(ctx context.Context, task *MonitoringTask, status string) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	success := status == TaskStatusSuccess
+	now := time.Now()
+
+	query := `
+		UPDATE monitoring."Tasks"
+		SET "LastTimestamp" = $4, "NextRunAt" = $5, "LastStatus" = $3, "LeaseOwner" = NULL, "LeaseExpiresAt" = NULL,
+			"FailureCount" = 0, "RetryAt" = NULL, "LastError" = NULL
+	`
+	if task.IsUnlockable {
+		query += `, "IsUnlocked" = false`
+	}
+	query += ` WHERE "ID" = $1 AND "LeaseOwner" IS NOT DISTINCT FROM $2`
+
+	res, err := tx.ExecContext(ctx, query, task.ID, task.LeaseOwner, status, now, task.NextRun(now, now))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrLeaseLost
+	}
+
 	if success && len(task.UnlockIDs) > 0 {
-		queryParts = append(queryParts, `UPDATE monitoring."Tasks" SET "IsUnlocked" = true WHERE "ID" = ANY($2);`)
-		// Convert []int64 to pq.Array for PostgreSQL
-		args = append(args, pq.Array(task.UnlockIDs))
-	}
-	
-	// Execute the combined query
-	finalQuery := strings.Join(queryParts, "")
-	_, err := db.conn.Exec(finalQuery, args...)
-	return err
-}	return nil
+		query := `UPDATE monitoring."Tasks" SET "IsUnlocked" = true, "NextRunAt" = now() WHERE "ID" = ANY($1)`
+		if _, err := tx.ExecContext(ctx, query, pq.Array(task.UnlockIDs)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RecordTaskInterrupted marks a run that was cut short by shutdown and
+// releases its lease. LastTimestamp is left alone, so the task is due again
+// as soon as a worker is available.
+func (db *DB) RecordTaskInterrupted(task *MonitoringTask) error {
+	return db.RecordTaskInterruptedContext(context.Background(), task)
+}
+
+func (db *DB) RecordTaskInterruptedContext(ctx context.Context, task *MonitoringTask) error {
+	query := `
+		UPDATE monitoring."Tasks"
+		SET "LastStatus" = $3, "LeaseOwner" = NULL, "LeaseExpiresAt" = NULL
+		WHERE "ID" = $1 AND "LeaseOwner" IS NOT DISTINCT FROM $2
+	`
+
+	res, err := db.conn.ExecContext(ctx, query, task.ID, task.LeaseOwner, TaskStatusInterrupted)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
 }
@@ -0,0 +1,286 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FieldKind is the JSON type of an object field.
+type FieldKind string
+
+const (
+	FieldNumber  FieldKind = "number"
+	FieldString  FieldKind = "string"
+	FieldBoolean FieldKind = "boolean"
+	FieldObject  FieldKind = "object"
+	FieldArray   FieldKind = "array"
+)
+
+// FieldSchema describes one field of the data of an object. Fields that
+// are not described are stored as they are.
+type FieldSchema struct {
+	Name     string
+	Kind     FieldKind
+	Required bool
+}
+
+// ObjectType describes a kind of object and the table it is stored in.
+type ObjectType struct {
+	Name string
+	// Key lists the detail fields that identify an object of an owner.
+	// Types without a key have one object per owner, written with nil
+	// details.
+	Key []string
+	// Parents lists the detail fields naming the item an object belongs
+	// to. Exactly one of them is set when the list is not empty.
+	Parents []string
+	// Fields is the schema of the object data.
+	Fields []FieldSchema
+	// Volatile lists top-level data fields that change without the object
+	// changing, such as counters or the last visit of a user. They are
+	// stored but left out of the hash and the diff, so a change in them
+	// alone neither rewrites nor archives the object.
+	Volatile []string
+}
+
+// Table returns the quoted name of the table holding objects of the type.
+func (t ObjectType) Table() string {
+	return `public."Objects_` + t.Name + `"`
+}
+
+var objectTypeName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+var (
+	objectTypesMu sync.RWMutex
+	objectTypes   = make(map[string]ObjectType)
+)
+
+// The object types stored by the collector. Data fields follow the VK API
+// objects; only the ID is required since deleted and private items come
+// back with little else.
+func init() {
+	RegisterObjectType(ObjectType{
+		Name: "user",
+		Fields: []FieldSchema{
+			{Name: "id", Kind: FieldNumber, Required: true},
+			{Name: "first_name", Kind: FieldString},
+			{Name: "last_name", Kind: FieldString},
+			{Name: "status", Kind: FieldString},
+			{Name: "city", Kind: FieldObject},
+		},
+		Volatile: []string{"last_seen", "online"},
+	})
+	RegisterObjectType(ObjectType{
+		Name: "group",
+		Fields: []FieldSchema{
+			{Name: "id", Kind: FieldNumber, Required: true},
+			{Name: "name", Kind: FieldString},
+			{Name: "screen_name", Kind: FieldString},
+		},
+		Volatile: []string{"members_count"},
+	})
+	RegisterObjectType(ObjectType{
+		Name: "post",
+		Key:  []string{"id"},
+		Fields: []FieldSchema{
+			{Name: "id", Kind: FieldNumber, Required: true},
+			{Name: "owner_id", Kind: FieldNumber},
+			{Name: "date", Kind: FieldNumber},
+			{Name: "text", Kind: FieldString},
+		},
+		Volatile: []string{"likes", "comments", "reposts", "views"},
+	})
+	RegisterObjectType(ObjectType{
+		Name: "photo",
+		Key:  []string{"id"},
+		Fields: []FieldSchema{
+			{Name: "id", Kind: FieldNumber, Required: true},
+			{Name: "owner_id", Kind: FieldNumber},
+			{Name: "album_id", Kind: FieldNumber},
+			{Name: "date", Kind: FieldNumber},
+			{Name: "sizes", Kind: FieldArray},
+		},
+		Volatile: []string{"likes", "comments", "reposts", "tags"},
+	})
+	RegisterObjectType(ObjectType{
+		Name:    "comment",
+		Key:     []string{"id"},
+		Parents: []string{"post_id", "photo_id", "topic_id"},
+		Fields: []FieldSchema{
+			{Name: "id", Kind: FieldNumber, Required: true},
+			{Name: "from_id", Kind: FieldNumber},
+			{Name: "date", Kind: FieldNumber},
+			{Name: "text", Kind: FieldString},
+		},
+	})
+	RegisterObjectType(ObjectType{
+		Name: "album",
+		Key:  []string{"id"},
+		Fields: []FieldSchema{
+			{Name: "id", Kind: FieldNumber, Required: true},
+			{Name: "title", Kind: FieldString},
+			{Name: "size", Kind: FieldNumber},
+		},
+	})
+	RegisterObjectType(ObjectType{
+		Name: "topic",
+		Key:  []string{"id"},
+		Fields: []FieldSchema{
+			{Name: "id", Kind: FieldNumber, Required: true},
+			{Name: "title", Kind: FieldString},
+			{Name: "created", Kind: FieldNumber},
+			{Name: "comments", Kind: FieldNumber},
+		},
+		Volatile: []string{"comments", "updated", "updated_by"},
+	})
+	RegisterObjectType(ObjectType{
+		Name: "video",
+		Key:  []string{"id"},
+		Fields: []FieldSchema{
+			{Name: "id", Kind: FieldNumber, Required: true},
+			{Name: "owner_id", Kind: FieldNumber},
+			{Name: "title", Kind: FieldString},
+			{Name: "date", Kind: FieldNumber},
+			{Name: "duration", Kind: FieldNumber},
+		},
+	})
+}
+
+// RegisterObjectType adds an object type to the registry. Its table is
+// created by the next "migrate up" and is only dropped by a "migrate down"
+// that reverts the first migration. It panics if the name is invalid or
+// already registered.
+func RegisterObjectType(t ObjectType) {
+	if !objectTypeName.MatchString(t.Name) {
+		panic(fmt.Sprintf("database: invalid object type name %q", t.Name))
+	}
+
+	objectTypesMu.Lock()
+	defer objectTypesMu.Unlock()
+
+	if _, ok := objectTypes[t.Name]; ok {
+		panic(fmt.Sprintf("database: object type %q registered twice", t.Name))
+	}
+	objectTypes[t.Name] = t
+}
+
+// LookupObjectType returns the registered object type with the given name.
+func LookupObjectType(name string) (ObjectType, bool) {
+	objectTypesMu.RLock()
+	defer objectTypesMu.RUnlock()
+
+	t, ok := objectTypes[name]
+	return t, ok
+}
+
+// ObjectTypes returns all registered object types ordered by name.
+func ObjectTypes() []ObjectType {
+	objectTypesMu.RLock()
+	defer objectTypesMu.RUnlock()
+
+	types := make([]ObjectType, 0, len(objectTypes))
+	for _, t := range objectTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
+
+// ValidateObject checks an object against its registered type and returns
+// the type. Details and data are expected in their decoded JSON form.
+// Errors are *ValidationError.
+func ValidateObject(objectType string, details, data map[string]interface{}) (ObjectType, error) {
+	t, ok := LookupObjectType(objectType)
+	if !ok {
+		return ObjectType{}, &ValidationError{Field: "ObjectType", Message: fmt.Sprintf("unknown object type %q", objectType)}
+	}
+
+	if err := t.validateDetails(details); err != nil {
+		return ObjectType{}, err
+	}
+
+	for _, field := range t.Fields {
+		value, ok := data[field.Name]
+		if !ok || value == nil {
+			if field.Required {
+				return ObjectType{}, &ValidationError{Field: "Data", Message: fmt.Sprintf("%s: missing %q", t.Name, field.Name)}
+			}
+			continue
+		}
+		if kind := jsonKind(value); kind != field.Kind {
+			return ObjectType{}, &ValidationError{Field: "Data", Message: fmt.Sprintf("%s: %q must be a %s, not a %s", t.Name, field.Name, field.Kind, kind)}
+		}
+	}
+
+	return t, nil
+}
+
+func (t ObjectType) validateDetails(details map[string]interface{}) error {
+	if len(t.Key) == 0 && len(t.Parents) == 0 {
+		if details != nil {
+			return &ValidationError{Field: "Details", Message: fmt.Sprintf("%s objects have no details", t.Name)}
+		}
+		return nil
+	}
+
+	for _, key := range t.Key {
+		if jsonKind(details[key]) != FieldNumber {
+			return &ValidationError{Field: "Details", Message: fmt.Sprintf("%s: %q must be a number", t.Name, key)}
+		}
+	}
+
+	var parents []string
+	for _, parent := range t.Parents {
+		if value, ok := details[parent]; ok {
+			if jsonKind(value) != FieldNumber {
+				return &ValidationError{Field: "Details", Message: fmt.Sprintf("%s: %q must be a number", t.Name, parent)}
+			}
+			parents = append(parents, parent)
+		}
+	}
+	if len(t.Parents) > 0 && len(parents) != 1 {
+		return &ValidationError{Field: "Details", Message: fmt.Sprintf("%s: exactly one of %s is required", t.Name, strings.Join(t.Parents, ", "))}
+	}
+
+	if len(details) != len(t.Key)+len(parents) {
+		return &ValidationError{Field: "Details", Message: fmt.Sprintf("%s: unexpected fields in %v", t.Name, details)}
+	}
+	return nil
+}
+
+func jsonKind(value interface{}) FieldKind {
+	switch value.(type) {
+	case float64:
+		return FieldNumber
+	case string:
+		return FieldString
+	case bool:
+		return FieldBoolean
+	case map[string]interface{}:
+		return FieldObject
+	case []interface{}:
+		return FieldArray
+	case nil:
+		return "null"
+	}
+	return FieldKind(fmt.Sprintf("%T", value))
+}
+
+// objectTableDDL creates the table of an object type. It matches
+// "Objects_user" as created by the migrations.
+const objectTableDDL = `
+	CREATE TABLE IF NOT EXISTS %s (
+		"Timestamp"         timestamptz NOT NULL,
+		"SocialNetworkType" text NOT NULL,
+		"OwnerType"         text NOT NULL,
+		"OwnerID"           bigint NOT NULL,
+		"Details"           jsonb NOT NULL DEFAULT 'null',
+		"Data"              jsonb NOT NULL,
+		"IsChanged"         boolean NOT NULL DEFAULT true,
+		"Hash"              text,
+		UNIQUE ("SocialNetworkType", "OwnerType", "OwnerID", "Details")
+	)
+`
@@ -0,0 +1,247 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FieldChange is one difference between two versions of an object. Path
+// joins the keys of nested objects with dots, e.g. "city.title". Arrays
+// are compared as a whole.
+type FieldChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Operations of a FieldChange.
+const (
+	FieldAdded   = "added"
+	FieldRemoved = "removed"
+	FieldChanged = "changed"
+)
+
+// ObjectVersion is a replaced version of an object with the changes that
+// replaced it.
+type ObjectVersion struct {
+	ID                int64
+	ObjectType        string
+	SocialNetworkType string
+	Owner             Owner
+	Details           map[string]interface{}
+	// Data was current from ValidFrom until ReplacedAt.
+	Data       map[string]interface{}
+	ValidFrom  time.Time
+	ReplacedAt time.Time
+	Diff       []FieldChange
+}
+
+// ObjectHistoryFilter selects object versions. Zero values match all
+// versions; Since is inclusive and Until exclusive, both applied to
+// ReplacedAt.
+type ObjectHistoryFilter struct {
+	ObjectType        string
+	SocialNetworkType string
+	Owner             Owner
+	// Details selects a single object, e.g. {"id": 12}.
+	Details map[string]interface{}
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// ObjectHash returns the content hash of object data. encoding/json sorts
+// map keys, so equal data always hashes the same.
+func ObjectHash(data map[string]interface{}) (string, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Hash returns the content hash of object data of type t, leaving out its
+// volatile fields.
+func (t ObjectType) Hash(data map[string]interface{}) (string, error) {
+	return ObjectHash(t.stable(data))
+}
+
+// Diff returns the field changes from old to new of an object of type t,
+// leaving out its volatile fields.
+func (t ObjectType) Diff(old, new map[string]interface{}) []FieldChange {
+	return DiffObjects(t.stable(old), t.stable(new))
+}
+
+// stable returns data without the volatile fields of t.
+func (t ObjectType) stable(data map[string]interface{}) map[string]interface{} {
+	if len(t.Volatile) == 0 || data == nil {
+		return data
+	}
+	out := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		out[k] = v
+	}
+	for _, field := range t.Volatile {
+		delete(out, field)
+	}
+	return out
+}
+
+// DiffObjects returns the field changes from old to new, sorted by path.
+// Both are expected in their decoded JSON form.
+func DiffObjects(old, new map[string]interface{}) []FieldChange {
+	var changes []FieldChange
+	diffFields("", old, new, &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func diffFields(prefix string, old, new map[string]interface{}, changes *[]FieldChange) {
+	for key, oldValue := range old {
+		path := prefix + key
+		newValue, ok := new[key]
+		if !ok {
+			*changes = append(*changes, FieldChange{Path: path, Op: FieldRemoved, Old: oldValue})
+			continue
+		}
+
+		oldMap, oldIsMap := oldValue.(map[string]interface{})
+		newMap, newIsMap := newValue.(map[string]interface{})
+		if oldIsMap && newIsMap {
+			diffFields(path+".", oldMap, newMap, changes)
+			continue
+		}
+		if !reflect.DeepEqual(oldValue, newValue) {
+			*changes = append(*changes, FieldChange{Path: path, Op: FieldChanged, Old: oldValue, New: newValue})
+		}
+	}
+
+	for key, newValue := range new {
+		if _, ok := old[key]; !ok {
+			*changes = append(*changes, FieldChange{Path: prefix + key, Op: FieldAdded, New: newValue})
+		}
+	}
+}
+
+// normalizeJSON round-trips data through JSON so that it compares equal to
+// data read back from jsonb.
+func normalizeJSON(data map[string]interface{}) (map[string]interface{}, error) {
+	if data == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (db *DB) ListObjectHistory(filter ObjectHistoryFilter) ([]ObjectVersion, error) {
+	return db.ListObjectHistoryContext(context.Background(), filter)
+}
+
+// ListObjectHistoryContext returns the versions matching filter, most
+// recently replaced first.
+func (db *DB) ListObjectHistoryContext(ctx context.Context, filter ObjectHistoryFilter) ([]ObjectVersion, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.ObjectType != "" {
+		addCondition(`"ObjectType" = $%d`, filter.ObjectType)
+	}
+	if filter.SocialNetworkType != "" {
+		addCondition(`"SocialNetworkType" = $%d`, filter.SocialNetworkType)
+	}
+	if filter.Owner.Type != "" {
+		addCondition(`"OwnerType" = $%d`, filter.Owner.Type)
+	}
+	if filter.Owner.ID != 0 {
+		addCondition(`"OwnerID" = $%d`, filter.Owner.ID)
+	}
+	if filter.Details != nil {
+		detailsJSON, err := json.Marshal(filter.Details)
+		if err != nil {
+			return nil, err
+		}
+		addCondition(`"Details" = $%d::jsonb`, detailsJSON)
+	}
+	if !filter.Since.IsZero() {
+		addCondition(`"ReplacedAt" >= $%d`, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		addCondition(`"ReplacedAt" < $%d`, filter.Until)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	query := `
+		SELECT "ID", "ObjectType", "SocialNetworkType", "OwnerType", "OwnerID",
+			"Details", "Data", "ValidFrom", "ReplacedAt", "Diff"
+		FROM public."ObjectHistory"
+	`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(` ORDER BY "ReplacedAt" DESC, "ID" DESC LIMIT %d`, limit)
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []ObjectVersion
+	for rows.Next() {
+		var v ObjectVersion
+		var detailsJSON, dataJSON, diffJSON []byte
+		err := rows.Scan(
+			&v.ID,
+			&v.ObjectType,
+			&v.SocialNetworkType,
+			&v.Owner.Type,
+			&v.Owner.ID,
+			&detailsJSON,
+			&dataJSON,
+			&v.ValidFrom,
+			&v.ReplacedAt,
+			&diffJSON,
+		)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(detailsJSON, &v.Details)
+		json.Unmarshal(dataJSON, &v.Data)
+		json.Unmarshal(diffJSON, &v.Diff)
+		versions = append(versions, v)
+	}
+
+	return versions, rows.Err()
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestObjectTypeIgnoresVolatileFields(t *testing.T) {
+	user, ok := LookupObjectType("user")
+	if !ok {
+		t.Fatal("user type not registered")
+	}
+
+	old := map[string]interface{}{
+		"id":         float64(1),
+		"first_name": "Pavel",
+		"last_seen":  map[string]interface{}{"time": float64(100), "platform": float64(7)},
+		"online":     float64(0),
+	}
+	seen := map[string]interface{}{
+		"id":         float64(1),
+		"first_name": "Pavel",
+		"last_seen":  map[string]interface{}{"time": float64(200), "platform": float64(1)},
+		"online":     float64(1),
+	}
+	renamed := map[string]interface{}{
+		"id":         float64(1),
+		"first_name": "Paul",
+		"last_seen":  map[string]interface{}{"time": float64(300), "platform": float64(1)},
+	}
+
+	oldHash, err := user.Hash(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seenHash, err := user.Hash(seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamedHash, err := user.Hash(renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldHash != seenHash {
+		t.Error("hash changed with last_seen and online only")
+	}
+	if oldHash == renamedHash {
+		t.Error("hash did not change with the name")
+	}
+	if diff := user.Diff(old, seen); len(diff) != 0 {
+		t.Errorf("diff of volatile fields: got %v, want none", diff)
+	}
+
+	want := []FieldChange{{Path: "first_name", Op: FieldChanged, Old: "Pavel", New: "Paul"}}
+	if diff := user.Diff(old, renamed); !reflect.DeepEqual(diff, want) {
+		t.Errorf("got %v, want %v", diff, want)
+	}
+	if _, ok := old["last_seen"]; !ok {
+		t.Error("Hash or Diff modified its argument")
+	}
+
+	// Without a volatile list every field counts.
+	plain := ObjectType{Name: "plain"}
+	plainOld, _ := plain.Hash(old)
+	plainSeen, _ := plain.Hash(seen)
+	if plainOld == plainSeen {
+		t.Error("hash of a type without volatile fields ignored last_seen")
+	}
+}
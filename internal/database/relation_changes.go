@@ -0,0 +1,215 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// completeKey is the relation detail that flags lists cut short by an item
+// cap. It is not part of the identity of a list.
+const completeKey = "complete"
+
+// relationKeyDetails is the SQL form of RelationKeyDetails. It is part of
+// the unique index "Relations_Key_idx" and has to match it for ON CONFLICT.
+const relationKeyDetails = `CASE WHEN jsonb_typeof("Details") = 'object' THEN "Details" - 'complete' ELSE "Details" END`
+
+// relationConflict is the ON CONFLICT target of relation upserts.
+const relationConflict = `("SocialNetworkType", "OwnerType", "OwnerID", "RelationType", (` + relationKeyDetails + `))`
+
+// RelationChange records the IDs added to and removed from a relation list
+// by one write.
+type RelationChange struct {
+	ID                int64
+	Timestamp         time.Time
+	SocialNetworkType string
+	Owner             Owner
+	RelationType      RelationType
+	// Details identify the list, without the completeness flag.
+	Details map[string]interface{}
+	Added   []int64
+	Removed []int64
+}
+
+// RelationChangeFilter selects relation changes. Zero values match all
+// changes; Since is inclusive and Until exclusive.
+type RelationChangeFilter struct {
+	SocialNetworkType string
+	Owner             Owner
+	RelationType      RelationType
+	// Details selects a single list, e.g. {"post_id": 12}. Nil matches
+	// all lists of the relation type.
+	Details map[string]interface{}
+	Since   time.Time
+	Until   time.Time
+}
+
+// RelationKeyDetails returns details without the completeness flag, which
+// is what identifies a relation list.
+func RelationKeyDetails(details map[string]interface{}) map[string]interface{} {
+	if details == nil {
+		return nil
+	}
+	key := make(map[string]interface{}, len(details))
+	for k, v := range details {
+		if k != completeKey {
+			key[k] = v
+		}
+	}
+	return key
+}
+
+// RelationComplete reports whether details describe a complete list.
+// Lists without the flag are complete.
+func RelationComplete(details map[string]interface{}) bool {
+	complete, ok := details[completeKey].(bool)
+	return !ok || complete
+}
+
+// DiffRelationIDs returns the IDs added to and removed from a list. An
+// incomplete list proves neither: IDs missing from an incomplete new list
+// may lie beyond the cap, and IDs new to an incomplete old list may have
+// been there before.
+func DiffRelationIDs(oldIDs, newIDs []int64, oldComplete, newComplete bool) (added, removed []int64) {
+	oldSet := make(map[int64]bool, len(oldIDs))
+	for _, id := range oldIDs {
+		oldSet[id] = true
+	}
+	newSet := make(map[int64]bool, len(newIDs))
+	for _, id := range newIDs {
+		newSet[id] = true
+	}
+
+	if oldComplete {
+		for _, id := range newIDs {
+			if !oldSet[id] {
+				added = append(added, id)
+				oldSet[id] = true
+			}
+		}
+	}
+	if newComplete {
+		for _, id := range oldIDs {
+			if !newSet[id] {
+				removed = append(removed, id)
+				newSet[id] = true
+			}
+		}
+	}
+	return added, removed
+}
+
+// NetRelationChanges folds changes of a single list, oldest first, into
+// the IDs added and removed over the whole period. An ID added and removed
+// again does not show up. Both results are sorted.
+func NetRelationChanges(changes []RelationChange) (added, removed []int64) {
+	state := make(map[int64]int)
+	for _, change := range changes {
+		for _, id := range change.Added {
+			state[id]++
+		}
+		for _, id := range change.Removed {
+			state[id]--
+		}
+	}
+
+	for id, n := range state {
+		switch {
+		case n > 0:
+			added = append(added, id)
+		case n < 0:
+			removed = append(removed, id)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	return added, removed
+}
+
+func (db *DB) ListRelationChanges(filter RelationChangeFilter) ([]RelationChange, error) {
+	return db.ListRelationChangesContext(context.Background(), filter)
+}
+
+// ListRelationChangesContext returns the changes matching filter, oldest
+// first.
+func (db *DB) ListRelationChangesContext(ctx context.Context, filter RelationChangeFilter) ([]RelationChange, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.SocialNetworkType != "" {
+		addCondition(`"SocialNetworkType" = $%d`, filter.SocialNetworkType)
+	}
+	if filter.Owner.Type != "" {
+		addCondition(`"OwnerType" = $%d`, filter.Owner.Type)
+	}
+	if filter.Owner.ID != 0 {
+		addCondition(`"OwnerID" = $%d`, filter.Owner.ID)
+	}
+	if filter.RelationType != "" {
+		addCondition(`"RelationType" = $%d`, filter.RelationType)
+	}
+	if filter.Details != nil {
+		detailsJSON, err := json.Marshal(RelationKeyDetails(filter.Details))
+		if err != nil {
+			return nil, err
+		}
+		addCondition(`"Details" = $%d::jsonb`, detailsJSON)
+	}
+	if !filter.Since.IsZero() {
+		addCondition(`"Timestamp" >= $%d`, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		addCondition(`"Timestamp" < $%d`, filter.Until)
+	}
+
+	query := `
+		SELECT "ID", "Timestamp", "SocialNetworkType", "OwnerType", "OwnerID",
+			"RelationType", "Details", "Added", "Removed"
+		FROM public."RelationChanges"
+	`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY "Timestamp", "ID"`
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []RelationChange
+	for rows.Next() {
+		var change RelationChange
+		var detailsJSON []byte
+		err := rows.Scan(
+			&change.ID,
+			&change.Timestamp,
+			&change.SocialNetworkType,
+			&change.Owner.Type,
+			&change.Owner.ID,
+			&change.RelationType,
+			&detailsJSON,
+			pq.Array(&change.Added),
+			pq.Array(&change.Removed),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(detailsJSON, &change.Details); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, rows.Err()
+}
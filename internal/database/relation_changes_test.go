@@ -0,0 +1,127 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func sorted(ids []int64) []int64 {
+	ids = append([]int64(nil), ids...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestDiffRelationIDs(t *testing.T) {
+	tests := []struct {
+		name        string
+		old, new    []int64
+		oldComplete bool
+		newComplete bool
+		added       []int64
+		removed     []int64
+	}{
+		{"unchanged", []int64{1, 2}, []int64{2, 1}, true, true, nil, nil},
+		{"first write", nil, []int64{1, 2}, true, true, []int64{1, 2}, nil},
+		{"added", []int64{1, 2}, []int64{1, 2, 3}, true, true, []int64{3}, nil},
+		{"removed", []int64{1, 2, 3}, []int64{1, 3}, true, true, nil, []int64{2}},
+		{"added and removed", []int64{1, 2}, []int64{2, 3, 4}, true, true, []int64{3, 4}, []int64{1}},
+		{"emptied", []int64{1, 2}, nil, true, true, nil, []int64{1, 2}},
+		{"duplicates", []int64{1, 1, 2}, []int64{2, 3, 3}, true, true, []int64{3}, []int64{1}},
+		{"incomplete new list proves no removals", []int64{1, 2, 3}, []int64{1, 4}, true, false, []int64{4}, nil},
+		{"incomplete old list proves no additions", []int64{1, 2}, []int64{2, 3}, false, true, nil, []int64{1}},
+		{"both incomplete", []int64{1, 2}, []int64{3}, false, false, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := DiffRelationIDs(tt.old, tt.new, tt.oldComplete, tt.newComplete)
+			if !reflect.DeepEqual(sorted(added), sorted(tt.added)) {
+				t.Errorf("added: got %v, want %v", added, tt.added)
+			}
+			if !reflect.DeepEqual(sorted(removed), sorted(tt.removed)) {
+				t.Errorf("removed: got %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestNetRelationChanges(t *testing.T) {
+	change := func(added, removed []int64) RelationChange {
+		return RelationChange{Added: added, Removed: removed}
+	}
+
+	tests := []struct {
+		name    string
+		changes []RelationChange
+		added   []int64
+		removed []int64
+	}{
+		{"none", nil, nil, nil},
+		{"single", []RelationChange{change([]int64{3, 1}, []int64{2})}, []int64{1, 3}, []int64{2}},
+		{"added then removed", []RelationChange{
+			change([]int64{5}, nil),
+			change(nil, []int64{5}),
+		}, nil, nil},
+		{"removed then added", []RelationChange{
+			change(nil, []int64{5}),
+			change([]int64{5}, nil),
+		}, nil, nil},
+		{"added, removed and added again", []RelationChange{
+			change([]int64{5}, nil),
+			change(nil, []int64{5}),
+			change([]int64{5}, nil),
+		}, []int64{5}, nil},
+		{"mixed", []RelationChange{
+			change([]int64{1, 2}, []int64{9}),
+			change([]int64{3}, []int64{1}),
+			change(nil, []int64{8}),
+		}, []int64{2, 3}, []int64{8, 9}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := NetRelationChanges(tt.changes)
+			if !reflect.DeepEqual(added, tt.added) {
+				t.Errorf("added: got %v, want %v", added, tt.added)
+			}
+			if !reflect.DeepEqual(removed, tt.removed) {
+				t.Errorf("removed: got %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestRelationKeyDetails(t *testing.T) {
+	tests := []struct {
+		name     string
+		details  map[string]interface{}
+		key      map[string]interface{}
+		complete bool
+	}{
+		{"nil", nil, nil, true},
+		{"no flag", map[string]interface{}{"post_id": 12}, map[string]interface{}{"post_id": 12}, true},
+		{"complete", map[string]interface{}{"complete": true}, map[string]interface{}{}, true},
+		{"incomplete", map[string]interface{}{"complete": false}, map[string]interface{}{}, false},
+		{"item and flag", map[string]interface{}{"post_id": 12, "complete": false}, map[string]interface{}{"post_id": 12}, false},
+		{"flag of the wrong type", map[string]interface{}{"complete": "no"}, map[string]interface{}{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RelationKeyDetails(tt.details); !reflect.DeepEqual(got, tt.key) {
+				t.Errorf("RelationKeyDetails = %v, want %v", got, tt.key)
+			}
+			if got := RelationComplete(tt.details); got != tt.complete {
+				t.Errorf("RelationComplete = %v, want %v", got, tt.complete)
+			}
+		})
+	}
+
+	// The flag is dropped from a copy; the details are not changed.
+	details := map[string]interface{}{"photo_id": 3, "complete": true}
+	RelationKeyDetails(details)
+	if _, ok := details["complete"]; !ok {
+		t.Error("RelationKeyDetails modified its argument")
+	}
+}
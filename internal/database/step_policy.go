@@ -0,0 +1,114 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// policySpec is the JSON schema of the "StepPolicy" column:
+//
+//	{
+//	  "required": ["profile", "friends"],
+//	  "ignored": ["likes", "photo.comments"]
+//	}
+//
+// Step names are those of TaskRunStep. A name without a dot also matches
+// the steps of that kind on posts, photos and topics, so "likes" covers
+// "post.likes" and "photo.likes".
+type policySpec struct {
+	Required []string `json:"required"`
+	Ignored  []string `json:"ignored"`
+}
+
+// StepPolicy is the parsed form of the StepPolicy of a task. It decides the
+// outcome of a run from its steps: a failed required step fails the run,
+// failures of ignored steps do not count, and any other failure makes the
+// run partial. Without a policy only the profile is required.
+type StepPolicy struct {
+	required []string
+	ignored  []string
+}
+
+// DefaultStepPolicy is used for tasks without a StepPolicy.
+var DefaultStepPolicy = &StepPolicy{required: []string{"profile"}}
+
+// stepNames are the names a policy may refer to.
+var stepNames = map[string]bool{"profile": true, "albums": true}
+
+func init() {
+	for _, kind := range CollectKinds {
+		stepNames[string(kind)] = true
+	}
+	for _, item := range []string{"post", "photo", "topic"} {
+		stepNames[item+".likes"] = true
+		stepNames[item+".comments"] = true
+	}
+}
+
+// ParseStepPolicy parses and validates the StepPolicy of a task. A nil
+// policy returns DefaultStepPolicy. Errors are *ValidationError.
+func ParseStepPolicy(policy map[string]interface{}) (*StepPolicy, error) {
+	if policy == nil {
+		return DefaultStepPolicy, nil
+	}
+
+	var spec policySpec
+	if err := decodeStrict(policy, &spec); err != nil {
+		return nil, &ValidationError{Field: "StepPolicy", Message: err.Error()}
+	}
+
+	seen := make(map[string]string)
+	for _, list := range []struct {
+		field string
+		names []string
+	}{
+		{"required", spec.Required},
+		{"ignored", spec.Ignored},
+	} {
+		for _, name := range list.names {
+			if !stepNames[name] {
+				return nil, &ValidationError{Field: "StepPolicy", Message: fmt.Sprintf("unknown step %q in %s", name, list.field)}
+			}
+			if field, ok := seen[name]; ok && field != list.field {
+				return nil, &ValidationError{Field: "StepPolicy", Message: fmt.Sprintf("step %q is both required and ignored", name)}
+			}
+			seen[name] = list.field
+		}
+	}
+
+	return &StepPolicy{required: spec.Required, ignored: spec.Ignored}, nil
+}
+
+// Outcome returns the status of a run whose collection returned no error
+// and ran steps, and the names of the failed or partial steps that decided
+// it.
+func (p *StepPolicy) Outcome(steps []TaskRunStep) (RunStatus, []string) {
+	status := RunSucceeded
+	var failed []string
+	for _, step := range steps {
+		if step.Status == StepOK || (matchStep(p.ignored, step.Name) && !matchStep(p.required, step.Name)) {
+			continue
+		}
+		failed = append(failed, step.Name)
+		if step.Status == StepFailed && matchStep(p.required, step.Name) {
+			status = RunFailed
+		} else if status != RunFailed {
+			status = RunPartial
+		}
+	}
+	return status, failed
+}
+
+// matchStep reports whether step is one of names, directly or as the
+// "<item>.<name>" form of a name without a dot.
+func matchStep(names []string, step string) bool {
+	for _, name := range names {
+		if name == step {
+			return true
+		}
+		if !strings.Contains(name, ".") && strings.HasSuffix(step, "."+name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// RelationWriter stores relation lists, replacing the previous list with
+// the same key.
+type RelationWriter interface {
+	WriteRelationsContext(ctx context.Context, socialNetworkType string, owner Owner, relationType RelationType, details map[string]interface{}, ids []int64) error
+}
+
+// ObjectWriter stores objects, replacing the previous object with the same
+// key.
+type ObjectWriter interface {
+	WriteObjectContext(ctx context.Context, socialNetworkType string, owner Owner, objectType string, details map[string]interface{}, data map[string]interface{}) error
+}
+
+// Writer is what the collector needs to store its results.
+type Writer interface {
+	RelationWriter
+	ObjectWriter
+}
+
+// BatchWriter stores the writes buffered by a Batch in one transaction.
+type BatchWriter interface {
+	WriteBatchContext(ctx context.Context, batch *Batch) (BatchStats, error)
+}
+
+// RelationHistory reads the changes recorded by relation writes.
+type RelationHistory interface {
+	ListRelationChangesContext(ctx context.Context, filter RelationChangeFilter) ([]RelationChange, error)
+}
+
+// ObjectHistory reads the versions archived by object writes.
+type ObjectHistory interface {
+	ListObjectHistoryContext(ctx context.Context, filter ObjectHistoryFilter) ([]ObjectVersion, error)
+}
+
+// CursorStore keeps the progress of incremental collection.
+type CursorStore interface {
+	GetCursorContext(ctx context.Context, socialNetworkType string, owner Owner, kind CollectKind) (*Cursor, error)
+	SaveCursorContext(ctx context.Context, cursor *Cursor) error
+}
+
+// AccountStore manages the accounts used to access social networks.
+type AccountStore interface {
+	GetAvailableAccountContext(ctx context.Context, socialNetworkType string, groupID int) (*Account, error)
+	UpdateAccountSessionContext(ctx context.Context, accountID int64, session map[string]interface{}) error
+	MarkAccountBlockedContext(ctx context.Context, accountID int64, info string) error
+	SetAccountUnavailableContext(ctx context.Context, accountID int64, duration time.Duration) error
+	ListAccountsContext(ctx context.Context) ([]Account, error)
+	CreateAccountContext(ctx context.Context, acc *Account) error
+	DeleteAccountContext(ctx context.Context, accountID int64) error
+}
+
+// TaskStore manages monitoring tasks and their leases.
+type TaskStore interface {
+	ClaimDueMonitoringTasksContext(ctx context.Context, owner string, lease time.Duration, limit int) ([]MonitoringTask, error)
+	RenewTaskLeaseContext(ctx context.Context, task *MonitoringTask, owner string, lease time.Duration) error
+	UpdateTaskLastTimestampContext(ctx context.Context, task *MonitoringTask, status string) error
+	RecordTaskInterruptedContext(ctx context.Context, task *MonitoringTask) error
+	RecordTaskFailureContext(ctx context.Context, task *MonitoringTask, errText string) error
+	ListMonitoringTasksContext(ctx context.Context, filter TaskFilter) ([]MonitoringTask, error)
+	GetMonitoringTaskContext(ctx context.Context, taskID int64) (*MonitoringTask, error)
+	CreateMonitoringTaskContext(ctx context.Context, task *MonitoringTask) error
+	UpdateMonitoringTaskContext(ctx context.Context, taskID int64, update TaskUpdate) (*MonitoringTask, error)
+	DeleteMonitoringTaskContext(ctx context.Context, taskID int64) error
+	SetMonitoringTaskPausedContext(ctx context.Context, taskID int64, paused bool) (*MonitoringTask, error)
+	RequeueMonitoringTaskContext(ctx context.Context, taskID int64) (*MonitoringTask, error)
+}
+
+// TaskNotifier tells the scheduler when to look for due tasks.
+type TaskNotifier interface {
+	NextTaskRunContext(ctx context.Context) (*time.Time, error)
+	TaskChanges(ctx context.Context) (<-chan struct{}, error)
+}
+
+// RunStore keeps the ledger of task runs.
+type RunStore interface {
+	CommitTaskRunContext(ctx context.Context, run *TaskRun, batch *Batch) error
+	ListTaskRunsContext(ctx context.Context, taskID int64, limit int) ([]TaskRun, error)
+}
+
+// Store is the complete storage used by the scheduler and the HTTP server.
+// DB implements it on top of PostgreSQL; memstore.Store keeps everything in
+// memory for tests.
+type Store interface {
+	Writer
+	BatchWriter
+	RelationHistory
+	ObjectHistory
+	CursorStore
+	AccountStore
+	TaskStore
+	TaskNotifier
+	RunStore
+}
+
+var _ Store = (*DB)(nil)
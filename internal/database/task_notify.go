@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// taskChannel is the channel the "Tasks_notify" trigger notifies.
+const taskChannel = "monitoring_tasks"
+
+func (db *DB) NextTaskRun() (*time.Time, error) {
+	return db.NextTaskRunContext(context.Background())
+}
+
+// NextTaskRunContext returns the earliest time a task can be claimed, or
+// nil if no task is scheduled. Tasks leased by a worker count from the end
+// of their lease; expired leases left by crashed workers are ignored.
+func (db *DB) NextTaskRunContext(ctx context.Context) (*time.Time, error) {
+	query := `
+		SELECT min(CASE WHEN "LeaseExpiresAt" > now()
+			THEN GREATEST("NextRunAt", "LeaseExpiresAt")
+			ELSE "NextRunAt" END)
+		FROM monitoring."Tasks"
+		WHERE "NextRunAt" IS NOT NULL AND NOT "IsPaused" AND NOT "IsDead"
+		  AND "IsUnlocked" IS NOT FALSE
+	`
+
+	var next sql.NullTime
+	if err := db.conn.QueryRowContext(ctx, query).Scan(&next); err != nil {
+		return nil, err
+	}
+	if !next.Valid {
+		return nil, nil
+	}
+	return &next.Time, nil
+}
+
+// TaskChanges listens for tasks being created, rescheduled, paused,
+// resumed or unlocked, by any process sharing the database. The returned
+// channel receives a value after one or more changes; changes that happen
+// while a value is pending are merged into it. It also receives a value
+// after the listener reconnects, since notifications may have been missed.
+// Listening stops and the channel is closed when ctx is done.
+func (db *DB) TaskChanges(ctx context.Context) (<-chan struct{}, error) {
+	listener := pq.NewListener(db.connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Task listener: %v\n", err)
+		}
+	})
+	if err := listener.Listen(taskChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		defer listener.Close()
+
+		// Check the connection now and then; a dead one is only noticed
+		// when it is used.
+		ping := time.NewTicker(90 * time.Second)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-listener.Notify:
+				// A nil notification means the connection was
+				// re-established.
+			case <-ping.C:
+				go listener.Ping()
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
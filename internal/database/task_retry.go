@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Retry settings of tasks that do not set their own.
+const (
+	DefaultMaxAttempts  = 5
+	DefaultRetryBackoff = time.Minute
+
+	maxRetryDelay = 24 * time.Hour
+)
+
+// RetryDelay returns how long the task waits before it is tried again
+// after failing failures times in a row, and whether it is dead instead.
+// A task is dead after MaxAttempts consecutive failures. The delay starts
+// at RetryBackoff and doubles with every failure, but never exceeds the
+// period of the task, or a day for tasks without a period.
+func (t *MonitoringTask) RetryDelay(failures int) (time.Duration, bool) {
+	maxAttempts := t.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	if failures >= maxAttempts {
+		return 0, true
+	}
+
+	delay := DefaultRetryBackoff
+	if t.RetryBackoff > 0 {
+		delay = time.Duration(t.RetryBackoff) * time.Second
+	}
+	ceiling := time.Duration(t.Period) * time.Minute
+	if ceiling <= 0 {
+		ceiling = maxRetryDelay
+	}
+	for i := 1; i < failures && delay < ceiling; i++ {
+		delay *= 2
+	}
+	if delay > ceiling {
+		delay = ceiling
+	}
+	return delay, false
+}
+
+func (db *DB) RecordTaskFailure(task *MonitoringTask, errText string) error {
+	return db.RecordTaskFailureContext(context.Background(), task, errText)
+}
+
+// RecordTaskFailureContext records a failed run and releases the lease held
+// by task.LeaseOwner. LastTimestamp is left alone: the task is retried
+// after RetryDelay, or marked dead when it has run out of attempts. The
+// failure count, retry time and dead flag of task are updated.
+func (db *DB) RecordTaskFailureContext(ctx context.Context, task *MonitoringTask, errText string) error {
+	failures := task.FailureCount + 1
+	delay, dead := task.RetryDelay(failures)
+
+	status := TaskStatusFailed
+	var delayMillis sql.NullInt64
+	if dead {
+		status = TaskStatusDead
+	} else {
+		delayMillis = sql.NullInt64{Int64: delay.Milliseconds(), Valid: true}
+	}
+
+	query := `
+		UPDATE monitoring."Tasks"
+		SET "LastStatus" = $3, "FailureCount" = $4, "IsDead" = $5,
+			"RetryAt" = now() + ($6 * INTERVAL '1 millisecond'), "LastError" = $7,
+			"NextRunAt" = now() + ($6 * INTERVAL '1 millisecond'),
+			"LeaseOwner" = NULL, "LeaseExpiresAt" = NULL
+		WHERE "ID" = $1 AND "LeaseOwner" IS NOT DISTINCT FROM $2
+		RETURNING "RetryAt"
+	`
+
+	var retryAt sql.NullTime
+	err := db.conn.QueryRowContext(ctx, query, task.ID, task.LeaseOwner, status, failures, dead, delayMillis, errText).Scan(&retryAt)
+	if err == sql.ErrNoRows {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+
+	task.LastStatus = &status
+	task.FailureCount = failures
+	task.IsDead = dead
+	task.RetryAt = nil
+	if retryAt.Valid {
+		task.RetryAt = &retryAt.Time
+	}
+	task.NextRunAt = task.RetryAt
+	task.LastError = &errText
+	task.LeaseOwner = nil
+	task.LeaseExpiresAt = nil
+	return nil
+}
+
+func (db *DB) RequeueMonitoringTask(taskID int64) (*MonitoringTask, error) {
+	return db.RequeueMonitoringTaskContext(context.Background(), taskID)
+}
+
+// RequeueMonitoringTaskContext brings a dead or failing task back: the
+// failure count is reset and the task is due right away, unless it is
+// still waiting to be unlocked. The last error is kept until the next run
+// succeeds.
+func (db *DB) RequeueMonitoringTaskContext(ctx context.Context, taskID int64) (*MonitoringTask, error) {
+	query := `
+		UPDATE monitoring."Tasks"
+		SET "IsDead" = false, "FailureCount" = 0, "RetryAt" = NULL,
+			"NextRunAt" = CASE WHEN "IsUnlocked" = false THEN NULL ELSE now() END
+		WHERE "ID" = $1
+		RETURNING ` + taskColumns
+
+	task, err := scanTask(db.conn.QueryRowContext(ctx, query, taskID))
+	if err == sql.ErrNoRows {
+		return nil, ErrTaskNotFound
+	}
+	return task, err
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		task      MonitoringTask
+		failures  int
+		wantDelay time.Duration
+		wantDead  bool
+	}{
+		{"default backoff", MonitoringTask{Period: 60}, 1, time.Minute, false},
+		{"default backoff doubles", MonitoringTask{Period: 60}, 3, 4 * time.Minute, false},
+		{"default backoff last attempt", MonitoringTask{Period: 60}, 4, 8 * time.Minute, false},
+		{"default attempts", MonitoringTask{Period: 60}, DefaultMaxAttempts, 0, true},
+		{"backoff", MonitoringTask{Period: 60, RetryBackoff: 10}, 1, 10 * time.Second, false},
+		{"backoff doubles", MonitoringTask{Period: 60, RetryBackoff: 10}, 2, 20 * time.Second, false},
+		{"capped at the period", MonitoringTask{Period: 5, RetryBackoff: 120}, 3, 5 * time.Minute, false},
+		{"backoff above the period", MonitoringTask{Period: 1, RetryBackoff: 600}, 1, time.Minute, false},
+		{"capped at a day without a period", MonitoringTask{RetryBackoff: 3600, MaxAttempts: 10}, 9, 24 * time.Hour, false},
+		{"no period below a day", MonitoringTask{RetryBackoff: 3600, MaxAttempts: 10}, 4, 8 * time.Hour, false},
+		{"before max attempts", MonitoringTask{Period: 60, MaxAttempts: 3}, 2, 2 * time.Minute, false},
+		{"at max attempts", MonitoringTask{Period: 60, MaxAttempts: 3}, 3, 0, true},
+		{"past max attempts", MonitoringTask{Period: 60, MaxAttempts: 3}, 7, 0, true},
+		{"single attempt", MonitoringTask{Period: 60, MaxAttempts: 1}, 1, 0, true},
+		{"many failures do not overflow", MonitoringTask{Period: 60, MaxAttempts: 1000}, 999, time.Hour, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, dead := tt.task.RetryDelay(tt.failures)
+			if delay != tt.wantDelay || dead != tt.wantDead {
+				t.Errorf("RetryDelay(%d) = %v, %v, want %v, %v", tt.failures, delay, dead, tt.wantDelay, tt.wantDead)
+			}
+		})
+	}
+}
+
+func TestRetryDelayDeadAfterMaxAttempts(t *testing.T) {
+	for _, maxAttempts := range []int{0, 1, 3, 5, 8} {
+		task := MonitoringTask{Period: 60, MaxAttempts: maxAttempts}
+		want := maxAttempts
+		if want == 0 {
+			want = DefaultMaxAttempts
+		}
+
+		var previous time.Duration
+		for failures := 1; failures < want; failures++ {
+			delay, dead := task.RetryDelay(failures)
+			if dead {
+				t.Fatalf("MaxAttempts %d: dead after %d failures", maxAttempts, failures)
+			}
+			if delay < previous {
+				t.Errorf("MaxAttempts %d: delay %v after %d failures is shorter than %v", maxAttempts, delay, failures, previous)
+			}
+			previous = delay
+		}
+		if _, dead := task.RetryDelay(want); !dead {
+			t.Errorf("MaxAttempts %d: not dead after %d failures", maxAttempts, want)
+		}
+	}
+}
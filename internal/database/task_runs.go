@@ -0,0 +1,236 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// RunStatus is the outcome of a task run.
+type RunStatus string
+
+const (
+	RunSucceeded RunStatus = "succeeded"
+	// RunPartial means the run stored its data but steps failed that the
+	// StepPolicy of the task does not require.
+	RunPartial     RunStatus = "partial"
+	RunFailed      RunStatus = "failed"
+	RunInterrupted RunStatus = "interrupted"
+)
+
+// StepStatus is the outcome of one step of a task run.
+type StepStatus string
+
+const (
+	StepOK StepStatus = "ok"
+	// StepPartial means some of the requests of the step failed.
+	StepPartial StepStatus = "partial"
+	StepFailed  StepStatus = "failed"
+)
+
+// TaskRunStep records one step of a run, such as "friends" or
+// "post.likes". Steps made of many requests, like the likes of every post,
+// count the requests that failed and keep the first error with its class,
+// such as "retryable" or "target-fatal".
+type TaskRunStep struct {
+	Name     string     `json:"name"`
+	Status   StepStatus `json:"status"`
+	Items    int        `json:"items"`
+	Requests int        `json:"requests"`
+	Failed   int        `json:"failed,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Class    string     `json:"class,omitempty"`
+}
+
+// TaskRun is the ledger entry of one run of a monitoring task. It is
+// committed together with the data the run collected.
+type TaskRun struct {
+	ID         int64
+	TaskID     int64
+	Worker     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Status     RunStatus
+	AccountID  *int64
+	Proxy      *string
+	APICalls   int
+	// Filled in from the BatchStats when the run is committed.
+	Objects         int
+	ObjectsWritten  int
+	Relations       int
+	RelationChanges int
+	Steps           []TaskRunStep
+	Error           string
+}
+
+// SetStats copies the counts of a stored batch into the run.
+func (r *TaskRun) SetStats(stats BatchStats) {
+	r.Objects = stats.Objects
+	r.ObjectsWritten = stats.Written
+	r.Relations = stats.Relations
+	r.RelationChanges = stats.Changes
+}
+
+const (
+	defaultRunLimit = 50
+	maxRunLimit     = 1000
+)
+
+func (db *DB) CommitTaskRun(run *TaskRun, batch *Batch) error {
+	return db.CommitTaskRunContext(context.Background(), run, batch)
+}
+
+// CommitTaskRunContext stores batch and records run in one transaction, so
+// that a run is in the ledger exactly when its data is stored. batch may be
+// nil to record a run that stored nothing. run.ID and the counts of run
+// are set on success.
+//
+// Nothing is stored and ErrLeaseLost is returned unless run.Worker still
+// holds the lease on the task: a worker whose lease expired must not store
+// data next to the worker that took the task over.
+func (db *DB) CommitTaskRunContext(ctx context.Context, run *TaskRun, batch *Batch) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The row lock keeps the task from being claimed until the commit.
+	var held int
+	err = tx.QueryRowContext(ctx, `
+		SELECT 1 FROM monitoring."Tasks"
+		WHERE "ID" = $1 AND "LeaseOwner" = $2
+		FOR UPDATE
+	`, run.TaskID, run.Worker).Scan(&held)
+	if err == sql.ErrNoRows {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+
+	if batch != nil {
+		stats, err := writeBatch(ctx, tx, batch)
+		if err != nil {
+			return err
+		}
+		run.SetStats(stats)
+	}
+
+	steps, err := json.Marshal(nonNilSteps(run.Steps))
+	if err != nil {
+		return err
+	}
+
+	var errorText sql.NullString
+	if run.Error != "" {
+		errorText = sql.NullString{String: run.Error, Valid: true}
+	}
+
+	query := `
+		INSERT INTO monitoring."TaskRuns"
+		("TaskID", "Worker", "StartedAt", "FinishedAt", "Status", "AccountID", "Proxy", "APICalls",
+		 "Objects", "ObjectsWritten", "Relations", "RelationChanges", "Steps", "Error")
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING "ID"
+	`
+	err = tx.QueryRowContext(ctx, query,
+		run.TaskID,
+		run.Worker,
+		run.StartedAt,
+		run.FinishedAt,
+		run.Status,
+		run.AccountID,
+		run.Proxy,
+		run.APICalls,
+		run.Objects,
+		run.ObjectsWritten,
+		run.Relations,
+		run.RelationChanges,
+		steps,
+		errorText,
+	).Scan(&run.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) ListTaskRuns(taskID int64, limit int) ([]TaskRun, error) {
+	return db.ListTaskRunsContext(context.Background(), taskID, limit)
+}
+
+// ListTaskRunsContext returns the latest runs of a task, newest first. A
+// limit of zero or less returns the default number of runs.
+func (db *DB) ListTaskRunsContext(ctx context.Context, taskID int64, limit int) ([]TaskRun, error) {
+	if limit <= 0 {
+		limit = defaultRunLimit
+	}
+	if limit > maxRunLimit {
+		limit = maxRunLimit
+	}
+
+	query := `
+		SELECT "ID", "TaskID", "Worker", "StartedAt", "FinishedAt", "Status", "AccountID", "Proxy", "APICalls",
+			"Objects", "ObjectsWritten", "Relations", "RelationChanges", "Steps", "Error"
+		FROM monitoring."TaskRuns"
+		WHERE "TaskID" = $1
+		ORDER BY "StartedAt" DESC, "ID" DESC
+		LIMIT $2
+	`
+	rows, err := db.conn.QueryContext(ctx, query, taskID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []TaskRun
+	for rows.Next() {
+		var run TaskRun
+		var accountID sql.NullInt64
+		var proxy, errorText sql.NullString
+		var steps []byte
+		err := rows.Scan(
+			&run.ID,
+			&run.TaskID,
+			&run.Worker,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.Status,
+			&accountID,
+			&proxy,
+			&run.APICalls,
+			&run.Objects,
+			&run.ObjectsWritten,
+			&run.Relations,
+			&run.RelationChanges,
+			&steps,
+			&errorText,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if accountID.Valid {
+			run.AccountID = &accountID.Int64
+		}
+		if proxy.Valid {
+			run.Proxy = &proxy.String
+		}
+		run.Error = errorText.String
+		if err := json.Unmarshal(steps, &run.Steps); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func nonNilSteps(steps []TaskRunStep) []TaskRunStep {
+	if steps == nil {
+		return []TaskRunStep{}
+	}
+	return steps
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"time"
+
+	"github.com/Nakray/sn/internal/schedule"
+)
+
+// ParseTaskSchedule returns the cron schedule of a task, or nil if it has
+// none. Errors are *ValidationError.
+func ParseTaskSchedule(task *MonitoringTask) (*schedule.Schedule, error) {
+	if task.Schedule == nil || *task.Schedule == "" {
+		if task.Timezone != nil && *task.Timezone != "" {
+			return nil, &ValidationError{Field: "Timezone", Message: "is only used with a Schedule"}
+		}
+		return nil, nil
+	}
+
+	timezone := ""
+	if task.Timezone != nil {
+		timezone = *task.Timezone
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return nil, &ValidationError{Field: "Timezone", Message: "unknown time zone " + timezone}
+		}
+	}
+
+	sched, err := schedule.Parse(*task.Schedule, timezone)
+	if err != nil {
+		return nil, &ValidationError{Field: "Schedule", Message: err.Error()}
+	}
+	return sched, nil
+}
+
+// validateTaskSchedule checks that a task runs on exactly one of Period
+// and Schedule, or only once at RunAt.
+func validateTaskSchedule(task *MonitoringTask) error {
+	if task.Period < 0 {
+		return &ValidationError{Field: "Period", Message: "must be a positive number of minutes"}
+	}
+	sched, err := ParseTaskSchedule(task)
+	if err != nil {
+		return err
+	}
+	switch {
+	case sched != nil && task.Period > 0:
+		return &ValidationError{Field: "Schedule", Message: "must not be set together with Period"}
+	case sched == nil && task.Period == 0 && task.RunAt == nil:
+		return &ValidationError{Field: "Period", Message: "must be a positive number of minutes unless Schedule or RunAt is set"}
+	}
+	return nil
+}
+
+// NextRun returns when a task that last ran at last is due again, given
+// the current time now, or nil if it is not. A zero last means the task
+// has never run.
+//
+// RunAt is honored until the task has run after it. After that the task
+// follows its Schedule or Period, and a task with neither is done. Tasks
+// that wait to be unlocked have no next run of their own.
+func (t *MonitoringTask) NextRun(last, now time.Time) *time.Time {
+	if t.IsUnlockable {
+		return nil
+	}
+	if t.RunAt != nil && t.RunAt.After(last) {
+		runAt := *t.RunAt
+		return &runAt
+	}
+
+	sched, err := ParseTaskSchedule(t)
+	if err != nil {
+		return nil
+	}
+
+	var next time.Time
+	switch {
+	case sched != nil:
+		next = sched.Next(now)
+	case t.Period > 0 && last.IsZero():
+		next = now
+	case t.Period > 0:
+		next = last.Add(time.Duration(t.Period) * time.Minute)
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return &next
+}
@@ -0,0 +1,440 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTaskNotFound is returned when no task has the requested ID.
+var ErrTaskNotFound = errors.New("task not found")
+
+// ValidationError reports an invalid task field.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Message)
+}
+
+// TaskFilter narrows down ListMonitoringTasks. Zero values match all tasks.
+type TaskFilter struct {
+	SocialNetworkType string
+	OwnerType         OwnerType
+	OwnerID           int64
+	Paused            *bool
+	Dead              *bool
+	Limit             int
+	Offset            int
+}
+
+// TaskUpdate holds the fields of a partial task update. Nil fields are left
+// unchanged.
+type TaskUpdate struct {
+	Period         *int
+	Filters        *map[string]interface{}
+	FilterLimits   *map[string]interface{}
+	StepPolicy     *map[string]interface{}
+	AccountGroupID *int
+	UnlockIDs      *[]int64
+	MaxAttempts    *int
+	RetryBackoff   *int
+	// An empty Schedule or Timezone clears it, as does a zero RunAt.
+	Schedule *string
+	Timezone *string
+	RunAt    *time.Time
+}
+
+const (
+	defaultTaskListLimit = 100
+	maxTaskListLimit     = 1000
+)
+
+// Page returns the effective limit and offset of the filter.
+func (f TaskFilter) Page() (limit, offset int) {
+	limit = f.Limit
+	if limit <= 0 {
+		limit = defaultTaskListLimit
+	}
+	if limit > maxTaskListLimit {
+		limit = maxTaskListLimit
+	}
+	offset = f.Offset
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+func (db *DB) ListMonitoringTasks(filter TaskFilter) ([]MonitoringTask, error) {
+	return db.ListMonitoringTasksContext(context.Background(), filter)
+}
+
+func (db *DB) ListMonitoringTasksContext(ctx context.Context, filter TaskFilter) ([]MonitoringTask, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+	}
+
+	if filter.SocialNetworkType != "" {
+		addCondition(`"SocialNetworkType" = ?`, filter.SocialNetworkType)
+	}
+	if filter.OwnerType != "" {
+		addCondition(`"OwnerType" = ?`, filter.OwnerType)
+	}
+	if filter.OwnerID != 0 {
+		addCondition(`"OwnerID" = ?`, filter.OwnerID)
+	}
+	if filter.Paused != nil {
+		addCondition(`"IsPaused" = ?`, *filter.Paused)
+	}
+	if filter.Dead != nil {
+		addCondition(`"IsDead" = ?`, *filter.Dead)
+	}
+
+	limit, offset := filter.Page()
+
+	query := `SELECT ` + taskColumns + ` FROM monitoring."Tasks"`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(` ORDER BY "ID" DESC LIMIT %d OFFSET %d`, limit, offset)
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []MonitoringTask{}
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, *task)
+	}
+
+	return tasks, rows.Err()
+}
+
+func (db *DB) GetMonitoringTask(taskID int64) (*MonitoringTask, error) {
+	return db.GetMonitoringTaskContext(context.Background(), taskID)
+}
+
+func (db *DB) GetMonitoringTaskContext(ctx context.Context, taskID int64) (*MonitoringTask, error) {
+	query := `SELECT ` + taskColumns + ` FROM monitoring."Tasks" WHERE "ID" = $1`
+
+	task, err := scanTask(db.conn.QueryRowContext(ctx, query, taskID))
+	if err == sql.ErrNoRows {
+		return nil, ErrTaskNotFound
+	}
+	return task, err
+}
+
+// ValidateTask checks the fields of a task that do not need the database.
+func ValidateTask(task *MonitoringTask) error {
+	if task.SocialNetworkType == "" {
+		return &ValidationError{Field: "SocialNetworkType", Message: "must not be empty"}
+	}
+	switch task.OwnerType {
+	case OwnerTypeUser, OwnerTypeGroup:
+	default:
+		return &ValidationError{Field: "OwnerType", Message: fmt.Sprintf("must be %q or %q", OwnerTypeUser, OwnerTypeGroup)}
+	}
+	if task.OwnerID <= 0 {
+		return &ValidationError{Field: "OwnerID", Message: "must be positive"}
+	}
+	if err := validateTaskSchedule(task); err != nil {
+		return err
+	}
+	if task.AccountGroupID < 0 {
+		return &ValidationError{Field: "AccountGroupID", Message: "must not be negative"}
+	}
+	if task.MaxAttempts < 0 {
+		return &ValidationError{Field: "MaxAttempts", Message: "must not be negative"}
+	}
+	if task.RetryBackoff < 0 {
+		return &ValidationError{Field: "RetryBackoff", Message: "must not be a negative number of seconds"}
+	}
+	if _, err := ParseTaskFilters(task.Filters, task.FilterLimits); err != nil {
+		return err
+	}
+	if _, err := ParseStepPolicy(task.StepPolicy); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateAccountGroup checks that the account group of a task has at
+// least one account of the task's social network.
+func (db *DB) validateAccountGroup(ctx context.Context, socialNetworkType string, groupID int) error {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM public."Accounts"
+			WHERE "SocialNetworkType" = $1 AND "GroupID" = $2
+		)
+	`
+
+	var exists bool
+	if err := db.conn.QueryRowContext(ctx, query, socialNetworkType, groupID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return &ValidationError{
+			Field:   "AccountGroupID",
+			Message: fmt.Sprintf("no %s accounts in group %d", socialNetworkType, groupID),
+		}
+	}
+	return nil
+}
+
+func (db *DB) CreateMonitoringTask(task *MonitoringTask) error {
+	return db.CreateMonitoringTaskContext(context.Background(), task)
+}
+
+// CreateMonitoringTaskContext validates and inserts task, filling in its ID
+// and the defaults set by the database.
+func (db *DB) CreateMonitoringTaskContext(ctx context.Context, task *MonitoringTask) error {
+	if err := ValidateTask(task); err != nil {
+		return err
+	}
+	if err := db.validateAccountGroup(ctx, task.SocialNetworkType, task.AccountGroupID); err != nil {
+		return err
+	}
+
+	filtersJSON, err := json.Marshal(task.Filters)
+	if err != nil {
+		return err
+	}
+	filterLimitsJSON, err := json.Marshal(task.FilterLimits)
+	if err != nil {
+		return err
+	}
+	stepPolicyJSON, err := json.Marshal(task.StepPolicy)
+	if err != nil {
+		return err
+	}
+	unlockIDsJSON, err := json.Marshal(task.UnlockIDs)
+	if err != nil {
+		return err
+	}
+
+	var isUnlocked *bool
+	if task.IsUnlockable {
+		locked := false
+		isUnlocked = &locked
+	}
+
+	query := `
+		INSERT INTO monitoring."Tasks"
+		("SocialNetworkType", "OwnerType", "OwnerID", "Period", "Filters", "FilterLimits",
+		 "StepPolicy", "AccountGroupID", "IsUnlocked", "UnlockIDs", "IsPaused",
+		 "MaxAttempts", "RetryBackoff", "Schedule", "Timezone", "RunAt", "NextRunAt")
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		RETURNING ` + taskColumns
+
+	created, err := scanTask(db.conn.QueryRowContext(ctx, query,
+		task.SocialNetworkType,
+		task.OwnerType,
+		task.OwnerID,
+		task.Period,
+		filtersJSON,
+		filterLimitsJSON,
+		stepPolicyJSON,
+		task.AccountGroupID,
+		isUnlocked,
+		unlockIDsJSON,
+		task.IsPaused,
+		task.MaxAttempts,
+		task.RetryBackoff,
+		nilIfEmpty(task.Schedule),
+		nilIfEmpty(task.Timezone),
+		task.RunAt,
+		task.NextRun(time.Time{}, time.Now()),
+	))
+	if err != nil {
+		return err
+	}
+
+	*task = *created
+	return nil
+}
+
+func (db *DB) UpdateMonitoringTask(taskID int64, update TaskUpdate) (*MonitoringTask, error) {
+	return db.UpdateMonitoringTaskContext(context.Background(), taskID, update)
+}
+
+// UpdateMonitoringTaskContext applies the non-nil fields of update and
+// returns the updated task.
+func (db *DB) UpdateMonitoringTaskContext(ctx context.Context, taskID int64, update TaskUpdate) (*MonitoringTask, error) {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The row stays locked until the update commits, so concurrent updates
+	// do not validate against or overwrite each other's changes.
+	task, err := scanTask(tx.QueryRowContext(ctx, `SELECT `+taskColumns+` FROM monitoring."Tasks" WHERE "ID" = $1 FOR UPDATE`, taskID))
+	if err == sql.ErrNoRows {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sets []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf(`"%s" = $%d`, column, len(args)))
+	}
+
+	if update.Period != nil {
+		task.Period = *update.Period
+		set("Period", *update.Period)
+	}
+	if update.AccountGroupID != nil {
+		task.AccountGroupID = *update.AccountGroupID
+		set("AccountGroupID", *update.AccountGroupID)
+	}
+	if update.Filters != nil {
+		task.Filters = *update.Filters
+		filtersJSON, err := json.Marshal(*update.Filters)
+		if err != nil {
+			return nil, err
+		}
+		set("Filters", filtersJSON)
+	}
+	if update.FilterLimits != nil {
+		task.FilterLimits = *update.FilterLimits
+		filterLimitsJSON, err := json.Marshal(*update.FilterLimits)
+		if err != nil {
+			return nil, err
+		}
+		set("FilterLimits", filterLimitsJSON)
+	}
+	if update.StepPolicy != nil {
+		task.StepPolicy = *update.StepPolicy
+		stepPolicyJSON, err := json.Marshal(*update.StepPolicy)
+		if err != nil {
+			return nil, err
+		}
+		set("StepPolicy", stepPolicyJSON)
+	}
+	if update.UnlockIDs != nil {
+		unlockIDsJSON, err := json.Marshal(*update.UnlockIDs)
+		if err != nil {
+			return nil, err
+		}
+		set("UnlockIDs", unlockIDsJSON)
+	}
+	if update.Schedule != nil {
+		task.Schedule = nilIfEmpty(update.Schedule)
+		set("Schedule", task.Schedule)
+	}
+	if update.Timezone != nil {
+		task.Timezone = nilIfEmpty(update.Timezone)
+		set("Timezone", task.Timezone)
+	}
+	if update.RunAt != nil {
+		task.RunAt = update.RunAt
+		if update.RunAt.IsZero() {
+			task.RunAt = nil
+		}
+		set("RunAt", task.RunAt)
+	}
+	// Tasks waiting to be unlocked keep their next run.
+	rescheduled := update.Period != nil || update.Schedule != nil || update.Timezone != nil || update.RunAt != nil
+	if rescheduled && !task.IsUnlockable {
+		task.NextRunAt = task.NextRun(task.LastTimestamp, time.Now())
+		set("NextRunAt", task.NextRunAt)
+	}
+	if update.MaxAttempts != nil {
+		task.MaxAttempts = *update.MaxAttempts
+		set("MaxAttempts", *update.MaxAttempts)
+	}
+	if update.RetryBackoff != nil {
+		task.RetryBackoff = *update.RetryBackoff
+		set("RetryBackoff", *update.RetryBackoff)
+	}
+
+	if len(sets) == 0 {
+		return task, nil
+	}
+
+	if err := ValidateTask(task); err != nil {
+		return nil, err
+	}
+	if update.AccountGroupID != nil {
+		if err := db.validateAccountGroup(ctx, task.SocialNetworkType, task.AccountGroupID); err != nil {
+			return nil, err
+		}
+	}
+
+	args = append(args, taskID)
+	query := fmt.Sprintf(`UPDATE monitoring."Tasks" SET %s WHERE "ID" = $%d RETURNING `,
+		strings.Join(sets, ", "), len(args)) + taskColumns
+
+	updated, err := scanTask(tx.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (db *DB) DeleteMonitoringTask(taskID int64) error {
+	return db.DeleteMonitoringTaskContext(context.Background(), taskID)
+}
+
+func (db *DB) DeleteMonitoringTaskContext(ctx context.Context, taskID int64) error {
+	query := `DELETE FROM monitoring."Tasks" WHERE "ID" = $1`
+
+	res, err := db.conn.ExecContext(ctx, query, taskID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+func (db *DB) SetMonitoringTaskPaused(taskID int64, paused bool) (*MonitoringTask, error) {
+	return db.SetMonitoringTaskPausedContext(context.Background(), taskID, paused)
+}
+
+// SetMonitoringTaskPausedContext pauses or resumes a task. A paused task is
+// not claimed by workers; a run that is already going finishes normally.
+func (db *DB) SetMonitoringTaskPausedContext(ctx context.Context, taskID int64, paused bool) (*MonitoringTask, error) {
+	query := `UPDATE monitoring."Tasks" SET "IsPaused" = $2 WHERE "ID" = $1 RETURNING ` + taskColumns
+
+	task, err := scanTask(db.conn.QueryRowContext(ctx, query, taskID, paused))
+	if err == sql.ErrNoRows {
+		return nil, ErrTaskNotFound
+	}
+	return task, err
+}
+
+func nilIfEmpty(s *string) *string {
+	if s == nil || *s == "" {
+		return nil
+	}
+	return s
+}
@@ -1,8 +1,13 @@
 package monitoring
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,20 +16,60 @@ import (
 	"github.com/Nakray/sn/internal/vk"
 )
 
+const (
+	defaultLeaseDuration = 5 * time.Minute
+	// defaultPollInterval bounds how long the dispatcher sleeps without
+	// being woken up, in case a notification was lost.
+	defaultPollInterval = time.Hour
+	// minDispatchWait keeps the dispatcher from spinning on a due task it
+	// cannot claim yet, such as one being claimed by another process.
+	minDispatchWait = time.Second
+)
+
 type Service struct {
-	db      *database.DB
-	config  *config.Config
-	stopCh  chan struct{}
-	wg      sync.WaitGroup
-	running bool
-	mu      sync.Mutex
+	db       database.Store
+	config   *config.Config
+	limiters *vk.LimiterRegistry
+	retry    vk.RetryPolicy
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	running  bool
+	mu       sync.Mutex
+
+	// Idle workers send their ID on idle; the dispatcher hands them a
+	// claimed task on their job queue.
+	idle chan int
+	jobs []chan database.MonitoringTask
 }
 
-func NewService(db *database.DB, cfg *config.Config) *Service {
+func NewService(db database.Store, cfg *config.Config) *Service {
+	limits := vk.RateLimits{
+		RequestsPerSecond: cfg.VK.RateLimit.RequestsPerSecond,
+		Burst:             cfg.VK.RateLimit.Burst,
+		Methods:           cfg.VK.RateLimit.Methods,
+		PerProxy:          cfg.VK.RateLimit.PerProxy,
+	}
+
+	retry := vk.DefaultRetryPolicy
+	if cfg.VK.Retry.MaxAttempts > 0 {
+		retry.MaxAttempts = cfg.VK.Retry.MaxAttempts
+	}
+	if cfg.VK.Retry.BaseDelayMS > 0 {
+		retry.BaseDelay = time.Duration(cfg.VK.Retry.BaseDelayMS) * time.Millisecond
+	}
+	if cfg.VK.Retry.MaxDelayMS > 0 {
+		retry.MaxDelay = time.Duration(cfg.VK.Retry.MaxDelayMS) * time.Millisecond
+	}
+	if cfg.VK.Retry.Jitter > 0 {
+		retry.Jitter = cfg.VK.Retry.Jitter
+	}
+
 	return &Service{
-		db:     db,
-		config: cfg,
-		stopCh: make(chan struct{}),
+		db:       db,
+		config:   cfg,
+		limiters: vk.NewLimiterRegistry(limits),
+		retry:    retry,
 	}
 }
 
@@ -35,85 +80,361 @@ func (s *Service) Start() {
 		return
 	}
 	s.running = true
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.mu.Unlock()
 
+	workers := s.config.Monitoring.Workers
+	s.idle = make(chan int, workers)
+	s.jobs = make([]chan database.MonitoringTask, workers)
+
 	// Start worker pool
-	for i := 0; i < s.config.Monitoring.Workers; i++ {
+	for i := 0; i < workers; i++ {
+		s.jobs[i] = make(chan database.MonitoringTask, 1)
 		s.wg.Add(1)
 		go s.worker(i)
 	}
+
+	s.wg.Add(1)
+	go s.dispatch()
 }
 
-func (s *Service) Stop() {
+// Stop cancels running tasks and waits for the workers to record them as
+// interrupted. It gives up waiting when ctx is done.
+func (s *Service) Stop(ctx context.Context) error {
 	s.mu.Lock()
 	if !s.running {
 		s.mu.Unlock()
-		return
+		return nil
 	}
 	s.running = false
 	s.mu.Unlock()
 
-	close(s.stopCh)
-	s.wg.Wait()
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (s *Service) worker(workerID int) {
+func (s *Service) leaseDuration() time.Duration {
+	if s.config.Monitoring.LeaseSeconds > 0 {
+		return time.Duration(s.config.Monitoring.LeaseSeconds) * time.Second
+	}
+	return defaultLeaseDuration
+}
+
+// leaseOwner identifies a worker across all processes sharing the database.
+func leaseOwner(workerID int) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d:%d", host, os.Getpid(), workerID)
+}
+
+func (s *Service) pollInterval() time.Duration {
+	if s.config.Monitoring.IntervalMinutes > 0 {
+		return time.Duration(s.config.Monitoring.IntervalMinutes) * time.Minute
+	}
+	return defaultPollInterval
+}
+
+// dispatch claims due tasks for idle workers. In between it sleeps until
+// the next task is due, a task changes or a worker becomes idle.
+func (s *Service) dispatch() {
 	defer s.wg.Done()
 
-	ticker := time.NewTicker(time.Duration(s.config.Monitoring.IntervalMinutes) * time.Minute)
-	defer ticker.Stop()
+	changes, err := s.db.TaskChanges(s.ctx)
+	if err != nil {
+		// Without notifications new tasks wait for the poll interval.
+		log.Printf("Dispatcher: not listening for task changes: %v\n", err)
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
-	log.Printf("Monitoring worker %d started\n", workerID)
+	var idle []int
+	for {
+		idle = s.assignTasks(idle)
+
+		wait := s.pollInterval()
+		if len(idle) > 0 {
+			next, err := s.db.NextTaskRunContext(s.ctx)
+			if err != nil && s.ctx.Err() == nil {
+				log.Printf("Dispatcher: failed to get next run time: %v\n", err)
+			}
+			if next != nil {
+				if until := time.Until(*next); until < wait {
+					wait = max(until, minDispatchWait)
+				}
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-s.ctx.Done():
+			log.Printf("Dispatcher stopped\n")
+			return
+		case workerID := <-s.idle:
+			idle = append(idle, workerID)
+		case _, ok := <-changes:
+			if !ok {
+				changes = nil
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// assignTasks claims a due task for each idle worker while there are any
+// and returns the workers that are still idle.
+func (s *Service) assignTasks(idle []int) []int {
+	for len(idle) > 0 && s.ctx.Err() == nil {
+		workerID := idle[len(idle)-1]
+		tasks, err := s.db.ClaimDueMonitoringTasksContext(s.ctx, leaseOwner(workerID), s.leaseDuration(), 1)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("Dispatcher: failed to claim due tasks: %v\n", err)
+			}
+			break
+		}
+		if len(tasks) == 0 {
+			break
+		}
+
+		idle = idle[:len(idle)-1]
+		s.jobs[workerID] <- tasks[0]
+	}
+	return idle
+}
+
+func (s *Service) worker(workerID int) {
+	defer s.wg.Done()
 
-	// Run immediately on start
-	s.processTasks(workerID)
+	owner := leaseOwner(workerID)
+	log.Printf("Monitoring worker %d started as %s\n", workerID, owner)
 
 	for {
 		select {
-		case <-s.stopCh:
+		case <-s.ctx.Done():
+			log.Printf("Monitoring worker %d stopped\n", workerID)
+			return
+		case s.idle <- workerID:
+		}
+
+		select {
+		case task := <-s.jobs[workerID]:
+			s.runTask(s.ctx, workerID, owner, task)
+		case <-s.ctx.Done():
+			// A task claimed right before shutdown is released as
+			// interrupted.
+			select {
+			case task := <-s.jobs[workerID]:
+				s.runTask(s.ctx, workerID, owner, task)
+			default:
+			}
 			log.Printf("Monitoring worker %d stopped\n", workerID)
 			return
-		case <-ticker.C:
-			s.processTasks(workerID)
 		}
 	}
 }
 
-func (s *Service) processTasks(workerID int) {
-	tasks, err := s.db.GetDueMonitoringTasks()
-	if err != nil {
-		log.Printf("Worker %d: failed to get due tasks: %v\n", workerID, err)
+func (s *Service) runTask(ctx context.Context, workerID int, owner string, task database.MonitoringTask) {
+	// Bookkeeping has to happen even when ctx is cancelled by shutdown.
+	bctx := context.WithoutCancel(ctx)
+
+	// The task is cancelled when its lease is lost, since another worker
+	// may already be running it.
+	tctx, cancelTask := context.WithCancelCause(ctx)
+	defer cancelTask(nil)
+	stopRenew := s.renewLease(bctx, workerID, owner, task, cancelTask)
+
+	run := &database.TaskRun{
+		TaskID:    task.ID,
+		Worker:    owner,
+		StartedAt: time.Now(),
+	}
+	batch, err := s.processTask(tctx, task, run)
+	stopRenew()
+
+	if errors.Is(context.Cause(tctx), database.ErrLeaseLost) {
+		log.Printf("Worker %d: lost the lease on task %d, dropping the run\n", workerID, task.ID)
 		return
 	}
 
-	if len(tasks) == 0 {
+	interrupted := err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err())
+	run.FinishedAt = time.Now()
+	switch {
+	case interrupted:
+		run.Status = database.RunInterrupted
+	case err != nil:
+		run.Status = database.RunFailed
+	default:
+		policy, perr := database.ParseStepPolicy(task.StepPolicy)
+		if perr != nil {
+			log.Printf("Worker %d: task %d: %v, using the default step policy\n", workerID, task.ID, perr)
+			policy = database.DefaultStepPolicy
+		}
+		var failed []string
+		run.Status, failed = policy.Outcome(run.Steps)
+		if len(failed) > 0 {
+			run.Error = "failed steps: " + strings.Join(failed, ", ")
+		}
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	// The run is recorded together with the data it collected. If that
+	// fails, the run is recorded alone as failed, unless the lease was lost.
+	cerr := s.db.CommitTaskRunContext(bctx, run, batch)
+	switch {
+	case errors.Is(cerr, database.ErrLeaseLost):
+		log.Printf("Worker %d: lost the lease on task %d, dropping the run\n", workerID, task.ID)
 		return
+	case cerr != nil:
+		log.Printf("Worker %d: failed to store data of task %d: %v\n", workerID, task.ID, cerr)
+		if err == nil {
+			err = fmt.Errorf("store collected data: %w", cerr)
+			run.Status = database.RunFailed
+			run.Error = err.Error()
+		}
+		if rerr := s.db.CommitTaskRunContext(bctx, run, nil); rerr != nil {
+			log.Printf("Worker %d: failed to record run of task %d: %v\n", workerID, task.ID, rerr)
+		}
+	default:
+		log.Printf("Worker %d: task %d run %d stored %d objects (%d written), %d relations (%d changes) after %d API calls\n",
+			workerID, task.ID, run.ID, run.Objects, run.ObjectsWritten, run.Relations, run.RelationChanges, run.APICalls)
 	}
 
-	log.Printf("Worker %d: processing %d tasks\n", workerID, len(tasks))
+	// A run failed by the account it used says nothing about the task, so
+	// it does not count towards MaxAttempts. The account is blocked and the
+	// task is run again with another one.
+	accountFailed := run.Status == database.RunFailed && accountFatal(err, run.Steps)
+	if interrupted || accountFailed {
+		if accountFailed {
+			log.Printf("Worker %d: task %d failed on its account: %s\n", workerID, task.ID, run.Error)
+		} else {
+			log.Printf("Worker %d: task %d interrupted\n", workerID, task.ID)
+		}
+		if err := s.db.RecordTaskInterruptedContext(bctx, &task); err != nil {
+			log.Printf("Worker %d: failed to record task %d as interrupted: %v\n", workerID, task.ID, err)
+		}
+		return
+	}
 
-	for _, task := range tasks {
-		success := true
-		if err := s.processTask(task); err != nil {
-			log.Printf("Worker %d: task %d failed: %v\n", workerID, task.ID, err)
-			success = false
+	if run.Status == database.RunFailed {
+		// A failed run does not advance LastTimestamp: the task is retried
+		// with backoff until it runs out of attempts.
+		if err := s.db.RecordTaskFailureContext(bctx, &task, run.Error); err != nil {
+			log.Printf("Worker %d: failed to record failure of task %d: %v\n", workerID, task.ID, err)
+		} else if task.IsDead {
+			log.Printf("Worker %d: task %d is dead after %d failures: %s\n", workerID, task.ID, task.FailureCount, run.Error)
 		} else {
-			log.Printf("Worker %d: task %d completed successfully\n", workerID, task.ID)
+			log.Printf("Worker %d: task %d failed (%d in a row), retrying at %s: %s\n",
+				workerID, task.ID, task.FailureCount, task.RetryAt.Format(time.RFC3339), run.Error)
+		}
+		return
+	}
+
+	status := database.TaskStatusSuccess
+	if run.Status == database.RunPartial {
+		log.Printf("Worker %d: task %d completed partially: %s\n", workerID, task.ID, run.Error)
+		status = database.TaskStatusPartial
+	} else {
+		log.Printf("Worker %d: task %d completed successfully\n", workerID, task.ID)
+	}
+
+	// Update task timestamp, release the lease and handle unlock logic
+	if err := s.db.UpdateTaskLastTimestampContext(bctx, &task, status); err != nil {
+		log.Printf("Worker %d: failed to update task %d timestamp: %v\n", workerID, task.ID, err)
+	}
+}
+
+// accountFatal reports whether a run failed because of its account rather
+// than its task.
+func accountFatal(err error, steps []database.TaskRunStep) bool {
+	if vk.ClassOf(err) == vk.ClassAccountFatal {
+		return true
+	}
+	for _, step := range steps {
+		if step.Status == database.StepFailed && step.Class == vk.ClassAccountFatal.String() {
+			return true
 		}
+	}
+	return false
+}
+
+// renewLease keeps the lease on task alive until the returned function is
+// called. If the lease is lost, cancel is called with ErrLeaseLost. The
+// renewals update a copy of task, which the caller keeps reading while
+// they run.
+func (s *Service) renewLease(ctx context.Context, workerID int, owner string, task database.MonitoringTask, cancel context.CancelCauseFunc) func() {
+	lease := s.leaseDuration()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
 
-		// Update task timestamp and handle unlock logic
-		if err := s.db.UpdateTaskLastTimestamp(&task, success); err != nil {
-			log.Printf("Worker %d: failed to update task %d timestamp: %v\n", workerID, task.ID, err)
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.db.RenewTaskLeaseContext(ctx, &task, owner, lease); err != nil {
+					log.Printf("Worker %d: failed to renew lease on task %d: %v\n", workerID, task.ID, err)
+					if errors.Is(err, database.ErrLeaseLost) {
+						cancel(err)
+						return
+					}
+				}
+			}
 		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
 	}
 }
 
-func (s *Service) processTask(task database.MonitoringTask) error {
+// processTask collects the data of a task into a batch and fills in run.
+// The batch holds whatever was collected, also when an error is returned;
+// it is nil if collection never started.
+func (s *Service) processTask(ctx context.Context, task database.MonitoringTask, run *database.TaskRun) (*database.Batch, error) {
+	filters, err := database.ParseTaskFilters(task.Filters, task.FilterLimits)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get available account
-	account, err := s.db.GetAvailableAccount(task.SocialNetworkType, task.AccountGroupID)
+	account, err := s.db.GetAvailableAccountContext(ctx, task.SocialNetworkType, task.AccountGroupID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	run.AccountID = &account.ID
+	run.Proxy = account.Proxy
 
 	// Create VK client
 	accessToken := "" // Extract from account.Session
@@ -124,16 +445,103 @@ func (s *Service) processTask(task database.MonitoringTask) error {
 	}
 
 	if accessToken == "" {
-		return fmt.Errorf("no access token for account %d", account.ID)
+		return nil, fmt.Errorf("no access token for account %d", account.ID)
+	}
+
+	opts := []vk.Option{
+		vk.WithLimiters(s.limiters),
+		vk.WithRetryPolicy(s.retry),
+		vk.WithAPIVersion(s.config.VK.APIVersion),
 	}
 
-	client, err := vk.NewClient(accessToken, account.Proxy)
+	if s.config.VK.RecordDir != "" {
+		cassette, err := s.createCassette(task)
+		if err != nil {
+			return nil, err
+		}
+		defer cassette.Close()
+		opts = append(opts, vk.WithRecorder(vk.NewRecorder(cassette)))
+	}
+
+	client, err := vk.NewClient(accessToken, account.Proxy, opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	collector := vk.NewCollector(client, s.db)
+	// Everything collected is buffered and stored in one transaction with
+	// the run record.
+	batch := database.NewBatch(s.db)
+	collector := vk.NewCollector(client, batch)
+	collector.SetMaxItems(s.config.VK.MaxItems)
+	collector.SetFilters(filters)
+	if inc := s.config.VK.Incremental; inc.Enabled {
+		collector.SetIncremental(batch, vk.Incremental{
+			HotWindow:        time.Duration(inc.HotWindowHours) * time.Hour,
+			FullSyncInterval: time.Duration(inc.FullSyncHours) * time.Hour,
+		})
+	}
 
 	// Collect entity
-	return collector.CollectEntity(task.OwnerType, task.OwnerID)
+	result, err := collector.CollectEntity(ctx, task.OwnerType, task.OwnerID)
+	if err != nil {
+		s.handleAccountError(context.WithoutCancel(ctx), account, err)
+	}
+
+	run.APICalls = int(client.Calls())
+	if result != nil {
+		run.Steps = result.RunSteps()
+		// An account that stops working half way fails the remaining
+		// steps without failing the collection.
+		for _, stepErr := range result.Errors() {
+			if stepErr.Class == vk.ClassAccountFatal {
+				s.handleAccountError(context.WithoutCancel(ctx), account, stepErr)
+				break
+			}
+		}
+	}
+
+	// Data collected before an error or a shutdown is kept.
+	return batch, err
+}
+
+// createCassette creates the file the VK traffic of a task run is recorded
+// to.
+func (s *Service) createCassette(task database.MonitoringTask) (*os.File, error) {
+	if err := os.MkdirAll(s.config.VK.RecordDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("task-%d-%s.jsonl", task.ID, time.Now().UTC().Format("20060102T150405"))
+	f, err := os.Create(filepath.Join(s.config.VK.RecordDir, name))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Recording task %d to %s\n", task.ID, f.Name())
+	return f, nil
+}
+
+// handleAccountError blocks or cools down the account depending on the
+// class of the VK API error it ran into.
+func (s *Service) handleAccountError(ctx context.Context, account *database.Account, err error) {
+	var apiErr *vk.APIError
+	if !errors.As(err, &apiErr) {
+		return
+	}
+
+	switch apiErr.Class() {
+	case vk.ClassAccountFatal:
+		log.Printf("Blocking account %d: %v\n", account.ID, apiErr)
+		if err := s.db.MarkAccountBlockedContext(ctx, account.ID, apiErr.Error()); err != nil {
+			log.Printf("Failed to block account %d: %v\n", account.ID, err)
+		}
+	case vk.ClassRetryable:
+		cooldown := apiErr.Cooldown()
+		if cooldown == 0 {
+			return
+		}
+		log.Printf("Account %d unavailable for %s: %v\n", account.ID, cooldown, apiErr)
+		if err := s.db.SetAccountUnavailableContext(ctx, account.ID, cooldown); err != nil {
+			log.Printf("Failed to set account %d unavailable: %v\n", account.ID, err)
+		}
+	}
 }
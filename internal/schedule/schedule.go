@@ -0,0 +1,272 @@
+// Package schedule parses the cron expressions of monitoring tasks and
+// computes their run times.
+//
+// An expression has five fields separated by spaces:
+//
+//	minute       0-59
+//	hour         0-23
+//	day of month 1-31
+//	month        1-12 or jan-dec
+//	day of week  0-7 or sun-sat, where both 0 and 7 are Sunday
+//
+// A field is "*", a value, a range "a-b" or a comma separated list of
+// them, each optionally followed by a step: "*/15", "8-22/2", "5/10".
+// When both day fields are restricted a day matching either of them
+// matches, as in cron. A day field starting with "*", such as "*/2", is not
+// restricted, and a day must then match both. The shorthands @yearly,
+// @monthly, @weekly, @daily and @hourly are accepted too.
+//
+// Times are local to the time zone of the schedule. A local time skipped
+// by a daylight saving change does not run that day, and one repeated by
+// it runs only the first time.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Tasks name their time zones; the zone database must not depend on
+	// the host.
+	_ "time/tzdata"
+)
+
+// Schedule is a parsed cron expression evaluated in a time zone.
+type Schedule struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// domAll and dowAll are set when the day fields start with "*"; then
+	// a day must match both fields, otherwise either.
+	domAll bool
+	dowAll bool
+	loc    *time.Location
+}
+
+// horizon bounds the search for the next run time. It covers a leap day.
+const horizon = 5 * 366 * 24 * time.Hour
+
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    []string // names of the values from min on
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12,
+		names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	dowField = field{name: "day of week", min: 0, max: 7,
+		names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// Parse parses expr and the IANA time zone it is evaluated in, such as
+// "Europe/Moscow". An empty timezone means UTC.
+func Parse(expr, timezone string) (*Schedule, error) {
+	loc := time.UTC
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", timezone)
+		}
+	}
+
+	spec := strings.TrimSpace(expr)
+	if full, ok := shorthands[strings.ToLower(spec)]; ok {
+		spec = full
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &Schedule{expr: expr, loc: loc}
+	var err error
+	if s.minute, err = minuteField.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if s.hour, err = hourField.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.dom, err = domField.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.month, err = monthField.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.dow, err = dowField.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAll = strings.HasPrefix(fields[2], "*")
+	s.dowAll = strings.HasPrefix(fields[4], "*")
+
+	ref := time.Date(2000, 1, 1, 0, 0, 0, 0, loc)
+	if s.Next(ref).IsZero() {
+		return nil, fmt.Errorf("%q never matches", expr)
+	}
+	return s, nil
+}
+
+func (f field) parse(text string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(text, ",") {
+		b, err := f.parsePart(part)
+		if err != nil {
+			return 0, fmt.Errorf("%s %q: %w", f.name, text, err)
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+func (f field) parsePart(part string) (uint64, error) {
+	rangeText, stepText, hasStep := strings.Cut(part, "/")
+
+	lo, hi := f.min, f.max
+	switch {
+	case rangeText == "*":
+	case strings.Contains(rangeText, "-"):
+		loText, hiText, _ := strings.Cut(rangeText, "-")
+		var err error
+		if lo, err = f.value(loText); err != nil {
+			return 0, err
+		}
+		if hi, err = f.value(hiText); err != nil {
+			return 0, err
+		}
+		if lo > hi {
+			return 0, errors.New("range start is after its end")
+		}
+	default:
+		v, err := f.value(rangeText)
+		if err != nil {
+			return 0, err
+		}
+		lo = v
+		// "5/10" runs from 5 to the end of the field.
+		if !hasStep {
+			hi = v
+		}
+	}
+
+	step := 1
+	if hasStep {
+		var err error
+		if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+			return 0, fmt.Errorf("invalid step %q", stepText)
+		}
+	}
+
+	var bits uint64
+	for v := lo; v <= hi; v += step {
+		bits |= 1 << uint(v)
+	}
+	return bits, nil
+}
+
+func (f field) value(text string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(text, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", text)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%d is out of range %d-%d", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// String returns the expression the schedule was parsed from.
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Location returns the time zone the schedule is evaluated in.
+func (s *Schedule) Location() *time.Location {
+	return s.loc
+}
+
+// Next returns the first time after after that matches the schedule, or
+// the zero time if there is none within five years.
+func (s *Schedule) Next(after time.Time) time.Time {
+	t := after.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(horizon)
+
+	for t.Before(limit) {
+		y, mo, d := t.Date()
+		h, mi := t.Hour(), t.Minute()
+
+		var next time.Time
+		switch {
+		case s.month&(1<<uint(mo)) == 0:
+			next = firstPass(time.Date(y, mo+1, 1, 0, 0, 0, 0, s.loc))
+		case !s.matchDay(t):
+			next = firstPass(time.Date(y, mo, d+1, 0, 0, 0, 0, s.loc))
+		case s.hour&(1<<uint(h)) == 0:
+			next = firstPass(time.Date(y, mo, d, h+1, 0, 0, 0, s.loc))
+		case s.minute&(1<<uint(mi)) == 0, !firstPass(t).Equal(t):
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+
+		// Daylight saving changes can map a local time back to an
+		// earlier instant; always make progress.
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// firstPass returns the first instant with the local time of t. It differs
+// from t only for times repeated when the clocks are turned back; for them
+// time.Date may return either instant.
+func firstPass(t time.Time) time.Time {
+	_, offset := t.Zone()
+	_, before := t.Add(-2 * time.Hour).Zone()
+	if before <= offset {
+		return t
+	}
+	earlier := t.Add(-time.Duration(before-offset) * time.Second)
+	y1, m1, d1 := t.Date()
+	y2, m2, d2 := earlier.Date()
+	if y1 == y2 && m1 == m2 && d1 == d2 && t.Hour() == earlier.Hour() && t.Minute() == earlier.Minute() {
+		return earlier
+	}
+	return t
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAll || s.dowAll {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,166 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr     string
+		timezone string
+		valid    bool
+	}{
+		{"* * * * *", "", true},
+		{"*/15 8-22 * * *", "Europe/Moscow", true},
+		{"5/10 * * * *", "", true},
+		{"0 9 * jan,JUL mon-fri", "", true},
+		{"0 0 * * 7", "", true},
+		{"@daily", "", true},
+		{"@Hourly", "America/New_York", true},
+		{"  0 3 * * *  ", "", true},
+		{"", "", false},
+		{"0 3 * *", "", false},
+		{"0 3 * * * *", "", false},
+		{"60 * * * *", "", false},
+		{"* 24 * * *", "", false},
+		{"* * 0 * *", "", false},
+		{"* * * 13 *", "", false},
+		{"* * * * 8", "", false},
+		{"* * * * sunday", "", false},
+		{"*/0 * * * *", "", false},
+		{"*/x * * * *", "", false},
+		{"30-10 * * * *", "", false},
+		{"@reboot", "", false},
+		{"0 0 30 2 *", "", false},
+		{"0 0 31 apr,jun,sep,nov *", "", false},
+		{"0 0 * * *", "Mars/Olympus_Mons", false},
+	}
+
+	for _, tt := range tests {
+		s, err := Parse(tt.expr, tt.timezone)
+		if tt.valid != (err == nil) {
+			t.Errorf("Parse(%q, %q): got error %v, want valid %v", tt.expr, tt.timezone, err, tt.valid)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if s.String() != tt.expr {
+			t.Errorf("Parse(%q).String() = %q", tt.expr, s.String())
+		}
+		if want := tt.timezone; want != "" && s.Location().String() != want {
+			t.Errorf("Parse(%q).Location() = %v, want %s", tt.expr, s.Location(), want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		expr     string
+		timezone string
+		after    time.Time
+		want     time.Time
+	}{
+		{"every minute", "* * * * *", "", utc(9, 1, 10, 0), utc(9, 1, 10, 1)},
+		{"seconds are dropped", "* * * * *", "", utc(9, 1, 10, 0).Add(59 * time.Second), utc(9, 1, 10, 1)},
+		{"step", "*/15 8-22 * * *", "", utc(9, 1, 10, 1), utc(9, 1, 10, 15)},
+		{"step past the range", "*/15 8-22 * * *", "", utc(9, 1, 22, 50), utc(9, 2, 8, 0)},
+		{"step on a range", "0 8-22/4 * * *", "", utc(9, 1, 13, 0), utc(9, 1, 16, 0)},
+		{"step on a value", "5/10 * * * *", "", utc(9, 1, 10, 0), utc(9, 1, 10, 5)},
+		{"step on a value repeats", "5/10 * * * *", "", utc(9, 1, 10, 5), utc(9, 1, 10, 15)},
+		{"step on a value wraps", "5/10 * * * *", "", utc(9, 1, 10, 55), utc(9, 1, 11, 5)},
+		{"list", "0,30 * * * *", "", utc(9, 1, 10, 10), utc(9, 1, 10, 30)},
+
+		// 2024-09-13 and 2024-09-20 are Fridays.
+		{"day of month only", "0 0 15 * *", "", utc(9, 1, 0, 0), utc(9, 15, 0, 0)},
+		{"day of week only", "0 0 * * fri", "", utc(9, 14, 0, 0), utc(9, 20, 0, 0)},
+		{"either day field: weekday first", "0 0 15 * fri", "", utc(9, 7, 0, 0), utc(9, 13, 0, 0)},
+		{"either day field: day of month first", "0 0 15 * fri", "", utc(9, 14, 0, 0), utc(9, 15, 0, 0)},
+		// 2024-10-21 is the first Monday on the 1st, 11th, 21st or 31st.
+		{"starred step needs both day fields", "0 0 */10 * mon", "", utc(9, 1, 0, 0), utc(10, 21, 0, 0)},
+		{"last day of short months", "0 0 31 * *", "", utc(9, 1, 0, 0), utc(10, 31, 0, 0)},
+		{"leap day", "0 0 29 2 *", "", utc(3, 1, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+
+		{"month names", "0 0 1 jan,jul *", "", utc(2, 1, 0, 0), utc(7, 1, 0, 0)},
+		{"weekday range names", "30 9 * * MON-Fri", "", utc(9, 13, 10, 0), utc(9, 16, 9, 30)},
+		{"7 is Sunday", "0 0 * * 7", "", utc(9, 10, 0, 0), utc(9, 15, 0, 0)},
+		{"range up to 7", "0 0 * * 5-7", "", utc(9, 14, 1, 0), utc(9, 15, 0, 0)},
+		{"0 is Sunday", "0 0 * * 0", "", utc(9, 10, 0, 0), utc(9, 15, 0, 0)},
+
+		{"@hourly", "@hourly", "", utc(9, 1, 10, 20), utc(9, 1, 11, 0)},
+		{"@daily", "@daily", "", utc(9, 1, 10, 20), utc(9, 2, 0, 0)},
+		{"@midnight", "@midnight", "", utc(9, 1, 10, 20), utc(9, 2, 0, 0)},
+		{"@weekly", "@weekly", "", utc(9, 10, 0, 0), utc(9, 15, 0, 0)},
+		{"@monthly", "@monthly", "", utc(9, 10, 0, 0), utc(10, 1, 0, 0)},
+		{"@yearly", "@yearly", "", utc(9, 10, 0, 0), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@annually", "@ANNUALLY", "", utc(9, 10, 0, 0), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+
+		// Moscow is UTC+3 all year.
+		{"time zone", "0 3 * * *", "Europe/Moscow", utc(9, 1, 1, 0), utc(9, 2, 0, 0)},
+		// New York turns its clocks forward on 2024-03-10 at 02:00 and
+		// back on 2024-11-03 at 02:00.
+		{"before the change forward", "0 9 * * *", "America/New_York", utc(3, 9, 15, 0), utc(3, 10, 13, 0)},
+		{"after the change back", "0 9 * * *", "America/New_York", utc(11, 2, 14, 0), utc(11, 3, 14, 0)},
+		{"skipped time does not run", "30 2 * * *", "America/New_York", utc(3, 9, 12, 0), utc(3, 11, 6, 30)},
+		{"repeated time runs first", "30 1 * * *", "America/New_York", utc(11, 2, 12, 0), utc(11, 3, 5, 30)},
+		{"repeated time runs once", "30 1 * * *", "America/New_York", utc(11, 3, 5, 30), utc(11, 4, 6, 30)},
+		// Berlin turns its clocks forward on 2024-03-31 at 02:00 and back
+		// on 2024-10-27 at 03:00.
+		{"skipped hour", "*/30 * * * *", "Europe/Berlin", utc(3, 31, 0, 45), utc(3, 31, 1, 0)},
+		{"skipped time in Berlin", "30 2 * * *", "Europe/Berlin", utc(3, 30, 12, 0), utc(4, 1, 0, 30)},
+		{"repeated hour runs first", "*/30 * * * *", "Europe/Berlin", utc(10, 27, 0, 10), utc(10, 27, 0, 30)},
+		{"repeated hour is not run again", "*/30 * * * *", "Europe/Berlin", utc(10, 27, 0, 30), utc(10, 27, 2, 0)},
+		{"inside the repeated hour", "*/30 * * * *", "Europe/Berlin", utc(10, 27, 1, 10), utc(10, 27, 2, 0)},
+		{"repeated time from the day before", "30 2 * * *", "Europe/Berlin", utc(10, 26, 12, 0), utc(10, 27, 0, 30)},
+		{"repeated time from inside it", "30 2 * * *", "Europe/Berlin", utc(10, 27, 0, 10), utc(10, 27, 0, 30)},
+		{"repeated time runs once in Berlin", "30 2 * * *", "Europe/Berlin", utc(10, 27, 0, 30), utc(10, 28, 1, 30)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr, tt.timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Next(tt.after)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.after, got.UTC(), tt.want)
+			}
+			if got.Location() != s.Location() {
+				t.Errorf("Next returned a time in %v, want %v", got.Location(), s.Location())
+			}
+		})
+	}
+}
+
+func TestNextNeverMatches(t *testing.T) {
+	// Parse rejects schedules that never match; build one that only
+	// matches on days that do not exist.
+	s := &Schedule{expr: "0 0 31 2 *", minute: 1, hour: 1, dom: 1 << 31, month: 1 << 2, dow: 0xff, dowAll: true, loc: time.UTC}
+	if got := s.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("Next = %v, want the zero time", got)
+	}
+}
+
+func TestNextWalksEveryDay(t *testing.T) {
+	s, err := Parse("0 12 * * *", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every day of a year with both changes has exactly one run, at noon.
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, s.Location())
+	for day := 0; day < 366; day++ {
+		at = s.Next(at)
+		want := time.Date(2024, 1, 1+day, 12, 0, 0, 0, s.Location())
+		if !at.Equal(want) {
+			t.Fatalf("run %d at %v, want %v", day, at, want)
+		}
+	}
+}
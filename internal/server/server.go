@@ -1,11 +1,14 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/Nakray/sn/internal/config"
 	"github.com/Nakray/sn/internal/database"
@@ -14,13 +17,14 @@ import (
 )
 
 type Server struct {
-	db         *database.DB
+	db         database.Store
 	monitoring *monitoring.Service
 	config     *config.Config
 	router     *mux.Router
+	httpServer *http.Server
 }
 
-func New(db *database.DB, mon *monitoring.Service, cfg *config.Config) *Server {
+func New(db database.Store, mon *monitoring.Service, cfg *config.Config) *Server {
 	s := &Server{
 		db:         db,
 		monitoring: mon,
@@ -29,6 +33,10 @@ func New(db *database.DB, mon *monitoring.Service, cfg *config.Config) *Server {
 	}
 
 	s.setupRoutes()
+	s.httpServer = &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler: s.router,
+	}
 	return s
 }
 
@@ -39,7 +47,19 @@ func (s *Server) setupRoutes() {
 	// Monitoring tasks API
 	s.router.HandleFunc("/api/tasks", s.handleGetTasks).Methods("GET")
 	s.router.HandleFunc("/api/tasks", s.handleCreateTask).Methods("POST")
+	s.router.HandleFunc("/api/tasks/{id}", s.handleGetTask).Methods("GET")
+	s.router.HandleFunc("/api/tasks/{id}", s.handleUpdateTask).Methods("PATCH")
 	s.router.HandleFunc("/api/tasks/{id}", s.handleDeleteTask).Methods("DELETE")
+	s.router.HandleFunc("/api/tasks/{id}/pause", s.handlePauseTask).Methods("POST")
+	s.router.HandleFunc("/api/tasks/{id}/resume", s.handleResumeTask).Methods("POST")
+	s.router.HandleFunc("/api/tasks/{id}/requeue", s.handleRequeueTask).Methods("POST")
+	s.router.HandleFunc("/api/tasks/{id}/runs", s.handleGetTaskRuns).Methods("GET")
+
+	// Relation history API
+	s.router.HandleFunc("/api/relations/changes", s.handleGetRelationChanges).Methods("GET")
+
+	// Object history API
+	s.router.HandleFunc("/api/objects/{type}/{owner}/history", s.handleGetObjectHistory).Methods("GET")
 
 	// Accounts API
 	s.router.HandleFunc("/api/accounts", s.handleGetAccounts).Methods("GET")
@@ -48,9 +68,18 @@ func (s *Server) setupRoutes() {
 }
 
 func (s *Server) Start() error {
-	addr := fmt.Sprintf(":%d", s.config.Server.Port)
-	log.Printf("HTTP server listening on %s\n", addr)
-	return http.ListenAndServe(addr, s.router)
+	log.Printf("HTTP server listening on %s\n", s.httpServer.Addr)
+	err := s.httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits for active requests to
+// finish until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
 }
 
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -58,10 +87,69 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, indexHTML)
 }
 
+// taskError maps task repository errors to HTTP status codes.
+func taskError(w http.ResponseWriter, err error) {
+	var validationErr *database.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, database.ErrTaskNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func taskID(r *http.Request) (int64, error) {
+	return strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+}
+
 func (s *Server) handleGetTasks(w http.ResponseWriter, r *http.Request) {
-	tasks, err := s.db.ListMonitoringTasks()
+	query := r.URL.Query()
+	filter := database.TaskFilter{
+		SocialNetworkType: query.Get("social_network_type"),
+		OwnerType:         database.OwnerType(query.Get("owner_type")),
+	}
+
+	var err error
+	if v := query.Get("owner_id"); v != "" {
+		if filter.OwnerID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid owner_id", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("paused"); v != "" {
+		paused, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid paused", http.StatusBadRequest)
+			return
+		}
+		filter.Paused = &paused
+	}
+	if v := query.Get("dead"); v != "" {
+		dead, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid dead", http.StatusBadRequest)
+			return
+		}
+		filter.Dead = &dead
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tasks, err := s.db.ListMonitoringTasksContext(r.Context(), filter)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		taskError(w, err)
 		return
 	}
 
@@ -69,15 +157,106 @@ func (s *Server) handleGetTasks(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(tasks)
 }
 
+func (s *Server) handleGetTask(w http.ResponseWriter, r *http.Request) {
+	id, err := taskID(r)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := s.db.GetMonitoringTaskContext(r.Context(), id)
+	if err != nil {
+		taskError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// handleGetTaskRuns returns the latest runs of a task from the run ledger,
+// newest first.
+func (s *Server) handleGetTaskRuns(w http.ResponseWriter, r *http.Request) {
+	id, err := taskID(r)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := s.db.GetMonitoringTaskContext(r.Context(), id); err != nil {
+		taskError(w, err)
+		return
+	}
+
+	runs, err := s.db.ListTaskRunsContext(r.Context(), id, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if runs == nil {
+		runs = []database.TaskRun{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// createTaskRequest is the body of POST /api/tasks. It holds the fields a
+// client may set; the state kept by the workers, like FailureCount or the
+// lease, always starts out empty.
+type createTaskRequest struct {
+	SocialNetworkType string
+	OwnerType         database.OwnerType
+	OwnerID           int64
+	Period            int
+	Filters           map[string]interface{}
+	FilterLimits      map[string]interface{}
+	StepPolicy        map[string]interface{}
+	AccountGroupID    int
+	IsUnlockable      bool
+	UnlockIDs         []int64
+	Schedule          *string
+	Timezone          *string
+	RunAt             *time.Time
+	MaxAttempts       int
+	RetryBackoff      int
+}
+
 func (s *Server) handleCreateTask(w http.ResponseWriter, r *http.Request) {
-	var task database.MonitoringTask
-	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+	var req createTaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := s.db.CreateMonitoringTask(&task); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	task := database.MonitoringTask{
+		SocialNetworkType: req.SocialNetworkType,
+		OwnerType:         req.OwnerType,
+		OwnerID:           req.OwnerID,
+		Period:            req.Period,
+		Filters:           req.Filters,
+		FilterLimits:      req.FilterLimits,
+		StepPolicy:        req.StepPolicy,
+		AccountGroupID:    req.AccountGroupID,
+		IsUnlockable:      req.IsUnlockable,
+		UnlockIDs:         req.UnlockIDs,
+		Schedule:          req.Schedule,
+		Timezone:          req.Timezone,
+		RunAt:             req.RunAt,
+		MaxAttempts:       req.MaxAttempts,
+		RetryBackoff:      req.RetryBackoff,
+	}
+
+	if err := s.db.CreateMonitoringTaskContext(r.Context(), &task); err != nil {
+		taskError(w, err)
 		return
 	}
 
@@ -86,24 +265,214 @@ func (s *Server) handleCreateTask(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(task)
 }
 
+func (s *Server) handleUpdateTask(w http.ResponseWriter, r *http.Request) {
+	id, err := taskID(r)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var update database.TaskUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	task, err := s.db.UpdateMonitoringTaskContext(r.Context(), id, update)
+	if err != nil {
+		taskError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
 func (s *Server) handleDeleteTask(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	id, err := taskID(r)
 	if err != nil {
 		http.Error(w, "Invalid task ID", http.StatusBadRequest)
 		return
 	}
 
-	if err := s.db.DeleteMonitoringTask(id); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.db.DeleteMonitoringTaskContext(r.Context(), id); err != nil {
+		taskError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) handlePauseTask(w http.ResponseWriter, r *http.Request) {
+	s.setTaskPaused(w, r, true)
+}
+
+func (s *Server) handleResumeTask(w http.ResponseWriter, r *http.Request) {
+	s.setTaskPaused(w, r, false)
+}
+
+func (s *Server) setTaskPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	id, err := taskID(r)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := s.db.SetMonitoringTaskPausedContext(r.Context(), id, paused)
+	if err != nil {
+		taskError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// handleRequeueTask brings back a dead task, or one waiting for a retry,
+// and makes it due right away.
+func (s *Server) handleRequeueTask(w http.ResponseWriter, r *http.Request) {
+	id, err := taskID(r)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	task, err := s.db.RequeueMonitoringTaskContext(r.Context(), id)
+	if err != nil {
+		taskError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// relationChanges is the response of GET /api/relations/changes. Added and
+// Removed are the net changes over the period; they are meaningful when the
+// query selects a single list.
+type relationChanges struct {
+	Changes []database.RelationChange `json:"changes"`
+	Added   []int64                   `json:"added"`
+	Removed []int64                   `json:"removed"`
+}
+
+// handleGetRelationChanges answers who was added to or removed from a
+// relation list of an owner between since and until.
+func (s *Server) handleGetRelationChanges(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.RelationChangeFilter{
+		SocialNetworkType: query.Get("social_network_type"),
+		Owner:             database.Owner{Type: database.OwnerType(query.Get("owner_type"))},
+		RelationType:      database.RelationType(query.Get("relation_type")),
+	}
+
+	var err error
+	if filter.Owner.Type == "" {
+		http.Error(w, "owner_type is required", http.StatusBadRequest)
+		return
+	}
+	if filter.Owner.ID, err = strconv.ParseInt(query.Get("owner_id"), 10, 64); err != nil {
+		http.Error(w, "Invalid owner_id", http.StatusBadRequest)
+		return
+	}
+	if v := query.Get("details"); v != "" {
+		if err := json.Unmarshal([]byte(v), &filter.Details); err != nil || filter.Details == nil {
+			http.Error(w, "Invalid details", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid until", http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := s.db.ListRelationChangesContext(r.Context(), filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := relationChanges{Changes: changes}
+	resp.Added, resp.Removed = database.NetRelationChanges(changes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleGetObjectHistory returns the replaced versions of the objects of an
+// owner with their field changes, newest first. The owner is given the way
+// VK does: negative IDs are groups.
+func (s *Server) handleGetObjectHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	filter := database.ObjectHistoryFilter{
+		ObjectType:        vars["type"],
+		SocialNetworkType: query.Get("social_network_type"),
+	}
+
+	if _, ok := database.LookupObjectType(filter.ObjectType); !ok {
+		http.Error(w, "Unknown object type", http.StatusNotFound)
+		return
+	}
+
+	ownerID, err := strconv.ParseInt(vars["owner"], 10, 64)
+	if err != nil || ownerID == 0 {
+		http.Error(w, "Invalid owner", http.StatusBadRequest)
+		return
+	}
+	filter.Owner = database.Owner{Type: database.OwnerTypeUser, ID: ownerID}
+	if ownerID < 0 {
+		filter.Owner = database.Owner{Type: database.OwnerTypeGroup, ID: -ownerID}
+	}
+
+	if v := query.Get("details"); v != "" {
+		if err := json.Unmarshal([]byte(v), &filter.Details); err != nil || filter.Details == nil {
+			http.Error(w, "Invalid details", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid until", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	versions, err := s.db.ListObjectHistoryContext(r.Context(), filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if versions == nil {
+		versions = []database.ObjectVersion{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
 func (s *Server) handleGetAccounts(w http.ResponseWriter, r *http.Request) {
-	accounts, err := s.db.ListAccounts()
+	accounts, err := s.db.ListAccountsContext(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -120,7 +489,7 @@ func (s *Server) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.db.CreateAccount(&account); err != nil {
+	if err := s.db.CreateAccountContext(r.Context(), &account); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -138,7 +507,7 @@ func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.db.DeleteAccount(id); err != nil {
+	if err := s.db.DeleteAccountContext(r.Context(), id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -31,6 +31,7 @@ const indexHTML = `<!DOCTYPE html>
         .status { padding: 4px 8px; border-radius: 4px; font-size: 12px; }
         .status.active { background: #d4edda; color: #155724; }
         .status.blocked { background: #f8d7da; color: #721c24; }
+        .status.dead { background: #343a40; color: #fff; }
         .btn-small { padding: 4px 8px; font-size: 12px; }
     </style>
 </head>
@@ -57,8 +58,20 @@ const indexHTML = `<!DOCTYPE html>
                     <input id="taskOwnerID" required="" type="number"/>
                 </div>
                 <div class="form-group">
-                    <label>Period (minutes):</label>
-                    <input id="taskPeriod" required="" type="number" value="60"/>
+                    <label>Period (minutes, empty when a schedule is set):</label>
+                    <input id="taskPeriod" type="number" value="60"/>
+                </div>
+                <div class="form-group">
+                    <label>Schedule (optional cron expression):</label>
+                    <input id="taskSchedule" placeholder="*/15 8-22 * * *" type="text"/>
+                </div>
+                <div class="form-group">
+                    <label>Time Zone (optional):</label>
+                    <input id="taskTimezone" placeholder="Europe/Moscow" type="text"/>
+                </div>
+                <div class="form-group">
+                    <label>Run At (optional, once):</label>
+                    <input id="taskRunAt" type="datetime-local"/>
                 </div>
                 <div class="form-group">
                     <label>Account Group ID:</label>
@@ -72,8 +85,10 @@ const indexHTML = `<!DOCTYPE html>
                         <th>ID</th>
                         <th>Type</th>
                         <th>Owner ID</th>
-                        <th>Period (min)</th>
+                        <th>Schedule</th>
                         <th>Last Run</th>
+                        <th>Next Run</th>
+                        <th>Status</th>
                         <th>Actions</th>
                     </tr>
                 </thead>
@@ -134,33 +149,90 @@ const indexHTML = `<!DOCTYPE html>
                     "<td>" + t.ID + "</td>" +
                     "<td>" + t.OwnerType + "</td>" +
                     "<td>" + t.OwnerID + "</td>" +
-                    "<td>" + t.Period + "</td>" +
+                    "<td>" + escapeHTML(taskSchedule(t)) + "</td>" +
                     "<td>" + new Date(t.LastTimestamp).toLocaleString() + "</td>" +
-                    "<td><button class=\"btn-small danger\" onclick=\"deleteTask(" + t.ID + ")\">Delete</button></td>" +
+                    "<td>" + (t.NextRunAt ? new Date(t.NextRunAt).toLocaleString() : '-') + "</td>" +
+                    "<td>" + taskStatus(t) + "</td>" +
+                    "<td class=\"actions\">" +
+                        (t.IsDead ? "<button class=\"btn-small\" onclick=\"requeueTask(" + t.ID + ")\">Requeue</button>" : "") +
+                        (t.IsPaused
+                            ? "<button class=\"btn-small\" onclick=\"setTaskPaused(" + t.ID + ", false)\">Resume</button>"
+                            : "<button class=\"btn-small\" onclick=\"setTaskPaused(" + t.ID + ", true)\">Pause</button>") +
+                        "<button class=\"btn-small danger\" onclick=\"deleteTask(" + t.ID + ")\">Delete</button>" +
+                    "</td>" +
                 "</tr>";
             }).join('');
         }
 
+        function taskStatus(t) {
+            if (t.IsDead) {
+                return "<span class=\"status dead\" title=\"" + escapeHTML(t.LastError || '') + "\">Dead</span>";
+            }
+            if (t.IsPaused) {
+                return "<span class=\"status blocked\">Paused</span>";
+            }
+            if (t.FailureCount > 0) {
+                return "<span class=\"status blocked\" title=\"" + escapeHTML(t.LastError || '') + "\">Failing (" + t.FailureCount + ")</span>";
+            }
+            return "<span class=\"status active\">Active</span>";
+        }
+
+        function taskSchedule(t) {
+            if (t.Schedule) {
+                return t.Schedule + (t.Timezone ? ' (' + t.Timezone + ')' : '');
+            }
+            if (t.Period) {
+                return 'every ' + t.Period + ' min';
+            }
+            return 'once';
+        }
+
+        function escapeHTML(s) {
+            return s.replace(/[&<>"']/g, function(c) {
+                return {'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'}[c];
+            });
+        }
+
         async function createTask(e) {
             e.preventDefault();
             const task = {
                 SocialNetworkType: 'vkontakte',
                 OwnerType: document.getElementById('taskOwnerType').value,
                 OwnerID: parseInt(document.getElementById('taskOwnerID').value),
-                Period: parseInt(document.getElementById('taskPeriod').value),
+                Period: parseInt(document.getElementById('taskPeriod').value) || 0,
                 AccountGroupID: parseInt(document.getElementById('taskAccountGroupID').value),
                 Filters: {},
                 FilterLimits: {}
             };
-            await fetch('/api/tasks', {
+            const schedule = document.getElementById('taskSchedule').value.trim();
+            const timezone = document.getElementById('taskTimezone').value.trim();
+            const runAt = document.getElementById('taskRunAt').value;
+            if (schedule) task.Schedule = schedule;
+            if (timezone) task.Timezone = timezone;
+            if (runAt) task.RunAt = new Date(runAt).toISOString();
+            const res = await fetch('/api/tasks', {
                 method: 'POST',
                 headers: {'Content-Type': 'application/json'},
                 body: JSON.stringify(task)
             });
+            if (!res.ok) {
+                alert(await res.text());
+                return;
+            }
             document.getElementById('taskForm').reset();
             loadTasks();
         }
 
+        async function setTaskPaused(id, paused) {
+            await fetch('/api/tasks/' + id + (paused ? '/pause' : '/resume'), {method: 'POST'});
+            loadTasks();
+        }
+
+        async function requeueTask(id) {
+            await fetch('/api/tasks/' + id + '/requeue', {method: 'POST'});
+            loadTasks();
+        }
+
         async function deleteTask(id) {
             if (!confirm('Delete this task?')) return;
             await fetch('/api/tasks/' + id, {method: 'DELETE'});
@@ -186,7 +258,7 @@ const indexHTML = `<!DOCTYPE html>
         async function createAccount(e) {
             e.preventDefault();
             const account = {
-                SocialNetworkType: 'VKontakte',
+                SocialNetworkType: 'vkontakte',
                 Login: document.getElementById('accountLogin').value,
                 Password: document.getElementById('accountPassword').value,
                 Proxy: document.getElementById('accountProxy').value,
@@ -0,0 +1,54 @@
+package vk
+
+import (
+	"context"
+	"strconv"
+)
+
+func boardTopicsQuery(groupID int64, max int) listQuery {
+	return listQuery{
+		method:   "board.getTopics",
+		params:   map[string]string{"group_id": strconv.FormatInt(groupID, 10)},
+		pageSize: topicsPageSize,
+		max:      max,
+	}
+}
+
+// GetAllBoardTopics pages through the discussion topics of groupID,
+// stopping after max topics when max is positive.
+func (c *Client) GetAllBoardTopics(ctx context.Context, groupID int64, max int) (*ItemList, error) {
+	items, total, complete, err := collectList[map[string]interface{}](ctx, c, boardTopicsQuery(groupID, max))
+	return &ItemList{Items: items, Total: total, Complete: complete}, err
+}
+
+func boardCommentsQuery(groupID, topicID int64, max int) listQuery {
+	return listQuery{
+		method: "board.getComments",
+		params: map[string]string{
+			"group_id":   strconv.FormatInt(groupID, 10),
+			"topic_id":   strconv.FormatInt(topicID, 10),
+			"need_likes": "1",
+			"sort":       "asc",
+		},
+		pageSize: commentsPageSize,
+		max:      max,
+	}
+}
+
+// GetAllBoardComments pages through the comments of a discussion topic,
+// stopping after max comments when max is positive.
+func (c *Client) GetAllBoardComments(ctx context.Context, groupID, topicID int64, max int) (*ItemList, error) {
+	items, total, complete, err := collectList[map[string]interface{}](ctx, c, boardCommentsQuery(groupID, topicID, max))
+	return &ItemList{Items: items, Total: total, Complete: complete}, err
+}
+
+// GetAllBoardCommentsBatch pages through the comments of many topics of
+// groupID at once, sharing execute calls between them.
+func (c *Client) GetAllBoardCommentsBatch(ctx context.Context, groupID int64, topicIDs []int64, max int) ([]*ItemList, []error) {
+	queries := make([]listQuery, len(topicIDs))
+	for i, topicID := range topicIDs {
+		queries[i] = boardCommentsQuery(groupID, topicID, max)
+	}
+
+	return itemLists(collectLists[map[string]interface{}](ctx, c, queries))
+}
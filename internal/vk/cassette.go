@@ -0,0 +1,261 @@
+package vk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redacted replaces access tokens in recorded requests.
+const redacted = "REDACTED"
+
+// Interaction is one recorded request and its response. A cassette file
+// holds one interaction per line as JSON.
+type Interaction struct {
+	Time   time.Time         `json:"time"`
+	Method string            `json:"method"`
+	Params map[string]string `json:"params"`
+	Status int               `json:"status,omitempty"`
+	Header http.Header       `json:"header,omitempty"`
+	Body   string            `json:"body,omitempty"`
+	// Error is set when the request failed before a response was received.
+	Error string `json:"error,omitempty"`
+}
+
+// key identifies the request an interaction answers. The access token is
+// left out, so a recording can be replayed with any token.
+func (i *Interaction) key() string {
+	values := url.Values{}
+	for k, v := range i.Params {
+		if k != "access_token" {
+			values.Set(k, v)
+		}
+	}
+	return i.Method + "?" + values.Encode()
+}
+
+// Recorder writes every request made by a client and its response to a
+// cassette. It is safe for concurrent use.
+type Recorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// WithRecorder makes the client record its traffic to rec. Requests are
+// still sent to the API.
+func WithRecorder(rec *Recorder) Option {
+	return func(c *Client) {
+		c.recorder = rec
+	}
+}
+
+func (r *Recorder) record(i *Interaction) error {
+	line, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.w.Write(line)
+	return err
+}
+
+// transport wraps base so that every round trip is recorded.
+func (r *Recorder) transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &recordingTransport{rec: r, base: base}
+}
+
+type recordingTransport struct {
+	rec  *Recorder
+	base http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	interaction, err := newInteraction(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		interaction.Error = err.Error()
+		if recErr := t.rec.record(interaction); recErr != nil {
+			return nil, fmt.Errorf("failed to record %s: %w", interaction.Method, recErr)
+		}
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	interaction.Status = resp.StatusCode
+	interaction.Header = resp.Header.Clone()
+	interaction.Body = string(body)
+	if err := t.rec.record(interaction); err != nil {
+		return nil, fmt.Errorf("failed to record %s: %w", interaction.Method, err)
+	}
+
+	return resp, nil
+}
+
+// newInteraction reads the method and form parameters of req, leaving its
+// body intact.
+func newInteraction(req *http.Request) (*Interaction, error) {
+	var form []byte
+	if req.Body != nil {
+		var err error
+		form, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(form))
+	}
+
+	values, err := url.ParseQuery(string(form))
+	if err != nil {
+		return nil, err
+	}
+
+	params := make(map[string]string, len(values))
+	for k := range values {
+		params[k] = values.Get(k)
+	}
+	if _, ok := params["access_token"]; ok {
+		params["access_token"] = redacted
+	}
+
+	return &Interaction{
+		Time:   time.Now(),
+		Method: path.Base(req.URL.Path),
+		Params: params,
+	}, nil
+}
+
+// ErrNotRecorded is returned in replay for requests the cassette does not
+// contain.
+var ErrNotRecorded = errors.New("request not recorded in cassette")
+
+// Cassette replays recorded interactions. Identical requests are answered
+// in the order they were recorded. It is safe for concurrent use.
+type Cassette struct {
+	mu           sync.Mutex
+	interactions map[string][]*Interaction
+}
+
+// LoadCassette reads a cassette written by a Recorder.
+func LoadCassette(r io.Reader) (*Cassette, error) {
+	c := &Cassette{interactions: make(map[string][]*Interaction)}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var i Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &i); err != nil {
+			return nil, fmt.Errorf("cassette line %d: %w", line, err)
+		}
+		key := i.key()
+		c.interactions[key] = append(c.interactions[key], &i)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// OpenCassette loads the cassette stored at filename.
+func OpenCassette(filename string) (*Cassette, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadCassette(f)
+}
+
+// WithCassette makes the client answer every request from cas instead of
+// the network.
+func WithCassette(cas *Cassette) Option {
+	return func(c *Client) {
+		c.cassette = cas
+	}
+}
+
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	want, err := newInteraction(req)
+	if err != nil {
+		return nil, err
+	}
+	key := want.key()
+
+	c.mu.Lock()
+	queue := c.interactions[key]
+	if len(queue) == 0 {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrNotRecorded, strings.TrimSuffix(key, "?"))
+	}
+	i := queue[0]
+	c.interactions[key] = queue[1:]
+	c.mu.Unlock()
+
+	if i.Error != "" {
+		return nil, errors.New(i.Error)
+	}
+
+	header := i.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.Status, http.StatusText(i.Status)),
+		StatusCode:    i.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(i.Body)),
+		ContentLength: int64(len(i.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Remaining returns the number of recorded interactions not replayed yet.
+func (c *Cassette) Remaining() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, queue := range c.interactions {
+		n += len(queue)
+	}
+	return n
+}
@@ -1,12 +1,16 @@
 package vk
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,23 +20,69 @@ const (
 )
 
 type Client struct {
+	endpoint    string
 	accessToken string
+	proxyURL    *string
 	version     string
 	client      *http.Client
-	lastRequest time.Time
+	limiters    *LimiterRegistry
+	limiter     *Limiter
+	retry       RetryPolicy
+	recorder    *Recorder
+	cassette    *Cassette
+
+	// calls counts the requests sent, including retries.
+	calls atomic.Int64
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithLimiters makes the client take its rate limiter from registry
+// instead of DefaultLimiters.
+func WithLimiters(registry *LimiterRegistry) Option {
+	return func(c *Client) {
+		c.limiters = registry
+	}
+}
+
+// WithEndpoint points the client at another API server, such as a
+// vktest.Server. endpoint must end with a slash.
+func WithEndpoint(endpoint string) Option {
+	return func(c *Client) {
+		c.endpoint = endpoint
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy for the client.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// WithAPIVersion overrides the VK API version sent with every request.
+func WithAPIVersion(version string) Option {
+	return func(c *Client) {
+		if version != "" {
+			c.version = version
+		}
+	}
 }
 
 type APIResponse struct {
-	Response json.RawMessage `json:"response"`
-	Error    *APIError       `json:"error"`
+	Response      json.RawMessage `json:"response"`
+	Error         *APIError       `json:"error"`
+	ExecuteErrors []APIError      `json:"execute_errors"`
 }
 
 type APIError struct {
+	Method    string `json:"method,omitempty"`
 	ErrorCode int    `json:"error_code"`
 	ErrorMsg  string `json:"error_msg"`
 }
 
-func NewClient(accessToken string, proxyURL *string) (*Client, error) {
+func NewClient(accessToken string, proxyURL *string, opts ...Option) (*Client, error) {
 	client := &http.Client{
 		Timeout: 30 * time.Second,
 	}
@@ -47,38 +97,92 @@ func NewClient(accessToken string, proxyURL *string) (*Client, error) {
 		}
 	}
 
-	return &Client{
+	c := &Client{
+		endpoint:    APIEndpoint,
 		accessToken: accessToken,
+		proxyURL:    proxyURL,
 		version:     APIVersion,
 		client:      client,
-	}, nil
+		limiters:    DefaultLimiters,
+		retry:       DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.cassette != nil {
+		client.Transport = c.cassette
+	}
+	if c.recorder != nil {
+		client.Transport = c.recorder.transport(client.Transport)
+	}
+	c.limiter = c.limiters.Get(accessToken, proxyURL)
+
+	return c, nil
 }
 
 func (c *Client) Call(method string, params map[string]string) (json.RawMessage, error) {
-	// Rate limiting: ~3 requests per second
-	since := time.Since(c.lastRequest)
-	if since < 350*time.Millisecond {
-		time.Sleep(350*time.Millisecond - since)
+	return c.CallContext(context.Background(), method, params)
+}
+
+// CallContext calls method and returns its response. The request is
+// abandoned when ctx is done, including while waiting for the rate limiter.
+func (c *Client) CallContext(ctx context.Context, method string, params map[string]string) (json.RawMessage, error) {
+	apiResp, err := c.do(ctx, method, params)
+	if err != nil {
+		return nil, err
 	}
-	c.lastRequest = time.Now()
 
-	if params == nil {
-		params = make(map[string]string)
+	return apiResp.Response, nil
+}
+
+// Calls returns the number of API requests the client has sent, counting
+// every attempt of a retried request and every execute as one.
+func (c *Client) Calls() int64 {
+	return c.calls.Load()
+}
+
+// do sends a request, retrying it according to the client's retry policy,
+// and decodes the envelope. A top-level API error is returned as *APIError.
+func (c *Client) do(ctx context.Context, method string, params map[string]string) (*APIResponse, error) {
+	var apiResp *APIResponse
+	err := c.retry.retry(ctx, func() error {
+		var err error
+		apiResp, err = c.doOnce(ctx, method, params)
+		return err
+	})
+	return apiResp, err
+}
+
+func (c *Client) doOnce(ctx context.Context, method string, params map[string]string) (*APIResponse, error) {
+	if err := c.limiter.Wait(ctx, method); err != nil {
+		return nil, err
 	}
-	params["access_token"] = c.accessToken
-	params["v"] = c.version
+
+	c.calls.Add(1)
 
 	formData := url.Values{}
 	for k, v := range params {
 		formData.Set(k, v)
 	}
+	formData.Set("access_token", c.accessToken)
+	formData.Set("v", c.version)
 
-	resp, err := c.client.PostForm(APIEndpoint+method, formData)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+method, strings.NewReader(formData.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPError(resp)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -90,28 +194,24 @@ func (c *Client) Call(method string, params map[string]string) (json.RawMessage,
 	}
 
 	if apiResp.Error != nil {
-		return nil, fmt.Errorf("VK API error %d: %s", apiResp.Error.ErrorCode, apiResp.Error.ErrorMsg)
+		if errors.Is(apiResp.Error, ErrTooManyRequests) {
+			c.limiter.Backoff()
+		}
+		return nil, apiResp.Error
 	}
+	c.limiter.Recover()
 
-	return apiResp.Response, nil
+	return &apiResp, nil
 }
 
-func (c *Client) GetUserInfo(userID int64) (map[string]interface{}, error) {
-	params := map[string]string{
-		"user_ids": strconv.FormatInt(userID, 10),
-		"fields":   "sex,bdate,city,country,photo_max,status,last_seen",
-	}
+const userFields = "sex,bdate,city,country,photo_max,status,last_seen"
 
-	resp, err := c.Call("users.get", params)
+func (c *Client) GetUserInfo(ctx context.Context, userID int64) (map[string]interface{}, error) {
+	users, err := c.GetUsersInfo(ctx, []int64{userID})
 	if err != nil {
 		return nil, err
 	}
 
-	var users []map[string]interface{}
-	if err := json.Unmarshal(resp, &users); err != nil {
-		return nil, err
-	}
-
 	if len(users) == 0 {
 		return nil, fmt.Errorf("user not found")
 	}
@@ -119,67 +219,110 @@ func (c *Client) GetUserInfo(userID int64) (map[string]interface{}, error) {
 	return users[0], nil
 }
 
-func (c *Client) GetGroupInfo(groupID int64) (map[string]interface{}, error) {
-	params := map[string]string{
-		"group_id": strconv.FormatInt(groupID, 10),
-		"fields":   "description,members_count,city,country",
+// GetUsersInfo looks up the profiles of many users. IDs are split into
+// users.get calls of up to usersPerCall IDs, which are sent through execute.
+func (c *Client) GetUsersInfo(ctx context.Context, userIDs []int64) ([]map[string]interface{}, error) {
+	var requests []Request
+	for start := 0; start < len(userIDs); start += usersPerCall {
+		end := start + usersPerCall
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		ids := make([]string, 0, end-start)
+		for _, id := range userIDs[start:end] {
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+
+		requests = append(requests, Request{
+			Method: "users.get",
+			Params: map[string]string{
+				"user_ids": strings.Join(ids, ","),
+				"fields":   userFields,
+			},
+		})
 	}
 
-	resp, err := c.Call("groups.getById", params)
+	results, err := c.Batch(ctx, requests)
 	if err != nil {
 		return nil, err
 	}
 
-	var groups []map[string]interface{}
-	if err := json.Unmarshal(resp, &groups); err != nil {
-		return nil, err
-	}
+	var users []map[string]interface{}
+	for _, result := range results {
+		if result.Err != nil {
+			return users, result.Err
+		}
 
-	if len(groups) == 0 {
-		return nil, fmt.Errorf("group not found")
+		var chunk []map[string]interface{}
+		if err := json.Unmarshal(result.Response, &chunk); err != nil {
+			return users, err
+		}
+		users = append(users, chunk...)
 	}
 
-	return groups[0], nil
+	return users, nil
 }
 
-func (c *Client) GetFriends(userID int64) ([]int64, error) {
+func (c *Client) GetGroupInfo(ctx context.Context, groupID int64) (map[string]interface{}, error) {
 	params := map[string]string{
-		"user_id": strconv.FormatInt(userID, 10),
+		"group_id": strconv.FormatInt(groupID, 10),
+		"fields":   "description,members_count,city,country",
 	}
 
-	resp, err := c.Call("friends.get", params)
+	resp, err := c.CallContext(ctx, "groups.getById", params)
 	if err != nil {
 		return nil, err
 	}
 
-	var result struct {
-		Items []int64 `json:"items"`
+	var groups []map[string]interface{}
+	if err := json.Unmarshal(resp, &groups); err != nil {
+		return nil, err
 	}
 
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, err
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("group not found")
 	}
 
-	return result.Items, nil
+	return groups[0], nil
 }
 
-func (c *Client) GetGroups(userID int64) ([]int64, error) {
-	params := map[string]string{
-		"user_id": strconv.FormatInt(userID, 10),
+func friendsQuery(userID int64, max int) listQuery {
+	return listQuery{
+		method:   "friends.get",
+		params:   map[string]string{"user_id": strconv.FormatInt(userID, 10)},
+		pageSize: friendsPageSize,
+		max:      max,
 	}
+}
 
-	resp, err := c.Call("groups.get", params)
-	if err != nil {
-		return nil, err
-	}
+func (c *Client) GetFriends(ctx context.Context, userID int64) ([]int64, error) {
+	return callList[int64](ctx, c, friendsQuery(userID, 0).page(0, friendsPageSize))
+}
 
-	var result struct {
-		Items []int64 `json:"items"`
-	}
+// GetAllFriends pages through the friends of userID, stopping after max IDs
+// when max is positive.
+func (c *Client) GetAllFriends(ctx context.Context, userID int64, max int) (*IDList, error) {
+	ids, total, complete, err := collectList[int64](ctx, c, friendsQuery(userID, max))
+	return &IDList{IDs: ids, Total: total, Complete: complete}, err
+}
 
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, err
+func groupsQuery(userID int64, max int) listQuery {
+	return listQuery{
+		method:   "groups.get",
+		params:   map[string]string{"user_id": strconv.FormatInt(userID, 10)},
+		pageSize: groupsPageSize,
+		max:      max,
 	}
+}
+
+func (c *Client) GetGroups(ctx context.Context, userID int64) ([]int64, error) {
+	return callList[int64](ctx, c, groupsQuery(userID, 0).page(0, groupsPageSize))
+}
 
-	return result.Items, nil
+// GetAllGroups pages through the groups of userID, stopping after max IDs
+// when max is positive.
+func (c *Client) GetAllGroups(ctx context.Context, userID int64, max int) (*IDList, error) {
+	ids, total, complete, err := collectList[int64](ctx, c, groupsQuery(userID, max))
+	return &IDList{IDs: ids, Total: total, Complete: complete}, err
 }
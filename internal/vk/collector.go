@@ -1,30 +1,153 @@
 package vk
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strconv"
+	"time"
 
 	"github.com/Nakray/sn/internal/database"
 )
 
+// DefaultMaxItems caps how many items a single list collects, keyed by API
+// method. A cap of zero or less means no cap.
+var DefaultMaxItems = map[string]int{
+	"friends.get":        10000,
+	"groups.get":         5000,
+	"users.getFollowers": 100000,
+	"groups.getMembers":  1000000,
+	"wall.get":           1000,
+	"photos.get":         1000,
+	"likes.getList":      100000,
+	"wall.getComments":   10000,
+	"photos.getComments": 10000,
+	"board.getTopics":    1000,
+	"board.getComments":  10000,
+}
+
 type Collector struct {
-	client *Client
-	db     *database.DB
+	client   *Client
+	db       database.Writer
+	maxItems map[string]int
+	filters  *database.TaskFilters
+
+	cursors     database.CursorStore
+	incremental Incremental
+
+	steps stepLog
 }
 
-func NewCollector(client *Client, db *database.DB) *Collector {
+func NewCollector(client *Client, db database.Writer) *Collector {
 	return &Collector{
-		client: client,
-		db:     db,
+		client:   client,
+		db:       db,
+		maxItems: DefaultMaxItems,
+	}
+}
+
+// SetMaxItems overrides the per-method item caps. Methods missing from
+// limits keep their default cap.
+func (col *Collector) SetMaxItems(limits map[string]int) {
+	merged := make(map[string]int, len(DefaultMaxItems)+len(limits))
+	for method, max := range DefaultMaxItems {
+		merged[method] = max
+	}
+	for method, max := range limits {
+		merged[method] = max
+	}
+	col.maxItems = merged
+}
+
+// SetFilters restricts what is collected to the kinds, limits and date
+// ranges of a task. A nil filters collects everything.
+func (col *Collector) SetFilters(filters *database.TaskFilters) {
+	col.filters = filters
+}
+
+func (col *Collector) maxFor(method string) int {
+	return col.maxItems[method]
+}
+
+// limit returns the item cap of a list of kind fetched with method: the
+// limit of the task filters if set, the per-method cap otherwise.
+func (col *Collector) limit(kind database.CollectKind, method string) int {
+	if limit := col.filters.Limit(kind); limit > 0 {
+		return limit
+	}
+	return col.maxFor(method)
+}
+
+// window returns the date range of kind; zero ends are open.
+func (col *Collector) window(kind database.CollectKind) (since, until time.Time) {
+	return col.filters.Window(kind, time.Now())
+}
+
+// inWindow filters items by the date range of kind, using the Unix time in
+// their dateField. Items without a date are kept.
+func (col *Collector) inWindow(kind database.CollectKind, dateField string, items []map[string]interface{}) []map[string]interface{} {
+	since, until := col.window(kind)
+	if since.IsZero() && until.IsZero() {
+		return items
+	}
+
+	var kept []map[string]interface{}
+	for _, item := range items {
+		if unix, ok := item[dateField].(float64); ok {
+			date := time.Unix(int64(unix), 0)
+			if (!since.IsZero() && date.Before(since)) || (!until.IsZero() && !date.Before(until)) {
+				continue
+			}
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+// windowed reports whether kind is limited to a date range. Lists of it
+// are stored as incomplete: items that leave the range were not removed.
+func (col *Collector) windowed(kind database.CollectKind) bool {
+	since, until := col.window(kind)
+	return !since.IsZero() || !until.IsZero()
+}
+
+// withCompleteness adds the completeness flag of a paginated list to
+// relation details. The flag does not identify the list, see
+// database.RelationKeyDetails.
+func withCompleteness(details map[string]interface{}, complete bool) map[string]interface{} {
+	result := make(map[string]interface{}, len(details)+1)
+	for k, v := range details {
+		result[k] = v
 	}
+	result["complete"] = complete
+	return result
 }
 
-func (col *Collector) CollectUser(userID int64) error {
+// CollectUser collects the profile and connections of a user. Steps that
+// fail after the profile is stored are recorded in the result instead of
+// ending the collection. An error is returned when the profile could not
+// be stored, or when ctx is cancelled half way; data that has already been
+// fetched is saved in that case too. The result is never nil.
+//
+// A Collector runs one collection at a time.
+func (col *Collector) CollectUser(ctx context.Context, userID int64) (*CollectResult, error) {
+	owner := database.Owner{Type: database.OwnerTypeUser, ID: userID}
+	started := time.Now()
+	col.steps.reset()
+	err := col.collectUser(ctx, userID)
+	return col.result(owner, started), err
+}
+
+func (col *Collector) collectUser(ctx context.Context, userID int64) error {
 	log.Printf("Collecting user %d\n", userID)
 
+	// Writes outlive cancellation so that partial progress is kept.
+	wctx := context.WithoutCancel(ctx)
+
 	// Get user info
-	userInfo, err := col.client.GetUserInfo(userID)
+	userInfo, err := col.client.GetUserInfo(ctx, userID)
 	if err != nil {
+		col.step("profile", 0, err)
 		return fmt.Errorf("failed to get user info: %w", err)
 	}
 
@@ -34,114 +157,283 @@ func (col *Collector) CollectUser(userID int64) error {
 		ID:   userID,
 	}
 
-	if err := col.db.WriteObject("vkontakte", owner, "user", nil, userInfo); err != nil {
+	if err := col.db.WriteObjectContext(wctx, "vkontakte", owner, "user", nil, userInfo); err != nil {
+		col.step("profile", 0, err)
 		return fmt.Errorf("failed to save user: %w", err)
 	}
+	col.step("profile", 1, nil)
 
-	// Get friends
-	friends, err := col.client.GetFriends(userID)
-	if err != nil {
-		log.Printf("Failed to get friends for user %d: %v\n", userID, err)
-	} else {
-		if err := col.db.WriteRelations("vkontakte", owner, database.RelationTypeFriend, nil, friends); err != nil {
-			log.Printf("Failed to save friends: %v\n", err)
+	// Get friends, groups and followers, sharing execute calls
+	type connection struct {
+		name         string
+		relationType database.RelationType
+		query        listQuery
+	}
+	var connections []connection
+	if col.filters.Collects(database.KindFriends) {
+		connections = append(connections, connection{"friends", database.RelationTypeFriend, friendsQuery(userID, col.limit(database.KindFriends, "friends.get"))})
+	}
+	if col.filters.Collects(database.KindGroups) {
+		connections = append(connections, connection{"groups", database.RelationTypeGroup, groupsQuery(userID, col.limit(database.KindGroups, "groups.get"))})
+	}
+	if col.filters.Collects(database.KindFollowers) {
+		connections = append(connections, connection{"followers", database.RelationTypeFollower, followersQuery(userID, col.limit(database.KindFollowers, "users.getFollowers"))})
+	}
+	queries := make([]listQuery, len(connections))
+	for i, conn := range connections {
+		queries[i] = conn.query
+	}
+	lists, errs := idLists(collectLists[int64](ctx, col.client, queries))
+	for i, conn := range connections {
+		if errs[i] != nil {
+			log.Printf("Failed to get %s for user %d: %v\n", conn.name, userID, errs[i])
+			col.step(conn.name, 0, errs[i])
+			continue
 		}
+		if err := col.db.WriteRelationsContext(wctx, "vkontakte", owner, conn.relationType, withCompleteness(nil, lists[i].Complete), lists[i].IDs); err != nil {
+			log.Printf("Failed to save %s: %v\n", conn.name, err)
+			col.step(conn.name, 0, err)
+			continue
+		}
+		col.step(conn.name, len(lists[i].IDs), nil)
 	}
 
-	// Get groups
-	groups, err := col.client.GetGroups(userID)
-	if err != nil {
-		log.Printf("Failed to get groups for user %d: %v\n", userID, err)
-	} else {
-		if err := col.db.WriteRelations("vkontakte", owner, database.RelationTypeGroup, nil, groups); err != nil {
-			log.Printf("Failed to save groups: %v\n", err)
-		}
+	// Get wall posts with their likes and comments
+	if col.filters.Collects(database.KindPosts) {
+		col.collectWall(ctx, owner, userID)
+	}
+
+	if !col.filters.Collects(database.KindPhotos) {
+		return ctx.Err()
 	}
 
-	var postIDs []int64
-	// Get wall posts
-	posts, err := col.client.GetWallPosts(userID, 100)
+	// Get photos
+	photos, err := col.client.GetAllPhotos(ctx, userID, "profile", col.limit(database.KindPhotos, "photos.get"))
 	if err != nil {
-		log.Printf("Failed to get wall posts for user %d: %v\n", userID, err)
+		log.Printf("Failed to get photos for user %d: %v\n", userID, err)
+		col.step("photos", 0, err)
 	} else {
-		for _, post := range posts {
-			if id, ok := post["id"].(float64); ok {
-				postIDs = append(postIDs, int64(id))
-				// Save post object
-				postOwner := database.Owner{Type: database.OwnerTypeUser, ID: userID}
-				postDetails := map[string]interface{}{"id": int64(id)}
-				col.db.WriteObject("vkontakte", postOwner, "post", postDetails, post)
+		photoIDs, stored, err := col.writeItems(ctx, owner, "photo", col.inWindow(database.KindPhotos, "date", photos.Items))
+		complete := photos.Complete && !col.windowed(database.KindPhotos)
+		if werr := col.db.WriteRelationsContext(wctx, "vkontakte", owner, database.RelationTypePhoto, withCompleteness(nil, complete), photoIDs); werr != nil {
+			log.Printf("Failed to save photos: %v\n", werr)
+			if err == nil {
+				err = werr
 			}
 		}
-		if len(postIDs) > 0 {
-			col.db.WriteRelations("vkontakte", owner, database.RelationTypePost, nil, postIDs)
+		col.step("photos", stored, err)
+		if len(photoIDs) > 0 {
+			// Collect likes and comments for photos
+			col.collectLikes(ctx, owner, userID, "photo", photoIDs)
+			col.collectComments(ctx, owner, userID, "photo", photoIDs)
 		}
 	}
 
-	// Collect likes for posts
-	for _, postID := range postIDs {
-		likes, err := col.client.GetLikes(userID, postID, "post", 1000)
-		if err != nil {
-			log.Printf("Failed to get likes for post %d: %v\n", postID, err)
-		} else {
-			likeDetails := map[string]interface{}{"post_id": postID}
-			if err := col.db.WriteRelations("vkontakte", owner, database.RelationTypePostLike, likeDetails, likes); err != nil {
-				log.Printf("Failed to save likes for post %d: %v\n", postID, err)
+	return ctx.Err()
+}
+
+// collectWall stores the posts on the wall of vkOwnerID, which is negative
+// for groups, together with their likes and comments.
+func (col *Collector) collectWall(ctx context.Context, owner database.Owner, vkOwnerID int64) {
+	wctx := context.WithoutCancel(ctx)
+
+	if cursor := col.wallCursor(ctx, owner); cursor != nil {
+		col.collectWallSince(ctx, owner, vkOwnerID, cursor)
+		return
+	}
+
+	// The wall is newest first, so paging stops at the start of the date
+	// range instead of fetching the whole wall.
+	since, _ := col.window(database.KindPosts)
+	limit := col.limit(database.KindPosts, "wall.get")
+	var posts *ItemList
+	var err error
+	if since.IsZero() {
+		posts, err = col.client.GetAllWallPosts(ctx, vkOwnerID, limit)
+	} else {
+		posts, err = col.client.GetAllWallPostsSince(ctx, vkOwnerID, since, limit)
+	}
+	if err != nil {
+		log.Printf("Failed to get wall posts for %s %d: %v\n", owner.Type, owner.ID, err)
+		col.step("posts", 0, err)
+		return
+	}
+
+	kept := col.inWindow(database.KindPosts, "date", posts.Items)
+	postIDs, stored, err := col.writeItems(ctx, owner, "post", kept)
+	col.saveWallCursor(wctx, owner, kept, postIDs, posts.Complete)
+	complete := posts.Complete && !col.windowed(database.KindPosts)
+	if werr := col.db.WriteRelationsContext(wctx, "vkontakte", owner, database.RelationTypePost, withCompleteness(nil, complete), postIDs); werr != nil {
+		log.Printf("Failed to save posts: %v\n", werr)
+		if err == nil {
+			err = werr
+		}
+	}
+	col.step("posts", stored, err)
+	if len(postIDs) == 0 {
+		return
+	}
+
+	// Collect likes and comments for posts
+	col.collectLikes(ctx, owner, vkOwnerID, "post", postIDs)
+	col.collectComments(ctx, owner, vkOwnerID, "post", postIDs)
+}
+
+// writeItems writes items of objectType keyed by their ID. It returns the
+// IDs of all items, the number of items stored and the first write error.
+func (col *Collector) writeItems(ctx context.Context, owner database.Owner, objectType string, items []map[string]interface{}) ([]int64, int, error) {
+	wctx := context.WithoutCancel(ctx)
+
+	var ids []int64
+	var stored int
+	var firstErr error
+	for _, item := range items {
+		id, ok := item["id"].(float64)
+		if !ok {
+			continue
+		}
+		ids = append(ids, int64(id))
+		if err := col.db.WriteObjectContext(wctx, "vkontakte", owner, objectType, map[string]interface{}{"id": int64(id)}, item); err != nil {
+			log.Printf("Failed to save %s %d: %v\n", objectType, int64(id), err)
+			if firstErr == nil {
+				firstErr = err
 			}
+			continue
 		}
+		stored++
 	}
+	return ids, stored, firstErr
+}
 
-	// Get followers
-	followers, err := col.client.GetFollowers(userID, 1000)
-	if err != nil {
-		log.Printf("Failed to get followers for user %d: %v\n", userID, err)
-	} else {
-		if err := col.db.WriteRelations("vkontakte", owner, database.RelationTypeFollower, nil, followers); err != nil {
-			log.Printf("Failed to save followers: %v\n", err)
+// collectLikes fetches the likes of items of one type ("post" or "photo")
+// in batches and stores them as relations keyed by item ID.
+func (col *Collector) collectLikes(ctx context.Context, owner database.Owner, vkOwnerID int64, itemType string, itemIDs []int64) {
+	if len(itemIDs) == 0 || !col.filters.Collects(database.KindLikes) {
+		return
+	}
+
+	relationType := database.RelationTypePostLike
+	if itemType == "photo" {
+		relationType = database.RelationTypePhotoLike
+	}
+	detailKey := itemType + "_id"
+	wctx := context.WithoutCancel(ctx)
+
+	likes, errs := col.client.GetAllLikesBatch(ctx, vkOwnerID, itemIDs, itemType, col.limit(database.KindLikes, "likes.getList"))
+	for i, itemID := range itemIDs {
+		if errs[i] != nil {
+			log.Printf("Failed to get likes for %s %d: %v\n", itemType, itemID, errs[i])
+			col.step(itemType+".likes", 0, errs[i])
+			continue
 		}
+
+		likeDetails := withCompleteness(map[string]interface{}{detailKey: itemID}, likes[i].Complete)
+		if err := col.db.WriteRelationsContext(wctx, "vkontakte", owner, relationType, likeDetails, likes[i].IDs); err != nil {
+			log.Printf("Failed to save likes for %s %d: %v\n", itemType, itemID, err)
+			col.step(itemType+".likes", 0, err)
+			continue
+		}
+		col.step(itemType+".likes", len(likes[i].IDs), nil)
 	}
+}
 
-	// Get photos
-	photos, err := col.client.GetPhotos(userID, "profile", 100)
-	if err != nil {
-		log.Printf("Failed to get photos for user %d: %v\n", userID, err)
-	} else {
-		var photoIDs []int64
-		for _, photo := range photos {
-			if id, ok := photo["id"].(float64); ok {
-				photoIDs = append(photoIDs, int64(id))
-				photoOwner := database.Owner{Type: database.OwnerTypeUser, ID: userID}
-				photoDetails := map[string]interface{}{"id": int64(id)}
-				col.db.WriteObject("vkontakte", photoOwner, "photo", photoDetails, photo)
+// collectComments fetches the comments of items of one type ("post",
+// "photo" or "topic") in batches. Every comment is stored as an object and the IDs of
+// the commenters as relations keyed by item ID.
+func (col *Collector) collectComments(ctx context.Context, owner database.Owner, vkOwnerID int64, itemType string, itemIDs []int64) {
+	if len(itemIDs) == 0 || !col.filters.Collects(database.KindComments) {
+		return
+	}
+
+	relationType := database.RelationTypePostComment
+	detailKey := itemType + "_id"
+	wctx := context.WithoutCancel(ctx)
+
+	var comments []*ItemList
+	var errs []error
+	switch itemType {
+	case "photo":
+		relationType = database.RelationTypePhotoComment
+		comments, errs = col.client.GetAllPhotoCommentsBatch(ctx, vkOwnerID, itemIDs, col.limit(database.KindComments, "photos.getComments"))
+	case "topic":
+		// Topics belong to groups, and the board methods take the
+		// positive group ID.
+		relationType = database.RelationTypeTopicComment
+		comments, errs = col.client.GetAllBoardCommentsBatch(ctx, -vkOwnerID, itemIDs, col.limit(database.KindComments, "board.getComments"))
+	default:
+		comments, errs = col.client.GetAllWallCommentsBatch(ctx, vkOwnerID, itemIDs, col.limit(database.KindComments, "wall.getComments"))
+	}
+
+	for i, itemID := range itemIDs {
+		if errs[i] != nil {
+			log.Printf("Failed to get comments for %s %d: %v\n", itemType, itemID, errs[i])
+			// Keep what was fetched before a thread failed.
+			if len(comments[i].Items) == 0 {
+				col.step(itemType+".comments", 0, errs[i])
+				continue
 			}
 		}
-		if len(photoIDs) > 0 {
-			col.db.WriteRelations("vkontakte", owner, database.RelationTypePhoto, nil, photoIDs)
-
-			// Collect likes for photos
-			for _, photoID := range photoIDs {
-				likes, err := col.client.GetLikes(userID, photoID, "photo", 1000)
-				if err != nil {
-					log.Printf("Failed to get likes for photo %d: %v\n", photoID, err)
-				} else {
-					likeDetails := map[string]interface{}{"photo_id": photoID}
-					if err := col.db.WriteRelations("vkontakte", owner, database.RelationTypePhotoLike, likeDetails, likes); err != nil {
-						log.Printf("Failed to save likes for photo %d: %v\n", photoID, err)
-					}
+
+		stored := 0
+		var writeErr error
+		var commenterIDs []int64
+		seen := make(map[int64]bool)
+		for _, comment := range col.inWindow(database.KindComments, "date", comments[i].Items) {
+			id, ok := comment["id"].(float64)
+			if !ok {
+				continue
+			}
+			commentDetails := map[string]interface{}{detailKey: itemID, "id": int64(id)}
+			if err := col.db.WriteObjectContext(wctx, "vkontakte", owner, "comment", commentDetails, comment); err != nil {
+				log.Printf("Failed to save comment %d on %s %d: %v\n", int64(id), itemType, itemID, err)
+				if writeErr == nil {
+					writeErr = err
 				}
+			} else {
+				stored++
+			}
+
+			// Deleted comments have no author.
+			if fromID, ok := comment["from_id"].(float64); ok && fromID != 0 && !seen[int64(fromID)] {
+				seen[int64(fromID)] = true
+				commenterIDs = append(commenterIDs, int64(fromID))
 			}
 		}
+
+		commentDetails := withCompleteness(map[string]interface{}{detailKey: itemID}, comments[i].Complete && !col.windowed(database.KindComments))
+		if err := col.db.WriteRelationsContext(wctx, "vkontakte", owner, relationType, commentDetails, commenterIDs); err != nil {
+			log.Printf("Failed to save commenters for %s %d: %v\n", itemType, itemID, err)
+			col.step(itemType+".comments", stored, err)
+			continue
+		}
+		err := errs[i]
+		if err == nil {
+			err = writeErr
+		}
+		col.step(itemType+".comments", stored, err)
 	}
+}
 
-	return nil
+// CollectGroup collects the profile, members, wall, photo albums and
+// discussions of a group. Step failures and cancellation are handled like
+// in CollectUser.
+func (col *Collector) CollectGroup(ctx context.Context, groupID int64) (*CollectResult, error) {
+	owner := database.Owner{Type: database.OwnerTypeGroup, ID: groupID}
+	started := time.Now()
+	col.steps.reset()
+	err := col.collectGroup(ctx, groupID)
+	return col.result(owner, started), err
 }
 
-func (col *Collector) CollectGroup(groupID int64) error {
+func (col *Collector) collectGroup(ctx context.Context, groupID int64) error {
 	log.Printf("Collecting group %d\n", groupID)
 
+	wctx := context.WithoutCancel(ctx)
+
 	// Get group info
-	groupInfo, err := col.client.GetGroupInfo(groupID)
+	groupInfo, err := col.client.GetGroupInfo(ctx, groupID)
 	if err != nil {
+		col.step("profile", 0, err)
 		return fmt.Errorf("failed to get group info: %w", err)
 	}
 
@@ -151,20 +443,161 @@ func (col *Collector) CollectGroup(groupID int64) error {
 		ID:   groupID,
 	}
 
-	if err := col.db.WriteObject("vkontakte", owner, "group", nil, groupInfo); err != nil {
+	if err := col.db.WriteObjectContext(wctx, "vkontakte", owner, "group", nil, groupInfo); err != nil {
+		col.step("profile", 0, err)
 		return fmt.Errorf("failed to save group: %w", err)
 	}
+	col.step("profile", 1, nil)
+
+	// Get members
+	if col.filters.Collects(database.KindMembers) {
+		members, err := col.client.GetAllGroupMembers(ctx, groupID, col.limit(database.KindMembers, "groups.getMembers"))
+		if err != nil {
+			log.Printf("Failed to get members of group %d: %v\n", groupID, err)
+			col.step("members", 0, err)
+		} else if err := col.db.WriteRelationsContext(wctx, "vkontakte", owner, database.RelationTypeMember, withCompleteness(nil, members.Complete), members.IDs); err != nil {
+			log.Printf("Failed to save members: %v\n", err)
+			col.step("members", 0, err)
+		} else {
+			col.step("members", len(members.IDs), nil)
+		}
+	}
+
+	// Group content is addressed by the negated group ID
+	if col.filters.Collects(database.KindPosts) {
+		col.collectWall(ctx, owner, -groupID)
+	}
+	if col.filters.Collects(database.KindPhotos) {
+		col.collectAlbums(ctx, owner, -groupID)
+	}
+	if col.filters.Collects(database.KindTopics) {
+		col.collectTopics(ctx, owner, groupID)
+	}
+
+	return ctx.Err()
+}
+
+// systemAlbums maps the IDs of system albums to the names photos.get
+// accepts for them.
+var systemAlbums = map[int64]string{
+	-6:  "profile",
+	-7:  "wall",
+	-15: "saved",
+}
+
+// collectAlbums stores all photo albums of vkOwnerID and the photos in
+// them, with their likes and comments.
+func (col *Collector) collectAlbums(ctx context.Context, owner database.Owner, vkOwnerID int64) {
+	wctx := context.WithoutCancel(ctx)
+
+	albums, err := col.client.GetPhotoAlbums(ctx, vkOwnerID)
+	if err != nil {
+		log.Printf("Failed to get albums for %s %d: %v\n", owner.Type, owner.ID, err)
+		col.step("albums", 0, err)
+		return
+	}
+
+	var albumIDs []int64
+	var queries []listQuery
+	var stored int
+	var writeErr error
+	for _, album := range albums.Items {
+		id, ok := album["id"].(float64)
+		if !ok {
+			continue
+		}
+		albumID := int64(id)
+
+		param := strconv.FormatInt(albumID, 10)
+		if albumID < 0 {
+			name, ok := systemAlbums[albumID]
+			if !ok {
+				continue
+			}
+			param = name
+		}
+
+		albumIDs = append(albumIDs, albumID)
+		queries = append(queries, photosQuery(vkOwnerID, param, col.limit(database.KindPhotos, "photos.get")))
+		if err := col.db.WriteObjectContext(wctx, "vkontakte", owner, "album", map[string]interface{}{"id": albumID}, album); err != nil {
+			log.Printf("Failed to save album %d: %v\n", albumID, err)
+			if writeErr == nil {
+				writeErr = err
+			}
+			continue
+		}
+		stored++
+	}
+	if err := col.db.WriteRelationsContext(wctx, "vkontakte", owner, database.RelationTypeAlbum, withCompleteness(nil, albums.Complete), albumIDs); err != nil {
+		log.Printf("Failed to save albums: %v\n", err)
+		if writeErr == nil {
+			writeErr = err
+		}
+	}
+	col.step("albums", stored, writeErr)
+	if len(albumIDs) == 0 {
+		return
+	}
+
+	var photoIDs []int64
+	outcomes := collectLists[map[string]interface{}](ctx, col.client, queries)
+	for i, out := range outcomes {
+		if out.err != nil {
+			log.Printf("Failed to get photos of album %d: %v\n", albumIDs[i], out.err)
+			col.step("photos", 0, out.err)
+			continue
+		}
+
+		ids, stored, err := col.writeItems(ctx, owner, "photo", col.inWindow(database.KindPhotos, "date", out.items))
+		photoIDs = append(photoIDs, ids...)
+		photoDetails := withCompleteness(map[string]interface{}{"album_id": albumIDs[i]}, out.complete && !col.windowed(database.KindPhotos))
+		if werr := col.db.WriteRelationsContext(wctx, "vkontakte", owner, database.RelationTypePhoto, photoDetails, ids); werr != nil {
+			log.Printf("Failed to save photos of album %d: %v\n", albumIDs[i], werr)
+			if err == nil {
+				err = werr
+			}
+		}
+		col.step("photos", stored, err)
+	}
+
+	col.collectLikes(ctx, owner, vkOwnerID, "photo", photoIDs)
+	col.collectComments(ctx, owner, vkOwnerID, "photo", photoIDs)
+}
+
+// collectTopics stores the discussion topics of a group and their
+// comments.
+func (col *Collector) collectTopics(ctx context.Context, owner database.Owner, groupID int64) {
+	wctx := context.WithoutCancel(ctx)
+
+	topics, err := col.client.GetAllBoardTopics(ctx, groupID, col.limit(database.KindTopics, "board.getTopics"))
+	if err != nil {
+		log.Printf("Failed to get topics of group %d: %v\n", groupID, err)
+		col.step("topics", 0, err)
+		return
+	}
+
+	topicIDs, stored, err := col.writeItems(ctx, owner, "topic", col.inWindow(database.KindTopics, "created", topics.Items))
+	complete := topics.Complete && !col.windowed(database.KindTopics)
+	if werr := col.db.WriteRelationsContext(wctx, "vkontakte", owner, database.RelationTypeTopic, withCompleteness(nil, complete), topicIDs); werr != nil {
+		log.Printf("Failed to save topics: %v\n", werr)
+		if err == nil {
+			err = werr
+		}
+	}
+	col.step("topics", stored, err)
 
-	return nil
+	col.collectComments(ctx, owner, -groupID, "topic", topicIDs)
 }
 
-func (col *Collector) CollectEntity(ownerType database.OwnerType, ownerID int64) error {
+// CollectEntity collects a user or a group, see CollectUser. The result is
+// nil only for an unknown owner type.
+func (col *Collector) CollectEntity(ctx context.Context, ownerType database.OwnerType, ownerID int64) (*CollectResult, error) {
 	switch ownerType {
 	case database.OwnerTypeUser:
-		return col.CollectUser(ownerID)
+		return col.CollectUser(ctx, ownerID)
 	case database.OwnerTypeGroup:
-		return col.CollectGroup(ownerID)
+		return col.CollectGroup(ctx, ownerID)
 	default:
-		return fmt.Errorf("unknown owner type: %s", ownerType)
+		return nil, fmt.Errorf("unknown owner type: %s", ownerType)
 	}
 }
@@ -0,0 +1,614 @@
+package vk_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Nakray/sn/internal/database"
+	"github.com/Nakray/sn/internal/database/memstore"
+	"github.com/Nakray/sn/internal/vk"
+	"github.com/Nakray/sn/internal/vk/vktest"
+)
+
+var userOwner = database.Owner{Type: database.OwnerTypeUser, ID: 1}
+
+// newUserServer serves user 1 with a profile and nothing else.
+func newUserServer(t *testing.T) *vktest.Server {
+	t.Helper()
+
+	srv := vktest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddUser(1, map[string]interface{}{"first_name": "Pavel"})
+	return srv
+}
+
+func ids(from, n int64) []int64 {
+	list := make([]int64, n)
+	for i := range list {
+		list[i] = from + int64(i)
+	}
+	return list
+}
+
+// kinds returns filters that collect only the given kinds.
+func kinds(t *testing.T, list ...database.CollectKind) *database.TaskFilters {
+	t.Helper()
+
+	names := make([]interface{}, len(list))
+	for i, kind := range list {
+		names[i] = string(kind)
+	}
+	filters, err := database.ParseTaskFilters(map[string]interface{}{"kinds": names}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filters
+}
+
+// findStep returns the step called name, failing the test if there is
+// none.
+func findStep(t *testing.T, result *vk.CollectResult, name string) vk.Step {
+	t.Helper()
+
+	for _, step := range result.Steps {
+		if step.Name == name {
+			return step
+		}
+	}
+	t.Fatalf("no step %q in %+v", name, result.Steps)
+	return vk.Step{}
+}
+
+// storedList returns the IDs and the completeness flag of a relation list
+// of owner that belongs to no item.
+func storedList(t *testing.T, store *memstore.Store, owner database.Owner, relationType database.RelationType) ([]int64, bool) {
+	t.Helper()
+
+	for _, rel := range store.Relations(owner) {
+		if rel.RelationType == relationType && len(database.RelationKeyDetails(rel.Details)) == 0 {
+			return rel.IDs, database.RelationComplete(rel.Details)
+		}
+	}
+	t.Fatalf("%s list of %s %d not stored", relationType, owner.Type, owner.ID)
+	return nil, false
+}
+
+func TestCollectorPagination(t *testing.T) {
+	srv := newUserServer(t)
+	srv.SetFriends(1, ids(1000, 9000))
+	srv.SetUserGroups(1, ids(1, 2500))
+	srv.SetFollowers(1, ids(50000, 1200))
+	for i := 0; i < 250; i++ {
+		srv.AddPost(1, map[string]interface{}{"text": "post"})
+	}
+
+	store := memstore.New()
+	col := vk.NewCollector(newTestClient(t, srv), store)
+	col.SetFilters(kinds(t, database.KindFriends, database.KindGroups, database.KindFollowers, database.KindPosts))
+	result, err := col.CollectUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		step         string
+		relationType database.RelationType
+		method       string
+		want         int
+		pages        int
+	}{
+		{"friends", database.RelationTypeFriend, "friends.get", 9000, 2},
+		{"groups", database.RelationTypeGroup, "groups.get", 2500, 3},
+		{"followers", database.RelationTypeFollower, "users.getFollowers", 1200, 2},
+		{"posts", database.RelationTypePost, "wall.get", 250, 3},
+	}
+	for _, tt := range tests {
+		step := findStep(t, result, tt.step)
+		if step.Status() != database.StepOK || step.Items != tt.want {
+			t.Errorf("%s: got %s with %d items, want %d", tt.step, step.Status(), step.Items, tt.want)
+		}
+		list, complete := storedList(t, store, userOwner, tt.relationType)
+		if len(list) != tt.want || !complete {
+			t.Errorf("%s: stored %d IDs, complete %v, want %d complete", tt.step, len(list), complete, tt.want)
+		}
+		seen := make(map[int64]bool, len(list))
+		for _, id := range list {
+			if seen[id] {
+				t.Errorf("%s: ID %d stored twice", tt.step, id)
+				break
+			}
+			seen[id] = true
+		}
+		if n := srv.Calls(tt.method); n != tt.pages {
+			t.Errorf("%s: fetched %d pages, want %d", tt.step, n, tt.pages)
+		}
+	}
+}
+
+func TestCollectorItemCap(t *testing.T) {
+	srv := newUserServer(t)
+	srv.SetFriends(1, ids(1000, 7000))
+
+	store := memstore.New()
+	col := vk.NewCollector(newTestClient(t, srv), store)
+	col.SetMaxItems(map[string]int{"friends.get": 6000})
+	col.SetFilters(kinds(t, database.KindFriends))
+	if _, err := col.CollectUser(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	list, complete := storedList(t, store, userOwner, database.RelationTypeFriend)
+	if len(list) != 6000 || complete {
+		t.Errorf("stored %d IDs, complete %v, want 6000 incomplete", len(list), complete)
+	}
+	if n := srv.Calls("friends.get"); n != 2 {
+		t.Errorf("fetched %d pages, want 2", n)
+	}
+}
+
+func TestCollectorRateLimit(t *testing.T) {
+	srv := newUserServer(t)
+	srv.SetFriends(1, []int64{2, 3})
+	// Error 6 fails the profile request and the execute call carrying
+	// the lists once; both are retried.
+	srv.InjectRateLimit("users.get", 1)
+	srv.InjectRateLimit("execute", 1)
+
+	store := memstore.New()
+	client := newTestClient(t, srv)
+	col := vk.NewCollector(client, store)
+	col.SetFilters(kinds(t, database.KindFriends, database.KindFollowers))
+	result, err := col.CollectUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"profile", "friends", "followers"} {
+		if step := findStep(t, result, name); step.Status() != database.StepOK {
+			t.Errorf("%s: got %s: %v", name, step.Status(), step.Err)
+		}
+	}
+	if n := srv.Calls("users.get"); n != 2 {
+		t.Errorf("users.get was called %d times, want 2", n)
+	}
+	if n := srv.Calls("execute"); n != 2 {
+		t.Errorf("execute was called %d times, want 2", n)
+	}
+	if n := client.Calls(); n != 4 {
+		t.Errorf("client counted %d calls, want 4", n)
+	}
+	if list, _ := storedList(t, store, userOwner, database.RelationTypeFriend); len(list) != 2 {
+		t.Errorf("stored friends %v", list)
+	}
+}
+
+func TestCollectorRateLimitInsideExecute(t *testing.T) {
+	srv := newUserServer(t)
+	srv.SetFriends(1, []int64{2, 3})
+	srv.SetFollowers(1, []int64{4})
+	// A call failing inside execute is not retried on its own; the other
+	// calls of the execute are not affected.
+	srv.InjectRateLimit("friends.get", 1)
+
+	store := memstore.New()
+	col := vk.NewCollector(newTestClient(t, srv), store)
+	col.SetFilters(kinds(t, database.KindFriends, database.KindFollowers))
+	result, err := col.CollectUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	friends := findStep(t, result, "friends")
+	if friends.Status() != database.StepFailed || friends.Err == nil {
+		t.Fatalf("friends: got %s, want failed", friends.Status())
+	}
+	if friends.Err.Class != vk.ClassRetryable || !errors.Is(friends.Err, vk.ErrTooManyRequests) {
+		t.Errorf("friends: got %v of class %s, want a retryable rate limit error", friends.Err, friends.Err.Class)
+	}
+	if followers := findStep(t, result, "followers"); followers.Status() != database.StepOK || followers.Items != 1 {
+		t.Errorf("followers: got %s with %d items", followers.Status(), followers.Items)
+	}
+}
+
+func TestCollectorCaptcha(t *testing.T) {
+	t.Run("profile", func(t *testing.T) {
+		srv := newUserServer(t)
+		srv.InjectCaptcha("users.get", 1)
+
+		store := memstore.New()
+		col := vk.NewCollector(newTestClient(t, srv), store)
+		result, err := col.CollectUser(context.Background(), 1)
+		if !errors.Is(err, vk.ErrCaptcha) {
+			t.Fatalf("got %v, want %v", err, vk.ErrCaptcha)
+		}
+
+		// A captcha puts the account on cooldown instead of being
+		// retried right away.
+		if n := srv.Calls("users.get"); n != 1 {
+			t.Errorf("users.get was called %d times, want 1", n)
+		}
+		var apiErr *vk.APIError
+		if !errors.As(err, &apiErr) || apiErr.Cooldown() != time.Hour {
+			t.Errorf("got %v, want an API error with an hour of cooldown", err)
+		}
+		profile := findStep(t, result, "profile")
+		if profile.Status() != database.StepFailed || profile.Err.Class != vk.ClassRetryable {
+			t.Errorf("profile: got %s of class %v", profile.Status(), profile.Err)
+		}
+		if _, ok := store.Object("vkontakte", userOwner, "user", nil); ok {
+			t.Error("profile was stored")
+		}
+	})
+
+	t.Run("wall", func(t *testing.T) {
+		srv := newUserServer(t)
+		srv.SetFriends(1, []int64{2})
+		srv.AddPost(1, map[string]interface{}{"text": "post"})
+		srv.InjectCaptcha("wall.get", 1)
+
+		store := memstore.New()
+		col := vk.NewCollector(newTestClient(t, srv), store)
+		col.SetFilters(kinds(t, database.KindFriends, database.KindPosts))
+		result, err := col.CollectUser(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		posts := findStep(t, result, "posts")
+		if posts.Status() != database.StepFailed || !errors.Is(posts.Err, vk.ErrCaptcha) || posts.Err.Class != vk.ClassRetryable {
+			t.Errorf("posts: got %s: %v", posts.Status(), posts.Err)
+		}
+		if n := srv.Calls("wall.get"); n != 1 {
+			t.Errorf("wall.get was called %d times, want 1", n)
+		}
+		if friends := findStep(t, result, "friends"); friends.Status() != database.StepOK {
+			t.Errorf("friends: got %s: %v", friends.Status(), friends.Err)
+		}
+	})
+}
+
+func TestCollectorPrivateProfile(t *testing.T) {
+	srv := newUserServer(t)
+	srv.SetFriends(1, []int64{2, 3})
+	srv.AddPost(1, map[string]interface{}{"text": "post"})
+	srv.SetPrivate(1)
+
+	store := memstore.New()
+	col := vk.NewCollector(newTestClient(t, srv), store)
+	col.SetFilters(kinds(t, database.KindFriends, database.KindGroups, database.KindFollowers, database.KindPosts, database.KindPhotos))
+	result, err := col.CollectUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if profile := findStep(t, result, "profile"); profile.Status() != database.StepOK {
+		t.Errorf("profile: got %s: %v", profile.Status(), profile.Err)
+	}
+	for _, name := range []string{"friends", "groups", "followers", "posts", "photos"} {
+		step := findStep(t, result, name)
+		if step.Status() != database.StepFailed || step.Err == nil {
+			t.Errorf("%s: got %s, want failed", name, step.Status())
+			continue
+		}
+		if step.Err.Class != vk.ClassTargetFatal || !errors.Is(step.Err, vk.ErrPrivateProfile) {
+			t.Errorf("%s: got %v of class %s, want a target-fatal private profile error", name, step.Err, step.Err.Class)
+		}
+	}
+	// Target-fatal errors are not retried.
+	if n := srv.Calls("wall.get"); n != 1 {
+		t.Errorf("wall.get was called %d times, want 1", n)
+	}
+
+	outcome, failed := database.DefaultStepPolicy.Outcome(runSteps(result))
+	if outcome != database.RunPartial || len(failed) != 5 {
+		t.Errorf("got outcome %s with failed steps %v, want partial with 5", outcome, failed)
+	}
+}
+
+func runSteps(result *vk.CollectResult) []database.TaskRunStep {
+	steps := make([]database.TaskRunStep, len(result.Steps))
+	for i, step := range result.Steps {
+		steps[i] = step.RunStep()
+	}
+	return steps
+}
+
+func TestCollectorLatency(t *testing.T) {
+	t.Run("slow", func(t *testing.T) {
+		srv := newUserServer(t)
+		srv.SetFriends(1, []int64{2})
+		srv.SetLatency(20 * time.Millisecond)
+
+		store := memstore.New()
+		col := vk.NewCollector(newTestClient(t, srv), store)
+		col.SetFilters(kinds(t, database.KindFriends))
+		result, err := col.CollectUser(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Duration < 40*time.Millisecond {
+			t.Errorf("two requests took %v", result.Duration)
+		}
+		if friends := findStep(t, result, "friends"); friends.Status() != database.StepOK {
+			t.Errorf("friends: got %s: %v", friends.Status(), friends.Err)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		srv := newUserServer(t)
+		srv.SetFriends(1, []int64{2})
+		srv.SetLatency(100 * time.Millisecond)
+
+		store := memstore.New()
+		col := vk.NewCollector(newTestClient(t, srv), store)
+		col.SetFilters(kinds(t, database.KindFriends))
+
+		// The profile arrives in time, the friends do not.
+		ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+		defer cancel()
+		result, err := col.CollectUser(ctx, 1)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+		}
+		if _, ok := store.Object("vkontakte", userOwner, "user", nil); !ok {
+			t.Error("profile fetched before the deadline was not stored")
+		}
+		friends := findStep(t, result, "friends")
+		if friends.Status() != database.StepFailed || !errors.Is(friends.Err, context.DeadlineExceeded) {
+			t.Errorf("friends: got %s: %v", friends.Status(), friends.Err)
+		}
+		if vk.IsRetryable(friends.Err) {
+			t.Error("a request past the deadline is retryable")
+		}
+	})
+}
+
+func TestCollectorAlbums(t *testing.T) {
+	srv := vktest.NewServer()
+	defer srv.Close()
+	srv.AddGroup(5, map[string]interface{}{"name": "Club"})
+	srv.AddAlbum(-5, map[string]interface{}{"title": "First"})
+	srv.AddAlbum(-5, map[string]interface{}{"title": "Second"})
+	srv.AddPhoto(-5, "2", map[string]interface{}{})
+
+	store := memstore.New()
+	col := vk.NewCollector(newTestClient(t, srv), store)
+	col.SetFilters(kinds(t, database.KindPhotos))
+	if _, err := col.CollectGroup(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := database.Owner{Type: database.OwnerTypeGroup, ID: 5}
+	albums, complete := storedList(t, store, owner, database.RelationTypeAlbum)
+	if len(albums) != 2 || !complete {
+		t.Errorf("stored albums %v, complete %v, want 2 complete", albums, complete)
+	}
+	photos, ok := store.Relation("vkontakte", owner, database.RelationTypePhoto, map[string]interface{}{"album_id": 2})
+	if !ok || len(photos) != 1 {
+		t.Errorf("stored photos %v of album 2", photos)
+	}
+}
+
+// failingWriter stores into a memstore but fails the writes of one object
+// type.
+type failingWriter struct {
+	*memstore.Store
+	objectType string
+}
+
+var errWrite = errors.New("write failed")
+
+func (w failingWriter) WriteObjectContext(ctx context.Context, socialNetworkType string, owner database.Owner, objectType string, details, data map[string]interface{}) error {
+	if objectType == w.objectType {
+		return errWrite
+	}
+	return w.Store.WriteObjectContext(ctx, socialNetworkType, owner, objectType, details, data)
+}
+
+func TestCollectorWriteErrors(t *testing.T) {
+	srv := vktest.NewServer()
+	defer srv.Close()
+	srv.AddGroup(5, map[string]interface{}{"name": "Club"})
+	postID := srv.AddPost(-5, map[string]interface{}{"text": "post"})
+	srv.AddComment(-5, "post", postID, map[string]interface{}{"from_id": 7, "text": "hi"})
+	srv.AddAlbum(-5, map[string]interface{}{"title": "Album"})
+	srv.AddPhoto(-5, "1", map[string]interface{}{})
+	topicID := srv.AddTopic(5, map[string]interface{}{"title": "Topic"})
+	srv.AddComment(-5, "topic", topicID, map[string]interface{}{"from_id": 8, "text": "hello"})
+
+	tests := []struct {
+		objectType string
+		steps      []string
+	}{
+		{"post", []string{"posts"}},
+		{"comment", []string{"post.comments", "topic.comments"}},
+		{"album", []string{"albums"}},
+		{"photo", []string{"photos"}},
+		{"topic", []string{"topics"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.objectType, func(t *testing.T) {
+			col := vk.NewCollector(newTestClient(t, srv), failingWriter{memstore.New(), tt.objectType})
+			col.SetFilters(kinds(t, database.KindPosts, database.KindComments, database.KindPhotos, database.KindTopics))
+			result, err := col.CollectGroup(context.Background(), 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			failed := make(map[string]bool)
+			for _, name := range tt.steps {
+				findStep(t, result, name)
+				failed[name] = true
+			}
+			for _, step := range result.Steps {
+				if failed[step.Name] {
+					if step.Status() != database.StepFailed || step.Items != 0 || step.Err == nil || !errors.Is(step.Err.Err, errWrite) {
+						t.Errorf("%s: got %s with %d items and %v, want the write error", step.Name, step.Status(), step.Items, step.Err)
+					}
+				} else if step.Status() != database.StepOK {
+					t.Errorf("%s: got %s (%v), want ok", step.Name, step.Status(), step.Err)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectorShortPages(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups int64
+		hidden []int
+		want   int
+	}{
+		{"empty first page", 3, []int{0, 1, 2}, 0},
+		{"short middle page", 2500, []int{1000, 1001, 1500}, 2497},
+		{"short last page", 2500, []int{2499}, 2499},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newUserServer(t)
+			srv.SetUserGroups(1, ids(1, tt.groups))
+			store := memstore.New()
+			col := vk.NewCollector(newTestClient(t, srv), store)
+			col.SetFilters(kinds(t, database.KindGroups))
+			if _, err := col.CollectUser(context.Background(), 1); err != nil {
+				t.Fatal(err)
+			}
+
+			srv.HideItems("groups.get", tt.hidden...)
+			result, err := col.CollectUser(context.Background(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if step := findStep(t, result, "groups"); step.Items != tt.want {
+				t.Errorf("got %d groups, want %d", step.Items, tt.want)
+			}
+			list, complete := storedList(t, store, userOwner, database.RelationTypeGroup)
+			if len(list) != tt.want || complete {
+				t.Errorf("stored %d IDs, complete %v, want %d incomplete", len(list), complete, tt.want)
+			}
+
+			// The hidden groups were not left: a short list proves
+			// nothing about them.
+			changes, err := store.ListRelationChangesContext(context.Background(), database.RelationChangeFilter{
+				Owner:        userOwner,
+				RelationType: database.RelationTypeGroup,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, change := range changes {
+				if len(change.Removed) > 0 {
+					t.Errorf("recorded %d removals from a short list", len(change.Removed))
+				}
+			}
+		})
+	}
+}
+
+func TestCollectorEmptiedWall(t *testing.T) {
+	srv := newUserServer(t)
+	first := srv.AddPost(1, map[string]interface{}{"text": "first"})
+	second := srv.AddPost(1, map[string]interface{}{"text": "second"})
+
+	store := memstore.New()
+	col := vk.NewCollector(newTestClient(t, srv), store)
+	col.SetFilters(kinds(t, database.KindPosts))
+	if _, err := col.CollectUser(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.DeletePost(1, first)
+	srv.DeletePost(1, second)
+	if _, err := col.CollectUser(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	list, complete := storedList(t, store, userOwner, database.RelationTypePost)
+	if len(list) != 0 || !complete {
+		t.Errorf("stored %v, complete %v, want an empty complete list", list, complete)
+	}
+
+	changes, err := store.ListRelationChangesContext(context.Background(), database.RelationChangeFilter{
+		Owner:        userOwner,
+		RelationType: database.RelationTypePost,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var removed int
+	for _, change := range changes {
+		removed += len(change.Removed)
+	}
+	if removed != 2 {
+		t.Errorf("recorded %d removals, want 2", removed)
+	}
+}
+
+func TestCollectorWindowedList(t *testing.T) {
+	srv := newUserServer(t)
+	now := time.Now()
+	srv.AddPost(1, map[string]interface{}{"text": "old", "date": now.Add(-48 * time.Hour).Unix()})
+	srv.AddPost(1, map[string]interface{}{"text": "new", "date": now.Unix()})
+
+	filters, err := database.ParseTaskFilters(map[string]interface{}{
+		"kinds": []interface{}{"posts"},
+		"since": map[string]interface{}{"posts": now.Add(-24 * time.Hour).Format(time.RFC3339)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := memstore.New()
+	col := vk.NewCollector(newTestClient(t, srv), store)
+	col.SetFilters(filters)
+	if _, err := col.CollectUser(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old post is outside the range, not deleted.
+	list, complete := storedList(t, store, userOwner, database.RelationTypePost)
+	if len(list) != 1 || complete {
+		t.Errorf("stored %v, complete %v, want one post, incomplete", list, complete)
+	}
+}
+
+func TestCollectorIncrementalCursorCapped(t *testing.T) {
+	srv := newUserServer(t)
+	now := time.Now()
+	for _, age := range []time.Duration{72 * time.Hour, 60 * time.Hour, 48 * time.Hour} {
+		srv.AddPost(1, map[string]interface{}{"text": "old", "date": now.Add(-age).Unix()})
+	}
+
+	store := memstore.New()
+	col := vk.NewCollector(newTestClient(t, srv), store)
+	col.SetFilters(kinds(t, database.KindPosts))
+	col.SetMaxItems(map[string]int{"wall.get": 4})
+	col.SetIncremental(store, vk.Incremental{HotWindow: time.Hour})
+	if _, err := col.CollectUser(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.AddPost(1, map[string]interface{}{"text": "new", "date": now.Unix()})
+	srv.AddPost(1, map[string]interface{}{"text": "newer", "date": now.Unix()})
+	if _, err := col.CollectUser(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := store.GetCursorContext(context.Background(), "vkontakte", userOwner, database.KindPosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{5, 4, 3, 2}
+	if !slices.Equal(cursor.IDs, want) || cursor.Complete {
+		t.Errorf("cursor keeps %v, complete %v, want %v incomplete", cursor.IDs, cursor.Complete, want)
+	}
+	list, complete := storedList(t, store, userOwner, database.RelationTypePost)
+	if !slices.Equal(list, want) || complete {
+		t.Errorf("stored %v, complete %v, want %v incomplete", list, complete, want)
+	}
+}
@@ -0,0 +1,179 @@
+package vk
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// threadItemsCount is the number of replies wall.getComments inlines into
+// each comment. Longer threads are fetched separately.
+const threadItemsCount = 10
+
+func wallCommentsQuery(ownerID, postID int64, max int) listQuery {
+	return listQuery{
+		method: "wall.getComments",
+		params: map[string]string{
+			"owner_id":           strconv.FormatInt(ownerID, 10),
+			"post_id":            strconv.FormatInt(postID, 10),
+			"need_likes":         "1",
+			"sort":               "asc",
+			"thread_items_count": strconv.Itoa(threadItemsCount),
+		},
+		pageSize: commentsPageSize,
+		max:      max,
+	}
+}
+
+func commentThreadQuery(ownerID, postID, commentID int64, max int) listQuery {
+	return listQuery{
+		method: "wall.getComments",
+		params: map[string]string{
+			"owner_id":   strconv.FormatInt(ownerID, 10),
+			"post_id":    strconv.FormatInt(postID, 10),
+			"comment_id": strconv.FormatInt(commentID, 10),
+			"need_likes": "1",
+			"sort":       "asc",
+		},
+		pageSize: commentsPageSize,
+		max:      max,
+	}
+}
+
+// GetAllWallComments pages through the comments of a post, including the
+// replies in their threads, stopping after max comments per level when max
+// is positive.
+func (c *Client) GetAllWallComments(ctx context.Context, ownerID, postID int64, max int) (*ItemList, error) {
+	lists, errs := c.GetAllWallCommentsBatch(ctx, ownerID, []int64{postID}, max)
+	return lists[0], errs[0]
+}
+
+// GetAllWallCommentsBatch pages through the comments of many posts at once,
+// sharing execute calls between them. Replies follow the top-level
+// comments in each list. A list whose threads could not all be fetched is
+// returned incomplete together with the error.
+func (c *Client) GetAllWallCommentsBatch(ctx context.Context, ownerID int64, postIDs []int64, max int) ([]*ItemList, []error) {
+	queries := make([]listQuery, len(postIDs))
+	for i, postID := range postIDs {
+		queries[i] = wallCommentsQuery(ownerID, postID, max)
+	}
+	lists, errs := itemLists(collectLists[map[string]interface{}](ctx, c, queries))
+
+	// Threads longer than the inlined replies are fetched in one more
+	// round; threadRefs[j] is the index of the post threads[j] belongs to.
+	var threads []listQuery
+	var threadRefs []int
+	replies := make([][]map[string]interface{}, len(postIDs))
+
+	for i, list := range lists {
+		for _, comment := range list.Items {
+			thread, ok := comment["thread"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			items, _ := thread["items"].([]interface{})
+			count, _ := thread["count"].(float64)
+			// The replies are stored as comments of their own.
+			delete(thread, "items")
+
+			if int(count) > len(items) {
+				commentID, _ := comment["id"].(float64)
+				threads = append(threads, commentThreadQuery(ownerID, postIDs[i], int64(commentID), max))
+				threadRefs = append(threadRefs, i)
+				continue
+			}
+			for _, item := range items {
+				if reply, ok := item.(map[string]interface{}); ok {
+					replies[i] = append(replies[i], reply)
+				}
+			}
+		}
+	}
+
+	if len(threads) > 0 {
+		outcomes := collectLists[map[string]interface{}](ctx, c, threads)
+		for j, out := range outcomes {
+			i := threadRefs[j]
+			replies[i] = append(replies[i], out.items...)
+			if out.err != nil || !out.complete {
+				lists[i].Complete = false
+			}
+			if out.err != nil && errs[i] == nil {
+				errs[i] = fmt.Errorf("failed to get comment thread: %w", out.err)
+			}
+		}
+	}
+
+	for i := range lists {
+		lists[i].Items = append(lists[i].Items, replies[i]...)
+	}
+
+	return lists, errs
+}
+
+func photoCommentsQuery(ownerID, photoID int64, max int) listQuery {
+	return listQuery{
+		method: "photos.getComments",
+		params: map[string]string{
+			"owner_id":   strconv.FormatInt(ownerID, 10),
+			"photo_id":   strconv.FormatInt(photoID, 10),
+			"need_likes": "1",
+			"sort":       "asc",
+		},
+		pageSize: commentsPageSize,
+		max:      max,
+	}
+}
+
+// GetAllPhotoComments pages through the comments of a photo, stopping after
+// max comments when max is positive.
+func (c *Client) GetAllPhotoComments(ctx context.Context, ownerID, photoID int64, max int) (*ItemList, error) {
+	items, total, complete, err := collectList[map[string]interface{}](ctx, c, photoCommentsQuery(ownerID, photoID, max))
+	return &ItemList{Items: items, Total: total, Complete: complete}, err
+}
+
+// GetAllPhotoCommentsBatch pages through the comments of many photos at
+// once, sharing execute calls between them.
+func (c *Client) GetAllPhotoCommentsBatch(ctx context.Context, ownerID int64, photoIDs []int64, max int) ([]*ItemList, []error) {
+	queries := make([]listQuery, len(photoIDs))
+	for i, photoID := range photoIDs {
+		queries[i] = photoCommentsQuery(ownerID, photoID, max)
+	}
+
+	return itemLists(collectLists[map[string]interface{}](ctx, c, queries))
+}
+
+func albumCommentsQuery(ownerID int64, albumID string, max int) listQuery {
+	params := map[string]string{
+		"owner_id":   strconv.FormatInt(ownerID, 10),
+		"need_likes": "1",
+	}
+	if albumID != "" {
+		params["album_id"] = albumID
+	}
+
+	return listQuery{
+		method:   "photos.getAllComments",
+		params:   params,
+		pageSize: commentsPageSize,
+		max:      max,
+	}
+}
+
+// GetAllAlbumComments pages through the comments on all photos of an album
+// of ownerID, or of all its albums when albumID is empty. Each comment
+// carries the ID of its photo in "pid".
+func (c *Client) GetAllAlbumComments(ctx context.Context, ownerID int64, albumID string, max int) (*ItemList, error) {
+	items, total, complete, err := collectList[map[string]interface{}](ctx, c, albumCommentsQuery(ownerID, albumID, max))
+	return &ItemList{Items: items, Total: total, Complete: complete}, err
+}
+
+func itemLists(outcomes []listOutcome[map[string]interface{}]) ([]*ItemList, []error) {
+	lists := make([]*ItemList, len(outcomes))
+	errs := make([]error, len(outcomes))
+	for i, out := range outcomes {
+		lists[i] = &ItemList{Items: out.items, Total: out.total, Complete: out.complete}
+		errs[i] = out.err
+	}
+	return lists, errs
+}
@@ -0,0 +1,125 @@
+package vk
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrorClass tells callers how to react to a failed API call.
+type ErrorClass int
+
+const (
+	// ClassPermanent errors will fail again if the call is repeated as is.
+	ClassPermanent ErrorClass = iota
+	// ClassRetryable errors are transient; the call may succeed later.
+	ClassRetryable
+	// ClassAccountFatal errors mean the account can no longer be used.
+	ClassAccountFatal
+	// ClassTargetFatal errors mean the collected user or group is not accessible.
+	ClassTargetFatal
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassRetryable:
+		return "retryable"
+	case ClassAccountFatal:
+		return "account-fatal"
+	case ClassTargetFatal:
+		return "target-fatal"
+	default:
+		return "permanent"
+	}
+}
+
+// VK API error codes, see https://dev.vk.com/reference/errors
+const (
+	ErrorCodeUnknown            = 1
+	ErrorCodeUnknownMethod      = 3
+	ErrorCodeAuthFailed         = 5
+	ErrorCodeTooManyRequests    = 6
+	ErrorCodePermissionDenied   = 7
+	ErrorCodeFloodControl       = 9
+	ErrorCodeInternal           = 10
+	ErrorCodeCaptcha            = 14
+	ErrorCodeAccessDenied       = 15
+	ErrorCodeValidationRequired = 17
+	ErrorCodeUserDeleted        = 18
+	ErrorCodeRateLimit          = 29
+	ErrorCodePrivateProfile     = 30
+	ErrorCodeParam              = 100
+	ErrorCodeInvalidUserID      = 113
+	ErrorCodeGroupAccessDenied  = 203
+)
+
+// Sentinel errors matched by APIError.Is.
+var (
+	ErrAuthFailed      = errors.New("vk: authorization failed")
+	ErrTooManyRequests = errors.New("vk: too many requests")
+	ErrCaptcha         = errors.New("vk: captcha needed")
+	ErrPrivateProfile  = errors.New("vk: profile is private")
+	ErrUserDeleted     = errors.New("vk: user was deleted or banned")
+	ErrAccessDenied    = errors.New("vk: access denied")
+)
+
+type errorInfo struct {
+	class    ErrorClass
+	sentinel error
+	// cooldown is how long the account should rest before it is used again.
+	cooldown time.Duration
+}
+
+var errorTable = map[int]errorInfo{
+	ErrorCodeUnknown:            {class: ClassRetryable},
+	ErrorCodeInternal:           {class: ClassRetryable},
+	ErrorCodeAuthFailed:         {class: ClassAccountFatal, sentinel: ErrAuthFailed},
+	ErrorCodeValidationRequired: {class: ClassAccountFatal, sentinel: ErrAuthFailed},
+	ErrorCodeTooManyRequests:    {class: ClassRetryable, sentinel: ErrTooManyRequests},
+	ErrorCodeFloodControl:       {class: ClassRetryable, sentinel: ErrTooManyRequests, cooldown: 30 * time.Minute},
+	ErrorCodeRateLimit:          {class: ClassRetryable, sentinel: ErrTooManyRequests, cooldown: 24 * time.Hour},
+	ErrorCodeCaptcha:            {class: ClassRetryable, sentinel: ErrCaptcha, cooldown: time.Hour},
+	ErrorCodeUserDeleted:        {class: ClassTargetFatal, sentinel: ErrUserDeleted},
+	ErrorCodePrivateProfile:     {class: ClassTargetFatal, sentinel: ErrPrivateProfile},
+	ErrorCodeAccessDenied:       {class: ClassTargetFatal, sentinel: ErrAccessDenied},
+	ErrorCodeGroupAccessDenied:  {class: ClassTargetFatal, sentinel: ErrAccessDenied},
+	ErrorCodeInvalidUserID:      {class: ClassTargetFatal, sentinel: ErrUserDeleted},
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("VK API error %d: %s", e.ErrorCode, e.ErrorMsg)
+}
+
+// Is reports whether the error belongs to the family of target, so that
+// errors.Is(err, ErrTooManyRequests) matches codes 6, 9 and 29.
+func (e *APIError) Is(target error) bool {
+	if t, ok := target.(*APIError); ok {
+		return t.ErrorCode == e.ErrorCode
+	}
+	info, ok := errorTable[e.ErrorCode]
+	return ok && info.sentinel != nil && info.sentinel == target
+}
+
+// Class returns the classification of the error code.
+func (e *APIError) Class() ErrorClass {
+	if info, ok := errorTable[e.ErrorCode]; ok {
+		return info.class
+	}
+	return ClassPermanent
+}
+
+// Cooldown returns how long the account that got this error should not be
+// used. Zero means the account can be used right away.
+func (e *APIError) Cooldown() time.Duration {
+	return errorTable[e.ErrorCode].cooldown
+}
+
+// ClassOf returns the class of the first APIError in err's chain. Errors that
+// are not API errors are treated as permanent.
+func ClassOf(err error) ErrorClass {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Class()
+	}
+	return ClassPermanent
+}
@@ -0,0 +1,144 @@
+package vk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// maxExecuteCalls is the number of API calls VK allows in one execute.
+	maxExecuteCalls = 25
+	// usersPerCall is the number of IDs users.get accepts in one call.
+	usersPerCall = 1000
+)
+
+// Request is a single API method call.
+type Request struct {
+	Method string
+	Params map[string]string
+}
+
+// Result is the outcome of one Request sent through Batch.
+type Result struct {
+	Response json.RawMessage
+	Err      error
+}
+
+// Batch sends requests packed into execute calls of up to 25 method calls
+// each and returns one Result per request, in order. A single request is
+// sent as a plain call. The returned error is only set when a whole execute
+// call fails; errors of individual calls are reported in Result.Err.
+func (c *Client) Batch(ctx context.Context, requests []Request) ([]Result, error) {
+	if len(requests) == 1 {
+		resp, err := c.CallContext(ctx, requests[0].Method, requests[0].Params)
+		return []Result{{Response: resp, Err: err}}, nil
+	}
+
+	results := make([]Result, 0, len(requests))
+	for start := 0; start < len(requests); start += maxExecuteCalls {
+		end := start + maxExecuteCalls
+		if end > len(requests) {
+			end = len(requests)
+		}
+
+		chunk, err := c.execute(ctx, requests[start:end])
+		if err != nil {
+			return results, err
+		}
+		results = append(results, chunk...)
+	}
+
+	return results, nil
+}
+
+func (c *Client) execute(ctx context.Context, requests []Request) ([]Result, error) {
+	code, err := executeScript(requests)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := make([]string, len(requests))
+	for i, req := range requests {
+		methods[i] = req.Method
+	}
+	if err := c.limiter.waitMethods(ctx, methods...); err != nil {
+		return nil, err
+	}
+
+	apiResp, err := c.do(ctx, "execute", map[string]string{"code": code})
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []json.RawMessage
+	if err := json.Unmarshal(apiResp.Response, &responses); err != nil {
+		return nil, fmt.Errorf("failed to decode execute response: %w", err)
+	}
+	if len(responses) != len(requests) {
+		return nil, fmt.Errorf("execute returned %d results for %d calls", len(responses), len(requests))
+	}
+
+	// A failed call yields false in the response array, and its error is
+	// appended to execute_errors in call order.
+	executeErrors := apiResp.ExecuteErrors
+	results := make([]Result, len(requests))
+	for i, resp := range responses {
+		if !bytes.Equal(bytes.TrimSpace(resp), []byte("false")) {
+			results[i].Response = resp
+			continue
+		}
+
+		apiErr := &APIError{
+			Method:    requests[i].Method,
+			ErrorCode: ErrorCodeUnknown,
+			ErrorMsg:  "call failed inside execute",
+		}
+		if len(executeErrors) > 0 {
+			e := executeErrors[0]
+			executeErrors = executeErrors[1:]
+			apiErr = &e
+		}
+		if errors.Is(apiErr, ErrTooManyRequests) {
+			c.limiter.Backoff()
+		}
+		results[i].Err = apiErr
+	}
+
+	return results, nil
+}
+
+// executeScript generates the VKScript that runs requests and returns their
+// responses as an array.
+func executeScript(requests []Request) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("return [")
+
+	for i, req := range requests {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+
+		// encoding/json sorts map keys, so the generated script is
+		// deterministic.
+		params := req.Params
+		if params == nil {
+			params = map[string]string{}
+		}
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			return "", err
+		}
+
+		buf.WriteString("API.")
+		buf.WriteString(req.Method)
+		buf.WriteString("(")
+		buf.Write(encoded)
+		buf.WriteString(")")
+	}
+
+	buf.WriteString("];")
+	return buf.String(), nil
+}
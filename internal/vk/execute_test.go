@@ -0,0 +1,208 @@
+package vk_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Nakray/sn/internal/vk"
+	"github.com/Nakray/sn/internal/vk/vktest"
+)
+
+// newTestClient returns a client of srv that is not slowed down by the
+// default rate limit and retries without noticeable delays.
+func newTestClient(t *testing.T, srv *vktest.Server, opts ...vk.Option) *vk.Client {
+	t.Helper()
+
+	opts = append([]vk.Option{
+		vk.WithEndpoint(srv.Endpoint()),
+		vk.WithLimiters(vk.NewLimiterRegistry(vk.RateLimits{RequestsPerSecond: 10000, Burst: 1000})),
+		vk.WithRetryPolicy(vk.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}),
+	}, opts...)
+	client, err := vk.NewClient("token", nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestExecuteScript(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []vk.Request
+		want     string
+	}{
+		{
+			name:     "single call",
+			requests: []vk.Request{{Method: "users.get", Params: map[string]string{"user_ids": "1"}}},
+			want:     `return [API.users.get({"user_ids":"1"})];`,
+		},
+		{
+			name: "params are sorted",
+			requests: []vk.Request{
+				{Method: "friends.get", Params: map[string]string{"user_id": "1", "offset": "0", "count": "5000"}},
+				{Method: "groups.get", Params: map[string]string{"user_id": "1"}},
+			},
+			want: `return [API.friends.get({"count":"5000","offset":"0","user_id":"1"}),API.groups.get({"user_id":"1"})];`,
+		},
+		{
+			name:     "nil params",
+			requests: []vk.Request{{Method: "photos.getAlbums"}},
+			want:     `return [API.photos.getAlbums({})];`,
+		},
+		{
+			name:     "quotes are escaped",
+			requests: []vk.Request{{Method: "wall.search", Params: map[string]string{"query": `a "b"`}}},
+			want:     `return [API.wall.search({"query":"a \"b\""})];`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := vk.ExecuteScript(tt.requests)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchSplitsExecuteErrors(t *testing.T) {
+	srv := vktest.NewServer()
+	defer srv.Close()
+	srv.SetFriends(1, []int64{10, 11})
+	srv.SetFriends(2, []int64{20})
+	srv.SetPrivate(2)
+	srv.SetFriends(3, []int64{30})
+
+	client := newTestClient(t, srv)
+	requests := []vk.Request{
+		{Method: "friends.get", Params: map[string]string{"user_id": "1"}},
+		{Method: "friends.get", Params: map[string]string{"user_id": "2"}},
+		{Method: "friends.get", Params: map[string]string{"user_id": "3"}},
+	}
+	results, err := client.Batch(context.Background(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(requests) {
+		t.Fatalf("got %d results for %d requests", len(results), len(requests))
+	}
+	if n := srv.Calls("execute"); n != 1 {
+		t.Errorf("sent %d execute calls, want 1", n)
+	}
+
+	for _, i := range []int{0, 2} {
+		if results[i].Err != nil {
+			t.Fatalf("result %d: %v", i, results[i].Err)
+		}
+		var list struct{ Count int }
+		if err := json.Unmarshal(results[i].Response, &list); err != nil {
+			t.Fatalf("result %d: %v", i, err)
+		}
+	}
+
+	var apiErr *vk.APIError
+	if !errors.As(results[1].Err, &apiErr) {
+		t.Fatalf("result 1: got %v, want an *APIError", results[1].Err)
+	}
+	if apiErr.ErrorCode != vk.ErrorCodePrivateProfile || apiErr.Method != "friends.get" {
+		t.Errorf("result 1: got error %d of %q, want %d of friends.get", apiErr.ErrorCode, apiErr.Method, vk.ErrorCodePrivateProfile)
+	}
+	if !errors.Is(results[1].Err, vk.ErrPrivateProfile) || vk.ClassOf(results[1].Err) != vk.ClassTargetFatal {
+		t.Errorf("result 1: %v is not a target-fatal private profile error", results[1].Err)
+	}
+}
+
+func TestBatchErrorsFollowCallOrder(t *testing.T) {
+	srv := vktest.NewServer()
+	defer srv.Close()
+	srv.SetFriends(1, []int64{10})
+	srv.SetPrivate(2)
+	srv.InjectError("groups.get", vk.ErrorCodeAccessDenied, 1)
+
+	client := newTestClient(t, srv)
+	results, err := client.Batch(context.Background(), []vk.Request{
+		{Method: "friends.get", Params: map[string]string{"user_id": "2"}},
+		{Method: "friends.get", Params: map[string]string{"user_id": "1"}},
+		{Method: "groups.get", Params: map[string]string{"user_id": "1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantCodes := []int{vk.ErrorCodePrivateProfile, 0, vk.ErrorCodeAccessDenied}
+	for i, want := range wantCodes {
+		var apiErr *vk.APIError
+		switch {
+		case want == 0 && results[i].Err != nil:
+			t.Errorf("result %d: unexpected error %v", i, results[i].Err)
+		case want != 0 && !errors.As(results[i].Err, &apiErr):
+			t.Errorf("result %d: got %v, want error %d", i, results[i].Err, want)
+		case want != 0 && apiErr.ErrorCode != want:
+			t.Errorf("result %d: got error %d, want %d", i, apiErr.ErrorCode, want)
+		}
+	}
+}
+
+func TestBatchChunksExecuteCalls(t *testing.T) {
+	srv := vktest.NewServer()
+	defer srv.Close()
+
+	var requests []vk.Request
+	for id := int64(1); id <= 30; id++ {
+		srv.SetFriends(id, []int64{id * 100})
+		requests = append(requests, vk.Request{
+			Method: "friends.get",
+			Params: map[string]string{"user_id": strconv.FormatInt(id, 10)},
+		})
+	}
+
+	client := newTestClient(t, srv)
+	results, err := client.Batch(context.Background(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("execute"); n != 2 {
+		t.Errorf("sent %d execute calls for 30 requests, want 2", n)
+	}
+	if len(results) != len(requests) {
+		t.Fatalf("got %d results for %d requests", len(results), len(requests))
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Fatalf("result %d: %v", i, result.Err)
+		}
+		var list struct{ Items []int64 }
+		if err := json.Unmarshal(result.Response, &list); err != nil {
+			t.Fatalf("result %d: %v", i, err)
+		}
+		if want := int64(i+1) * 100; len(list.Items) != 1 || list.Items[0] != want {
+			t.Errorf("result %d: got %v, want [%d]", i, list.Items, want)
+		}
+	}
+}
+
+func TestBatchFailsWithExecute(t *testing.T) {
+	srv := vktest.NewServer()
+	defer srv.Close()
+	srv.InjectError("execute", vk.ErrorCodeAuthFailed, 1)
+
+	client := newTestClient(t, srv)
+	_, err := client.Batch(context.Background(), []vk.Request{
+		{Method: "friends.get", Params: map[string]string{"user_id": "1"}},
+		{Method: "friends.get", Params: map[string]string{"user_id": "2"}},
+	})
+	if !errors.Is(err, vk.ErrAuthFailed) {
+		t.Fatalf("got %v, want %v", err, vk.ErrAuthFailed)
+	}
+	if n := srv.Calls("friends.get"); n != 0 {
+		t.Errorf("ran %d calls of a failed execute", n)
+	}
+}
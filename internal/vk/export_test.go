@@ -0,0 +1,5 @@
+package vk
+
+// ExecuteScript is exported for the tests in package vk_test, which use
+// vktest and so cannot live in package vk.
+var ExecuteScript = executeScript
@@ -0,0 +1,194 @@
+package vk
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Nakray/sn/internal/database"
+)
+
+// Incremental configures incremental collection of walls. Between full
+// syncs only posts newer than the cursor and posts inside the hot window
+// are fetched, and only the latter get their likes and comments refreshed.
+type Incremental struct {
+	// HotWindow is how far back likes and comments are refreshed.
+	HotWindow time.Duration
+	// FullSyncInterval is how often the whole wall is fetched again, which
+	// is when deleted posts are noticed.
+	FullSyncInterval time.Duration
+}
+
+var DefaultIncremental = Incremental{
+	HotWindow:        72 * time.Hour,
+	FullSyncInterval: 24 * time.Hour,
+}
+
+// SetIncremental enables incremental collection, keeping cursors in
+// cursors. Zero fields of opts take their value from DefaultIncremental.
+func (col *Collector) SetIncremental(cursors database.CursorStore, opts Incremental) {
+	if opts.HotWindow <= 0 {
+		opts.HotWindow = DefaultIncremental.HotWindow
+	}
+	if opts.FullSyncInterval <= 0 {
+		opts.FullSyncInterval = DefaultIncremental.FullSyncInterval
+	}
+	col.cursors = cursors
+	col.incremental = opts
+}
+
+// wallCursor returns the cursor of the wall of owner if the next run can
+// be incremental, or nil if the whole wall has to be fetched.
+func (col *Collector) wallCursor(ctx context.Context, owner database.Owner) *database.Cursor {
+	if col.cursors == nil {
+		return nil
+	}
+
+	cursor, err := col.cursors.GetCursorContext(ctx, "vkontakte", owner, database.KindPosts)
+	if err != nil {
+		if !errors.Is(err, database.ErrCursorNotFound) {
+			log.Printf("Failed to load wall cursor of %s %d: %v\n", owner.Type, owner.ID, err)
+		}
+		return nil
+	}
+	if time.Since(cursor.LastFullSync) >= col.incremental.FullSyncInterval {
+		return nil
+	}
+	return cursor
+}
+
+// saveWallCursor records the posts written by a full sync of the wall.
+func (col *Collector) saveWallCursor(ctx context.Context, owner database.Owner, posts []map[string]interface{}, postIDs []int64, complete bool) {
+	if col.cursors == nil {
+		return
+	}
+
+	cursor := &database.Cursor{
+		SocialNetworkType: "vkontakte",
+		Owner:             owner,
+		Kind:              database.KindPosts,
+		IDs:               postIDs,
+		Complete:          complete,
+		LastFullSync:      time.Now(),
+	}
+	advanceCursor(cursor, posts)
+
+	if err := col.cursors.SaveCursorContext(ctx, cursor); err != nil {
+		log.Printf("Failed to save wall cursor of %s %d: %v\n", owner.Type, owner.ID, err)
+	}
+}
+
+// advanceCursor moves the newest post of cursor forward to the newest of
+// posts. Pinned posts are ignored, as their position says nothing about
+// their age.
+func advanceCursor(cursor *database.Cursor, posts []map[string]interface{}) {
+	for _, post := range posts {
+		if pinned, _ := post["is_pinned"].(float64); pinned != 0 {
+			continue
+		}
+		id, _ := post["id"].(float64)
+		if int64(id) <= cursor.NewestID {
+			continue
+		}
+		cursor.NewestID = int64(id)
+		if date, ok := post["date"].(float64); ok {
+			cursor.NewestDate = time.Unix(int64(date), 0)
+		}
+	}
+}
+
+// collectWallSince fetches the posts published since the cursor or inside
+// the hot window, whichever reaches further back, and merges them into the
+// post list of the cursor, keeping at most as many posts as a full sync.
+func (col *Collector) collectWallSince(ctx context.Context, owner database.Owner, vkOwnerID int64, cursor *database.Cursor) {
+	wctx := context.WithoutCancel(ctx)
+
+	hotStart := time.Now().Add(-col.incremental.HotWindow)
+	since := hotStart
+	if cursor.NewestDate.Before(since) {
+		since = cursor.NewestDate
+	}
+	if filterSince, _ := col.window(database.KindPosts); filterSince.After(since) {
+		since = filterSince
+	}
+
+	posts, err := col.client.GetAllWallPostsSince(ctx, vkOwnerID, since, col.limit(database.KindPosts, "wall.get"))
+	if err != nil {
+		log.Printf("Failed to get new wall posts for %s %d: %v\n", owner.Type, owner.ID, err)
+		col.step("posts", 0, err)
+		return
+	}
+	kept := col.inWindow(database.KindPosts, "date", posts.Items)
+
+	var fetchedIDs, refreshIDs []int64
+	var stored int
+	var writeErr error
+	// oldestID is the oldest post fetched; known posts newer than it that
+	// were not fetched again have been deleted.
+	var oldestID int64
+	fetched := make(map[int64]bool)
+	for _, post := range kept {
+		id, ok := post["id"].(float64)
+		if !ok {
+			continue
+		}
+		postID := int64(id)
+		fetchedIDs = append(fetchedIDs, postID)
+		fetched[postID] = true
+		if err := col.db.WriteObjectContext(wctx, "vkontakte", owner, "post", map[string]interface{}{"id": postID}, post); err != nil {
+			log.Printf("Failed to save post %d: %v\n", postID, err)
+			if writeErr == nil {
+				writeErr = err
+			}
+		} else {
+			stored++
+		}
+
+		date, _ := post["date"].(float64)
+		if postID > cursor.NewestID || !time.Unix(int64(date), 0).Before(hotStart) {
+			refreshIDs = append(refreshIDs, postID)
+		}
+		if pinned, _ := post["is_pinned"].(float64); pinned == 0 && (oldestID == 0 || postID < oldestID) {
+			oldestID = postID
+		}
+	}
+
+	postIDs := fetchedIDs
+	for _, id := range cursor.IDs {
+		if fetched[id] || (oldestID != 0 && id > oldestID) {
+			continue
+		}
+		postIDs = append(postIDs, id)
+	}
+
+	complete := cursor.Complete && posts.Complete
+	// The list is capped like a full sync would cap it, so the cursor does
+	// not grow between full syncs. The oldest posts drop out of it.
+	if max := col.limit(database.KindPosts, "wall.get"); max > 0 && len(postIDs) > max {
+		postIDs = postIDs[:max]
+		complete = false
+	}
+	listComplete := complete && !col.windowed(database.KindPosts)
+	if err := col.db.WriteRelationsContext(wctx, "vkontakte", owner, database.RelationTypePost, withCompleteness(nil, listComplete), postIDs); err != nil {
+		log.Printf("Failed to save posts: %v\n", err)
+		col.step("posts", stored, err)
+		return
+	}
+	col.step("posts", stored, writeErr)
+
+	col.collectLikes(ctx, owner, vkOwnerID, "post", refreshIDs)
+	col.collectComments(ctx, owner, vkOwnerID, "post", refreshIDs)
+
+	cursor.IDs = postIDs
+	cursor.Complete = complete
+	advanceCursor(cursor, kept)
+	if !posts.Complete {
+		// The item cap left a gap between the new posts and the known
+		// ones; the next run fills it with a full sync.
+		cursor.LastFullSync = time.Time{}
+	}
+	if err := col.cursors.SaveCursorContext(wctx, cursor); err != nil {
+		log.Printf("Failed to save wall cursor of %s %d: %v\n", owner.Type, owner.ID, err)
+	}
+}
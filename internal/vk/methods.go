@@ -1,8 +1,10 @@
 package vk
 
 import (
+	"context"
 	"encoding/json"
 	"strconv"
+	"time"
 )
 
 type WallPost struct {
@@ -15,22 +17,31 @@ type WallPost struct {
 	Likes    map[string]interface{} `json:"likes"`
 }
 
-func (c *Client) GetWallPosts(ownerID int64, count int) ([]map[string]interface{}, error) {
-	params := map[string]string{
-		"owner_id": strconv.FormatInt(ownerID, 10),
-		"count":    strconv.Itoa(count),
-		"filter":   "all",
+// listResponse is the common shape of VK list responses.
+type listResponse[T any] struct {
+	Count int `json:"count"`
+	// CurrentLevelCount is set by comment lists, whose Count includes
+	// replies in threads.
+	CurrentLevelCount *int `json:"current_level_count"`
+	Items             []T  `json:"items"`
+}
+
+// total returns the number of items that can be paged through.
+func (r listResponse[T]) total() int {
+	if r.CurrentLevelCount != nil {
+		return *r.CurrentLevelCount
 	}
+	return r.Count
+}
 
-	resp, err := c.Call("wall.get", params)
+// callList sends a single list request and returns its items.
+func callList[T any](ctx context.Context, c *Client, req Request) ([]T, error) {
+	resp, err := c.CallContext(ctx, req.Method, req.Params)
 	if err != nil {
 		return nil, err
 	}
 
-	var result struct {
-		Items []map[string]interface{} `json:"items"`
-	}
-
+	var result listResponse[T]
 	if err := json.Unmarshal(resp, &result); err != nil {
 		return nil, err
 	}
@@ -38,115 +49,205 @@ func (c *Client) GetWallPosts(ownerID int64, count int) ([]map[string]interface{
 	return result.Items, nil
 }
 
-func (c *Client) GetPhotos(ownerID int64, albumID string, count int) ([]map[string]interface{}, error) {
-	params := map[string]string{
-		"owner_id":  strconv.FormatInt(ownerID, 10),
-		"album_id":  albumID,
-		"count":     strconv.Itoa(count),
-		"photo_sizes": "1",
+func wallQuery(ownerID int64, max int) listQuery {
+	return listQuery{
+		method: "wall.get",
+		params: map[string]string{
+			"owner_id": strconv.FormatInt(ownerID, 10),
+			"filter":   "all",
+		},
+		pageSize: wallPageSize,
+		max:      max,
 	}
+}
 
-	resp, err := c.Call("photos.get", params)
-	if err != nil {
-		return nil, err
-	}
+func (c *Client) GetWallPosts(ctx context.Context, ownerID int64, count int) ([]map[string]interface{}, error) {
+	return callList[map[string]interface{}](ctx, c, wallQuery(ownerID, 0).page(0, count))
+}
 
-	var result struct {
-		Items []map[string]interface{} `json:"items"`
-	}
+// GetAllWallPosts pages through the wall of ownerID, stopping after max
+// posts when max is positive.
+func (c *Client) GetAllWallPosts(ctx context.Context, ownerID int64, max int) (*ItemList, error) {
+	items, total, complete, err := collectList[map[string]interface{}](ctx, c, wallQuery(ownerID, max))
+	return &ItemList{Items: items, Total: total, Complete: complete}, err
+}
 
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, err
+func photosQuery(ownerID int64, albumID string, max int) listQuery {
+	return listQuery{
+		method: "photos.get",
+		params: map[string]string{
+			"owner_id":    strconv.FormatInt(ownerID, 10),
+			"album_id":    albumID,
+			"photo_sizes": "1",
+		},
+		pageSize: photosPageSize,
+		max:      max,
 	}
+}
 
-	return result.Items, nil
+func (c *Client) GetPhotos(ctx context.Context, ownerID int64, albumID string, count int) ([]map[string]interface{}, error) {
+	return callList[map[string]interface{}](ctx, c, photosQuery(ownerID, albumID, 0).page(0, count))
 }
 
-func (c *Client) GetPhotoAlbums(ownerID int64) ([]map[string]interface{}, error) {
+// GetAllPhotos pages through an album of ownerID, stopping after max photos
+// when max is positive.
+func (c *Client) GetAllPhotos(ctx context.Context, ownerID int64, albumID string, max int) (*ItemList, error) {
+	items, total, complete, err := collectList[map[string]interface{}](ctx, c, photosQuery(ownerID, albumID, max))
+	return &ItemList{Items: items, Total: total, Complete: complete}, err
+}
+
+// GetPhotoAlbums returns all albums of ownerID, including the system
+// albums (wall, profile and saved photos), which have negative IDs. The
+// albums come in a single response; the list is incomplete when it holds
+// fewer albums than VK counts.
+func (c *Client) GetPhotoAlbums(ctx context.Context, ownerID int64) (*ItemList, error) {
 	params := map[string]string{
-		"owner_id": strconv.FormatInt(ownerID, 10),
+		"owner_id":    strconv.FormatInt(ownerID, 10),
+		"need_system": "1",
 	}
 
-	resp, err := c.Call("photos.getAlbums", params)
+	resp, err := c.CallContext(ctx, "photos.getAlbums", params)
 	if err != nil {
 		return nil, err
 	}
 
-	var result struct {
-		Items []map[string]interface{} `json:"items"`
-	}
-
+	var result listResponse[map[string]interface{}]
 	if err := json.Unmarshal(resp, &result); err != nil {
 		return nil, err
 	}
 
-	return result.Items, nil
+	total := result.total()
+	return &ItemList{Items: result.Items, Total: total, Complete: len(result.Items) >= total}, nil
 }
 
-func (c *Client) GetFollowers(userID int64, count int) ([]int64, error) {
-	params := map[string]string{
-		"user_id": strconv.FormatInt(userID, 10),
-		"count":   strconv.Itoa(count),
+func followersQuery(userID int64, max int) listQuery {
+	return listQuery{
+		method:   "users.getFollowers",
+		params:   map[string]string{"user_id": strconv.FormatInt(userID, 10)},
+		pageSize: followersPageSize,
+		max:      max,
 	}
+}
 
-	resp, err := c.Call("users.getFollowers", params)
-	if err != nil {
-		return nil, err
-	}
+func (c *Client) GetFollowers(ctx context.Context, userID int64, count int) ([]int64, error) {
+	return callList[int64](ctx, c, followersQuery(userID, 0).page(0, count))
+}
 
-	var result struct {
-		Items []int64 `json:"items"`
-	}
+// GetAllFollowers pages through the followers of userID, stopping after max
+// IDs when max is positive.
+func (c *Client) GetAllFollowers(ctx context.Context, userID int64, max int) (*IDList, error) {
+	ids, total, complete, err := collectList[int64](ctx, c, followersQuery(userID, max))
+	return &IDList{IDs: ids, Total: total, Complete: complete}, err
+}
 
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, err
+func groupMembersQuery(groupID int64, max int) listQuery {
+	return listQuery{
+		method:   "groups.getMembers",
+		params:   map[string]string{"group_id": strconv.FormatInt(groupID, 10)},
+		pageSize: membersPageSize,
+		max:      max,
 	}
-
-	return result.Items, nil
 }
 
-func (c *Client) GetGroupMembers(groupID int64, count int) ([]int64, error) {
-	params := map[string]string{
-		"group_id": strconv.FormatInt(groupID, 10),
-		"count":    strconv.Itoa(count),
-	}
+func (c *Client) GetGroupMembers(ctx context.Context, groupID int64, count int) ([]int64, error) {
+	return callList[int64](ctx, c, groupMembersQuery(groupID, 0).page(0, count))
+}
 
-	resp, err := c.Call("groups.getMembers", params)
-	if err != nil {
-		return nil, err
-	}
+// GetAllGroupMembers pages through the members of groupID, stopping after
+// max IDs when max is positive.
+func (c *Client) GetAllGroupMembers(ctx context.Context, groupID int64, max int) (*IDList, error) {
+	ids, total, complete, err := collectList[int64](ctx, c, groupMembersQuery(groupID, max))
+	return &IDList{IDs: ids, Total: total, Complete: complete}, err
+}
 
-	var result struct {
-		Items []int64 `json:"items"`
+func likesQuery(ownerID int64, itemID int64, itemType string, max int) listQuery {
+	return listQuery{
+		method: "likes.getList",
+		params: map[string]string{
+			"owner_id": strconv.FormatInt(ownerID, 10),
+			"item_id":  strconv.FormatInt(itemID, 10),
+			"type":     itemType,
+		},
+		pageSize: likesPageSize,
+		max:      max,
 	}
+}
 
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, err
-	}
+func (c *Client) GetLikes(ctx context.Context, ownerID int64, itemID int64, itemType string, count int) ([]int64, error) {
+	return callList[int64](ctx, c, likesQuery(ownerID, itemID, itemType, 0).page(0, count))
+}
 
-	return result.Items, nil
+// GetAllLikes pages through the likes of an item, stopping after max IDs
+// when max is positive.
+func (c *Client) GetAllLikes(ctx context.Context, ownerID int64, itemID int64, itemType string, max int) (*IDList, error) {
+	ids, total, complete, err := collectList[int64](ctx, c, likesQuery(ownerID, itemID, itemType, max))
+	return &IDList{IDs: ids, Total: total, Complete: complete}, err
 }
 
-func (c *Client) GetLikes(ownerID int64, itemID int64, itemType string, count int) ([]int64, error) {
-	params := map[string]string{
-		"owner_id": strconv.FormatInt(ownerID, 10),
-		"item_id":  strconv.FormatInt(itemID, 10),
-		"type":     itemType,
-		"count":    strconv.Itoa(count),
+// GetAllLikesBatch pages through the likes of many items of the same type
+// at once, sharing execute calls between them. It returns one list and one
+// error per item.
+func (c *Client) GetAllLikesBatch(ctx context.Context, ownerID int64, itemIDs []int64, itemType string, max int) ([]*IDList, []error) {
+	queries := make([]listQuery, len(itemIDs))
+	for i, itemID := range itemIDs {
+		queries[i] = likesQuery(ownerID, itemID, itemType, max)
 	}
 
-	resp, err := c.Call("likes.getList", params)
-	if err != nil {
-		return nil, err
-	}
+	return idLists(collectLists[int64](ctx, c, queries))
+}
 
-	var result struct {
-		Items []int64 `json:"items"`
+func idLists(outcomes []listOutcome[int64]) ([]*IDList, []error) {
+	lists := make([]*IDList, len(outcomes))
+	errs := make([]error, len(outcomes))
+	for i, out := range outcomes {
+		lists[i] = &IDList{IDs: out.items, Total: out.total, Complete: out.complete}
+		errs[i] = out.err
 	}
+	return lists, errs
+}
 
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, err
+// GetAllWallPostsSince pages through the wall of ownerID from the newest
+// post back to since, stopping after max posts when max is positive. Pinned
+// posts are returned regardless of their date. The list is complete when
+// every post since then was fetched.
+func (c *Client) GetAllWallPostsSince(ctx context.Context, ownerID int64, since time.Time, max int) (*ItemList, error) {
+	q := wallQuery(ownerID, max)
+	list := &ItemList{}
+
+	for offset := 0; ; offset += q.pageSize {
+		req := q.page(offset, q.pageSize)
+		resp, err := c.CallContext(ctx, req.Method, req.Params)
+		if err != nil {
+			return list, err
+		}
+
+		var page listResponse[map[string]interface{}]
+		if err := json.Unmarshal(resp, &page); err != nil {
+			return list, err
+		}
+		list.Total = page.total()
+
+		for _, post := range page.Items {
+			date, _ := post["date"].(float64)
+			pinned, _ := post["is_pinned"].(float64)
+			if pinned == 0 && time.Unix(int64(date), 0).Before(since) {
+				list.Complete = true
+				return list, nil
+			}
+			if max > 0 && len(list.Items) >= max {
+				return list, nil
+			}
+			list.Items = append(list.Items, post)
+		}
+
+		if offset+len(page.Items) >= list.Total {
+			list.Complete = true
+			return list, nil
+		}
+		// An empty page before the end of the wall leaves the rest
+		// unknown.
+		if len(page.Items) == 0 {
+			return list, nil
+		}
 	}
-
-	return result.Items, nil
 }
@@ -0,0 +1,162 @@
+package vk
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+// Maximum page sizes accepted by the VK API for each list method.
+const (
+	wallPageSize      = 100
+	photosPageSize    = 1000
+	followersPageSize = 1000
+	membersPageSize   = 1000
+	likesPageSize     = 1000
+	friendsPageSize   = 5000
+	groupsPageSize    = 1000
+	commentsPageSize  = 100
+	topicsPageSize    = 100
+)
+
+// IDList is a fully paginated list of IDs.
+type IDList struct {
+	IDs   []int64
+	Total int
+	// Complete is false when the list was cut short by the item cap.
+	Complete bool
+}
+
+// ItemList is a fully paginated list of objects.
+type ItemList struct {
+	Items []map[string]interface{}
+	Total int
+	// Complete is false when the list was cut short by the item cap.
+	Complete bool
+}
+
+// listQuery describes one paginated list. Params must not contain offset
+// or count.
+type listQuery struct {
+	method   string
+	params   map[string]string
+	pageSize int
+	// max caps the number of collected items; zero or less means no cap.
+	max int
+}
+
+func (q listQuery) page(offset, count int) Request {
+	params := make(map[string]string, len(q.params)+2)
+	for k, v := range q.params {
+		params[k] = v
+	}
+	params["offset"] = strconv.Itoa(offset)
+	params["count"] = strconv.Itoa(count)
+	return Request{Method: q.method, Params: params}
+}
+
+// limit returns how many items of a list with the given total to fetch.
+func (q listQuery) limit(total int) int {
+	if q.max > 0 && q.max < total {
+		return q.max
+	}
+	return total
+}
+
+type listOutcome[T any] struct {
+	items    []T
+	total    int
+	complete bool
+	err      error
+}
+
+// collectLists pages through several lists at once. The first pages of all
+// lists are fetched in one batch; once the totals are known, all remaining
+// pages are requested together, 25 per execute call. A list is complete
+// when it is not capped and as many items came back as its count promised:
+// pages cut short by deleted or hidden items leave it incomplete.
+func collectLists[T any](ctx context.Context, c *Client, queries []listQuery) []listOutcome[T] {
+	outcomes := make([]listOutcome[T], len(queries))
+
+	first := make([]Request, len(queries))
+	for i, q := range queries {
+		first[i] = q.page(0, q.limit(q.pageSize))
+	}
+
+	// Batch returns the results of the execute calls that succeeded before
+	// a failing one; lists without a result share its error.
+	results, err := c.Batch(ctx, first)
+	for i := len(results); i < len(outcomes); i++ {
+		outcomes[i].err = err
+	}
+
+	// refs[j] is the index of the query that pages[j] belongs to.
+	var pages []Request
+	var refs []int
+
+	for i, result := range results {
+		var resp listResponse[T]
+		if result.Err == nil {
+			result.Err = json.Unmarshal(result.Response, &resp)
+		}
+		if result.Err != nil {
+			outcomes[i].err = result.Err
+			continue
+		}
+
+		total := resp.total()
+		outcomes[i].items = resp.Items
+		outcomes[i].total = total
+		if len(resp.Items) == 0 {
+			continue
+		}
+
+		q := queries[i]
+		target := q.limit(total)
+		for offset := len(resp.Items); offset < target; offset += q.pageSize {
+			count := q.pageSize
+			if target-offset < count {
+				count = target - offset
+			}
+			pages = append(pages, q.page(offset, count))
+			refs = append(refs, i)
+		}
+	}
+
+	if len(pages) > 0 {
+		results, err = c.Batch(ctx, pages)
+		for j, ref := range refs {
+			out := &outcomes[ref]
+			if out.err != nil {
+				continue
+			}
+			if j >= len(results) {
+				out.err = err
+				continue
+			}
+
+			var resp listResponse[T]
+			pageErr := results[j].Err
+			if pageErr == nil {
+				pageErr = json.Unmarshal(results[j].Response, &resp)
+			}
+			if pageErr != nil {
+				out.err = pageErr
+				continue
+			}
+			out.items = append(out.items, resp.Items...)
+		}
+	}
+
+	for i := range outcomes {
+		out := &outcomes[i]
+		out.complete = out.err == nil && queries[i].limit(out.total) == out.total && len(out.items) >= out.total
+	}
+	return outcomes
+}
+
+// collectList pages through a single list.
+func collectList[T any](ctx context.Context, c *Client, q listQuery) ([]T, int, bool, error) {
+	out := collectLists[T](ctx, c, []listQuery{q})[0]
+	return out.items, out.total, out.complete, out.err
+}
@@ -0,0 +1,211 @@
+package vk
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimits configures the request rate allowed per access token.
+type RateLimits struct {
+	// RequestsPerSecond is the rate of all requests made with one token.
+	RequestsPerSecond float64
+	// Burst is the number of requests that may be sent back to back.
+	Burst int
+	// Methods sets additional per-method rates, e.g. "wall.get": 1. Calls
+	// made inside execute count against their own method.
+	Methods map[string]float64
+	// PerProxy keys limiters by token and proxy instead of token only.
+	PerProxy bool
+}
+
+// DefaultRateLimits matches the documented VK limit of 3 requests per
+// second for user tokens.
+var DefaultRateLimits = RateLimits{
+	RequestsPerSecond: 3,
+	Burst:             1,
+}
+
+const (
+	// minRateFactor bounds how far adaptive backoff slows a limiter down.
+	minRateFactor = 0.1
+	// recoverStep is how much of the rate a successful request restores.
+	recoverStep = 0.05
+	// backoffPause is how long a limiter stops after a rate limit error.
+	backoffPause = time.Second
+)
+
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token and returns how long the caller has to wait before
+// using it. Tokens may go negative, which queues later callers behind
+// earlier ones.
+func (b *bucket) reserve(now time.Time, factor float64) time.Duration {
+	rate := b.rate * factor
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// Limiter is a token bucket shared by every client using the same token.
+// It is safe for concurrent use.
+type Limiter struct {
+	mu          sync.Mutex
+	global      *bucket
+	methods     map[string]*bucket
+	factor      float64
+	pausedUntil time.Time
+}
+
+func newLimiter(limits RateLimits) *Limiter {
+	burst := float64(limits.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l := &Limiter{
+		global:  &bucket{rate: limits.RequestsPerSecond, burst: burst, tokens: burst},
+		methods: make(map[string]*bucket, len(limits.Methods)),
+		factor:  1,
+	}
+	for method, rate := range limits.Methods {
+		if rate > 0 {
+			l.methods[method] = &bucket{rate: rate, burst: 1, tokens: 1}
+		}
+	}
+	return l
+}
+
+// Wait blocks until a request to method may be sent or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, method string) error {
+	return sleep(ctx, l.reserve(true, method))
+}
+
+// waitMethods blocks until the per-method limits of methods allow them to
+// run, without taking from the token-wide rate.
+func (l *Limiter) waitMethods(ctx context.Context, methods ...string) error {
+	return sleep(ctx, l.reserve(false, methods...))
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (l *Limiter) reserve(global bool, methods ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	if now.Before(l.pausedUntil) {
+		wait = l.pausedUntil.Sub(now)
+	}
+
+	if global && l.global.rate > 0 {
+		if d := l.global.reserve(now, l.factor); d > wait {
+			wait = d
+		}
+	}
+	for _, method := range methods {
+		if b, ok := l.methods[method]; ok {
+			if d := b.reserve(now, l.factor); d > wait {
+				wait = d
+			}
+		}
+	}
+
+	return wait
+}
+
+// Backoff slows the limiter down after VK reported a rate limit error.
+func (l *Limiter) Backoff() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.factor /= 2
+	if l.factor < minRateFactor {
+		l.factor = minRateFactor
+	}
+	l.pausedUntil = time.Now().Add(backoffPause)
+}
+
+// Recover gradually restores the configured rate after a successful request.
+func (l *Limiter) Recover() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.factor < 1 {
+		l.factor += recoverStep
+		if l.factor > 1 {
+			l.factor = 1
+		}
+	}
+}
+
+// LimiterRegistry hands out one Limiter per access token, so all clients of
+// a process that use the same token share a single rate.
+type LimiterRegistry struct {
+	mu       sync.Mutex
+	limits   RateLimits
+	limiters map[string]*Limiter
+}
+
+func NewLimiterRegistry(limits RateLimits) *LimiterRegistry {
+	if limits.RequestsPerSecond <= 0 {
+		limits.RequestsPerSecond = DefaultRateLimits.RequestsPerSecond
+	}
+
+	return &LimiterRegistry{
+		limits:   limits,
+		limiters: make(map[string]*Limiter),
+	}
+}
+
+// DefaultLimiters is used by clients created without WithLimiters.
+var DefaultLimiters = NewLimiterRegistry(DefaultRateLimits)
+
+// Get returns the limiter for accessToken, creating it on first use.
+func (r *LimiterRegistry) Get(accessToken string, proxyURL *string) *Limiter {
+	key := accessToken
+	if r.limits.PerProxy && proxyURL != nil {
+		key += "@" + *proxyURL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.limiters[key]
+	if !ok {
+		l = newLimiter(r.limits)
+		r.limiters[key] = l
+	}
+	return l
+}
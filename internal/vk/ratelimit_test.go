@@ -0,0 +1,188 @@
+package vk
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBucketReserve(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	type step struct {
+		after  time.Duration // since start
+		factor float64
+		want   time.Duration
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst float64
+		steps []step
+	}{
+		{
+			name: "burst is free, then calls queue",
+			rate: 2, burst: 3,
+			steps: []step{
+				{0, 1, 0},
+				{0, 1, 0},
+				{0, 1, 0},
+				{0, 1, 500 * time.Millisecond},
+				{0, 1, time.Second},
+			},
+		},
+		{
+			name: "refills at the rate",
+			rate: 2, burst: 1,
+			steps: []step{
+				{0, 1, 0},
+				{0, 1, 500 * time.Millisecond},
+				{time.Second, 1, 0},
+				{time.Second, 1, 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "refill is capped at the burst",
+			rate: 10, burst: 2,
+			steps: []step{
+				{0, 1, 0},
+				{time.Hour, 1, 0},
+				{time.Hour, 1, 0},
+				{time.Hour, 1, 100 * time.Millisecond},
+			},
+		},
+		{
+			name: "factor slows the refill",
+			rate: 2, burst: 1,
+			steps: []step{
+				{0, 0.5, 0},
+				{0, 0.5, time.Second},
+				{2 * time.Second, 0.5, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &bucket{rate: tt.rate, burst: tt.burst, tokens: tt.burst}
+			for i, s := range tt.steps {
+				if got := b.reserve(start.Add(s.after), s.factor); got != s.want {
+					t.Errorf("step %d: got wait %v, want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterMethodLimits(t *testing.T) {
+	l := newLimiter(RateLimits{
+		RequestsPerSecond: 1000,
+		Burst:             10,
+		Methods:           map[string]float64{"wall.get": 1},
+	})
+
+	if d := l.reserve(true, "wall.get"); d != 0 {
+		t.Fatalf("first wall.get waits %v", d)
+	}
+	if d := l.reserve(true, "wall.get"); d <= 0 {
+		t.Errorf("second wall.get in a row does not wait")
+	}
+	if d := l.reserve(true, "friends.get"); d != 0 {
+		t.Errorf("friends.get waits %v behind wall.get", d)
+	}
+	// Calls inside execute take from their method only.
+	if d := l.reserve(false, "friends.get"); d != 0 {
+		t.Errorf("execute call without a method limit waits %v", d)
+	}
+}
+
+func TestLimiterRegistry(t *testing.T) {
+	proxyA, proxyB := "http://a:8080", "http://b:8080"
+
+	tests := []struct {
+		name     string
+		perProxy bool
+		token1   string
+		proxy1   *string
+		token2   string
+		proxy2   *string
+		shared   bool
+	}{
+		{"same token", false, "t1", nil, "t1", nil, true},
+		{"other token", false, "t1", nil, "t2", nil, false},
+		{"same token, other proxy", false, "t1", &proxyA, "t1", &proxyB, true},
+		{"per proxy, same proxy", true, "t1", &proxyA, "t1", &proxyA, true},
+		{"per proxy, other proxy", true, "t1", &proxyA, "t1", &proxyB, false},
+		{"per proxy, no proxy", true, "t1", nil, "t1", nil, true},
+		{"per proxy, proxy and none", true, "t1", &proxyA, "t1", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewLimiterRegistry(RateLimits{RequestsPerSecond: 3, PerProxy: tt.perProxy})
+			l1 := r.Get(tt.token1, tt.proxy1)
+			l2 := r.Get(tt.token2, tt.proxy2)
+			if shared := l1 == l2; shared != tt.shared {
+				t.Errorf("got shared %v, want %v", shared, tt.shared)
+			}
+		})
+	}
+}
+
+func TestLimiterRegistryDefaultRate(t *testing.T) {
+	r := NewLimiterRegistry(RateLimits{})
+	if got := r.Get("t", nil).global.rate; got != DefaultRateLimits.RequestsPerSecond {
+		t.Errorf("got rate %v, want the default %v", got, DefaultRateLimits.RequestsPerSecond)
+	}
+}
+
+func TestLimiterWaitCancel(t *testing.T) {
+	l := newLimiter(RateLimits{RequestsPerSecond: 0.01, Burst: 1})
+	if err := l.Wait(context.Background(), "users.get"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next token is 100 seconds away.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := l.Wait(ctx, "users.get")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Wait returned after %v", elapsed)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(cancelled, "users.get"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v from a cancelled context, want %v", err, context.Canceled)
+	}
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	l := newLimiter(RateLimits{RequestsPerSecond: 10, Burst: 1})
+	l.Backoff()
+	if l.factor != 0.5 {
+		t.Errorf("got factor %v after one backoff, want 0.5", l.factor)
+	}
+	if d := l.reserve(true, "users.get"); d <= 0 || d > backoffPause {
+		t.Errorf("got wait %v after a backoff, want up to %v", d, backoffPause)
+	}
+
+	for i := 0; i < 10; i++ {
+		l.Backoff()
+	}
+	if l.factor != minRateFactor {
+		t.Errorf("got factor %v, want it bounded at %v", l.factor, minRateFactor)
+	}
+
+	for i := 0; i < 100; i++ {
+		l.Recover()
+	}
+	if l.factor != 1 {
+		t.Errorf("got factor %v after recovering, want 1", l.factor)
+	}
+}
@@ -0,0 +1,193 @@
+package vk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// fixRand makes the jitter source return r until the test ends.
+func fixRand(t *testing.T, r func() float64) {
+	t.Helper()
+	old := randFloat
+	randFloat = r
+	t.Cleanup(func() { randFloat = old })
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	jittered := policy
+	jittered.Jitter = 0.2
+
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		retry  int
+		err    error
+		rand   float64
+		want   time.Duration
+	}{
+		{"first retry", policy, 1, nil, 0.5, time.Second},
+		{"doubles", policy, 2, nil, 0.5, 2 * time.Second},
+		{"doubles again", policy, 3, nil, 0.5, 4 * time.Second},
+		{"capped", policy, 5, nil, 0.5, 10 * time.Second},
+		{"capped far out", policy, 100, nil, 0.5, 10 * time.Second},
+		{"no cap", RetryPolicy{BaseDelay: time.Second}, 6, nil, 0.5, 32 * time.Second},
+		{"jitter low end", jittered, 1, nil, 0, 800 * time.Millisecond},
+		{"jitter middle", jittered, 1, nil, 0.5, time.Second},
+		{"jitter high end", jittered, 1, nil, 1, 1200 * time.Millisecond},
+		{"jitter after cap", jittered, 10, nil, 1, 12 * time.Second},
+		{"Retry-After wins", policy, 1, &HTTPError{StatusCode: 429, RetryAfter: 7 * time.Second}, 0.5, 7 * time.Second},
+		{"Retry-After shorter", policy, 3, &HTTPError{StatusCode: 503, RetryAfter: time.Second}, 0.5, 4 * time.Second},
+		{"Retry-After beats cap", policy, 10, fmt.Errorf("call: %w", &HTTPError{StatusCode: 503, RetryAfter: time.Minute}), 0.5, time.Minute},
+		{"Retry-After not jittered", jittered, 1, &HTTPError{StatusCode: 429, RetryAfter: 5 * time.Second}, 1, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixRand(t, func() float64 { return tt.rand })
+			if got := tt.policy.delay(tt.retry, tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelayJitterBounds(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	fixRand(t, rng.Float64)
+
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 8 * time.Second, Jitter: 0.25}
+	for retry := 1; retry <= 6; retry++ {
+		base := RetryPolicy{BaseDelay: policy.BaseDelay, MaxDelay: policy.MaxDelay}.delay(retry, nil)
+		low := time.Duration(float64(base) * 0.75)
+		high := time.Duration(float64(base) * 1.25)
+
+		for i := 0; i < 1000; i++ {
+			if got := policy.delay(retry, nil); got < low || got > high {
+				t.Fatalf("retry %d: got %v, want within [%v, %v]", retry, got, low, high)
+			}
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	syntaxErr := json.Unmarshal([]byte("{]"), new(map[string]interface{}))
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("boom"), false},
+		{"cancelled", context.Canceled, false},
+		{"deadline", fmt.Errorf("call: %w", context.DeadlineExceeded), false},
+		{"not recorded", ErrNotRecorded, false},
+		{"too many requests", &APIError{ErrorCode: ErrorCodeTooManyRequests}, true},
+		{"internal error", &APIError{ErrorCode: ErrorCodeInternal}, true},
+		{"unknown error", &APIError{ErrorCode: ErrorCodeUnknown}, true},
+		{"wrapped API error", fmt.Errorf("friends: %w", &APIError{ErrorCode: ErrorCodeTooManyRequests}), true},
+		{"captcha cools down", &APIError{ErrorCode: ErrorCodeCaptcha}, false},
+		{"flood control cools down", &APIError{ErrorCode: ErrorCodeFloodControl}, false},
+		{"rate limit cools down", &APIError{ErrorCode: ErrorCodeRateLimit}, false},
+		{"auth failed", &APIError{ErrorCode: ErrorCodeAuthFailed}, false},
+		{"private profile", &APIError{ErrorCode: ErrorCodePrivateProfile}, false},
+		{"bad parameter", &APIError{ErrorCode: ErrorCodeParam}, false},
+		{"HTTP 500", &HTTPError{StatusCode: 500}, true},
+		{"HTTP 503", &HTTPError{StatusCode: 503}, true},
+		{"HTTP 429", &HTTPError{StatusCode: 429}, true},
+		{"HTTP 404", &HTTPError{StatusCode: 404}, false},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"truncated body", fmt.Errorf("decode: %w", io.ErrUnexpectedEOF), true},
+		{"garbled body", syntaxErr, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-3", 0},
+		{"soon", 0},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	if got := parseRetryAfter(future); got < 58*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %v, want about an hour", future, got)
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	fixRand(t, func() float64 { return 0.5 })
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	tests := []struct {
+		name  string
+		errs  []error
+		want  error
+		calls int
+	}{
+		{"succeeds", []error{nil}, nil, 1},
+		{"succeeds on retry", []error{&HTTPError{StatusCode: 502}, nil}, nil, 2},
+		{"runs out of attempts", []error{&HTTPError{StatusCode: 502}, &HTTPError{StatusCode: 502}, &HTTPError{StatusCode: 503}}, &HTTPError{StatusCode: 503}, 3},
+		{"not retryable", []error{ErrNotRecorded}, ErrNotRecorded, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := policy.retry(context.Background(), func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if calls != tt.calls {
+				t.Errorf("got %d calls, want %d", calls, tt.calls)
+			}
+			if fmt.Sprint(err) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryStopsBeforeDeadline(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	calls := 0
+	err := policy.retry(ctx, func() error {
+		calls++
+		return &HTTPError{StatusCode: 500}
+	})
+	if calls != 1 || err == nil {
+		t.Errorf("got %d calls and %v, want 1 call and the error", calls, err)
+	}
+}
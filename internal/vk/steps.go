@@ -0,0 +1,161 @@
+package vk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Nakray/sn/internal/database"
+)
+
+// Step is the outcome of one step of a collection, such as "friends" or
+// "post.likes". Steps made of many requests, like the likes of every post,
+// add up the items stored and the requests that failed, and keep the first
+// error.
+type Step struct {
+	Name     string
+	Items    int
+	Requests int
+	Failed   int
+	Err      *StepError
+}
+
+// StepError is the first error of a step. Class tells whether it is worth
+// retrying; errors.Is and errors.As see the underlying error.
+type StepError struct {
+	Step  string
+	Class ErrorClass
+	Err   error
+}
+
+func (e *StepError) Error() string {
+	return e.Step + ": " + e.Err.Error()
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Status summarizes the step: failed when every request failed, partial
+// when some did.
+func (s Step) Status() database.StepStatus {
+	switch {
+	case s.Failed == 0:
+		return database.StepOK
+	case s.Failed < s.Requests:
+		return database.StepPartial
+	default:
+		return database.StepFailed
+	}
+}
+
+// RunStep converts the step for the run ledger.
+func (s Step) RunStep() database.TaskRunStep {
+	step := database.TaskRunStep{
+		Name:     s.Name,
+		Status:   s.Status(),
+		Items:    s.Items,
+		Requests: s.Requests,
+		Failed:   s.Failed,
+	}
+	if s.Err != nil {
+		step.Error = s.Err.Err.Error()
+		step.Class = s.Err.Class.String()
+	}
+	return step
+}
+
+// CollectResult is the outcome of collecting a user or group: every step
+// that ran, in the order it started.
+type CollectResult struct {
+	Owner    database.Owner
+	Steps    []Step
+	Duration time.Duration
+}
+
+// Items returns the number of items stored by all steps.
+func (r *CollectResult) Items() int {
+	n := 0
+	for _, step := range r.Steps {
+		n += step.Items
+	}
+	return n
+}
+
+// Errors returns the first error of every step that had failed requests.
+func (r *CollectResult) Errors() []*StepError {
+	var errs []*StepError
+	for _, step := range r.Steps {
+		if step.Err != nil {
+			errs = append(errs, step.Err)
+		}
+	}
+	return errs
+}
+
+// RunSteps converts the steps for the run ledger.
+func (r *CollectResult) RunSteps() []database.TaskRunStep {
+	steps := make([]database.TaskRunStep, len(r.Steps))
+	for i, step := range r.Steps {
+		steps[i] = step.RunStep()
+	}
+	return steps
+}
+
+// stepLog collects the steps of a collection in the order they started.
+type stepLog struct {
+	mu    sync.Mutex
+	steps []Step
+	index map[string]int
+}
+
+func (l *stepLog) record(name string, items int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.index == nil {
+		l.index = make(map[string]int)
+	}
+	i, ok := l.index[name]
+	if !ok {
+		i = len(l.steps)
+		l.index[name] = i
+		l.steps = append(l.steps, Step{Name: name})
+	}
+
+	step := &l.steps[i]
+	step.Requests++
+	step.Items += items
+	if err != nil {
+		step.Failed++
+		if step.Err == nil {
+			step.Err = &StepError{Step: name, Class: ClassOf(err), Err: err}
+		}
+	}
+}
+
+func (l *stepLog) list() []Step {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Step(nil), l.steps...)
+}
+
+func (l *stepLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.steps = nil
+	l.index = nil
+}
+
+// result returns the steps logged since the collection of owner started.
+func (col *Collector) result(owner database.Owner, started time.Time) *CollectResult {
+	return &CollectResult{
+		Owner:    owner,
+		Steps:    col.steps.list(),
+		Duration: time.Since(started),
+	}
+}
+
+// step records the outcome of a request of step name that stored items.
+func (col *Collector) step(name string, items int, err error) {
+	col.steps.record(name, items, err)
+}
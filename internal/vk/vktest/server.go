@@ -0,0 +1,708 @@
+// Package vktest provides an in-process fake of the VK API for offline
+// tests of vk.Client and vk.Collector.
+//
+// A test fills the server with fixtures, points a client at it and runs
+// the collector:
+//
+//	srv := vktest.NewServer()
+//	defer srv.Close()
+//	srv.AddUser(1, map[string]interface{}{"first_name": "Pavel"})
+//	srv.SetFriends(1, []int64{2, 3})
+//	client, _ := vk.NewClient("token", nil, vk.WithEndpoint(srv.Endpoint()))
+//
+// Lists honour offset and count and report their full size in "count", so
+// pagination works as against the real API. Requests to execute are
+// decoded and dispatched call by call.
+package vktest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nakray/sn/internal/vk"
+)
+
+// LikeKey identifies the item a list of likes belongs to.
+type LikeKey struct {
+	Type    string
+	OwnerID int64
+	ItemID  int64
+}
+
+type photoKey struct {
+	ownerID int64
+	albumID string
+}
+
+type commentKey struct {
+	itemType string
+	ownerID  int64
+	itemID   int64
+}
+
+type threadKey struct {
+	ownerID   int64
+	postID    int64
+	commentID int64
+}
+
+type injectedError struct {
+	code      int
+	msg       string
+	remaining int
+}
+
+// Server is a fake VK API server. All methods are safe for concurrent use.
+type Server struct {
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	token      string
+	latency    time.Duration
+	users      map[int64]map[string]interface{}
+	groups     map[int64]map[string]interface{}
+	friends    map[int64][]int64
+	userGroups map[int64][]int64
+	followers  map[int64][]int64
+	members    map[int64][]int64
+	walls      map[int64][]map[string]interface{}
+	postIDs    map[int64]int64
+	photos     map[photoKey][]map[string]interface{}
+	likes      map[LikeKey][]int64
+	albums     map[int64][]map[string]interface{}
+	topics     map[int64][]map[string]interface{}
+	comments   map[commentKey][]map[string]interface{}
+	replies    map[threadKey][]map[string]interface{}
+	commentID  int64
+	private    map[int64]bool
+	hidden     map[string]map[int]bool
+	errors     map[string][]*injectedError
+	calls      map[string]int
+}
+
+// NewServer starts a fake server. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		users:      make(map[int64]map[string]interface{}),
+		groups:     make(map[int64]map[string]interface{}),
+		friends:    make(map[int64][]int64),
+		userGroups: make(map[int64][]int64),
+		followers:  make(map[int64][]int64),
+		members:    make(map[int64][]int64),
+		walls:      make(map[int64][]map[string]interface{}),
+		postIDs:    make(map[int64]int64),
+		photos:     make(map[photoKey][]map[string]interface{}),
+		likes:      make(map[LikeKey][]int64),
+		albums:     make(map[int64][]map[string]interface{}),
+		topics:     make(map[int64][]map[string]interface{}),
+		comments:   make(map[commentKey][]map[string]interface{}),
+		replies:    make(map[threadKey][]map[string]interface{}),
+		private:    make(map[int64]bool),
+		hidden:     make(map[string]map[int]bool),
+		errors:     make(map[string][]*injectedError),
+		calls:      make(map[string]int),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Endpoint returns the value to pass to vk.WithEndpoint.
+func (s *Server) Endpoint() string {
+	return s.srv.URL + "/method/"
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// SetToken makes the server reject every other access token with error 5.
+func (s *Server) SetToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+// SetLatency delays every HTTP response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// InjectError makes the next times calls of method fail with code. Calls
+// inside execute fail individually. Use method "execute" to fail the
+// whole request.
+func (s *Server) InjectError(method string, code int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[method] = append(s.errors[method], &injectedError{
+		code:      code,
+		msg:       fmt.Sprintf("injected error %d", code),
+		remaining: times,
+	})
+}
+
+// InjectRateLimit makes the next times calls of method fail with error 6.
+func (s *Server) InjectRateLimit(method string, times int) {
+	s.InjectError(method, vk.ErrorCodeTooManyRequests, times)
+}
+
+// InjectCaptcha makes the next times calls of method fail with error 14.
+func (s *Server) InjectCaptcha(method string, times int) {
+	s.InjectError(method, vk.ErrorCodeCaptcha, times)
+}
+
+// SetPrivate makes the lists of userID fail with error 30, as they do for
+// a private profile. The profile itself stays visible.
+func (s *Server) SetPrivate(userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.private[userID] = true
+}
+
+// HideItems makes the lists of method leave out the items at the given
+// positions but still count them, as VK does for deleted or hidden items.
+// Pages that contain them come back short.
+func (s *Server) HideItems(method string, positions ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hidden[method] == nil {
+		s.hidden[method] = make(map[int]bool)
+	}
+	for _, pos := range positions {
+		s.hidden[method][pos] = true
+	}
+}
+
+// Calls returns how many times method has been called. Calls inside
+// execute are counted under their own method as well.
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+func (s *Server) AddUser(userID int64, data map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[userID] = withID(data, userID)
+}
+
+func (s *Server) AddGroup(groupID int64, data map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[groupID] = withID(data, groupID)
+}
+
+func (s *Server) SetFriends(userID int64, ids []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.friends[userID] = ids
+}
+
+// SetUserGroups sets the groups returned by groups.get for userID.
+func (s *Server) SetUserGroups(userID int64, ids []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userGroups[userID] = ids
+}
+
+func (s *Server) SetFollowers(userID int64, ids []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.followers[userID] = ids
+}
+
+func (s *Server) SetMembers(groupID int64, ids []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.members[groupID] = ids
+}
+
+// AddPost publishes a post on the wall of ownerID, which is negative for
+// groups, and returns its ID. Like the real API, wall.get returns posts
+// with "is_pinned" set first and the rest newest (last added) first.
+func (s *Server) AddPost(ownerID int64, post map[string]interface{}) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.postIDs[ownerID]++
+	post = withID(post, s.postIDs[ownerID])
+	post["owner_id"] = ownerID
+	s.walls[ownerID] = append(s.walls[ownerID], post)
+	id, _ := post["id"].(int64)
+	return id
+}
+
+// DeletePost removes a post from the wall of ownerID.
+func (s *Server) DeletePost(ownerID, postID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wall := s.walls[ownerID]
+	for i, post := range wall {
+		if id, _ := post["id"].(int64); id == postID {
+			s.walls[ownerID] = append(wall[:i:i], wall[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddPhoto appends a photo to an album of ownerID.
+func (s *Server) AddPhoto(ownerID int64, albumID string, photo map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := photoKey{ownerID: ownerID, albumID: albumID}
+	photo = withID(photo, int64(len(s.photos[key])+1))
+	photo["owner_id"] = ownerID
+	s.photos[key] = append(s.photos[key], photo)
+}
+
+func (s *Server) SetLikes(key LikeKey, ids []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.likes[key] = ids
+}
+
+// AddAlbum appends an album to the albums of ownerID. Its photos are added
+// with AddPhoto under the album ID, or under "profile", "wall" or "saved"
+// for the system albums -6, -7 and -15.
+func (s *Server) AddAlbum(ownerID int64, album map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	album = withID(album, int64(len(s.albums[ownerID])+1))
+	album["owner_id"] = ownerID
+	s.albums[ownerID] = append(s.albums[ownerID], album)
+}
+
+// AddTopic appends a discussion topic to groupID and returns its ID.
+// Comments are added with AddComment(-groupID, "topic", topicID, ...).
+func (s *Server) AddTopic(groupID int64, topic map[string]interface{}) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := int64(len(s.topics[groupID]) + 1)
+	s.topics[groupID] = append(s.topics[groupID], withID(topic, id))
+	return id
+}
+
+// AddComment appends a comment to a post, photo or topic ("post", "photo"
+// or "topic") of ownerID, which is negative for groups, and returns its ID.
+func (s *Server) AddComment(ownerID int64, itemType string, itemID int64, comment map[string]interface{}) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commentID++
+	comment = withID(comment, s.commentID)
+	key := commentKey{itemType: itemType, ownerID: ownerID, itemID: itemID}
+	s.comments[key] = append(s.comments[key], comment)
+	return s.commentID
+}
+
+// AddReply appends a reply to the thread of a comment on a post and returns
+// its ID.
+func (s *Server) AddReply(ownerID, postID, commentID int64, reply map[string]interface{}) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commentID++
+	reply = withID(reply, s.commentID)
+	reply["parents_stack"] = []int64{commentID}
+	key := threadKey{ownerID: ownerID, postID: postID, commentID: commentID}
+	s.replies[key] = append(s.replies[key], reply)
+	return s.commentID
+}
+
+// withID copies data and sets its "id" unless it already has one.
+func withID(data map[string]interface{}, id int64) map[string]interface{} {
+	out := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		out[k] = v
+	}
+	if _, ok := out["id"]; !ok {
+		out["id"] = id
+	}
+	return out
+}
+
+type response struct {
+	Response      interface{}    `json:"response,omitempty"`
+	Error         *vk.APIError   `json:"error,omitempty"`
+	ExecuteErrors []*vk.APIError `json:"execute_errors,omitempty"`
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, "/method/")
+	params := make(map[string]string, len(r.Form))
+	for k := range r.Form {
+		params[k] = r.Form.Get(k)
+	}
+
+	var resp response
+	if apiErr := s.checkToken(params["access_token"]); apiErr != nil {
+		resp.Error = apiErr
+	} else if method == "execute" {
+		resp = s.execute(r.Context(), params)
+	} else {
+		resp.Response, resp.Error = s.call(method, params)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) checkToken(token string) *vk.APIError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && token != s.token {
+		return apiError("", vk.ErrorCodeAuthFailed, "User authorization failed: invalid access_token")
+	}
+	return nil
+}
+
+func apiError(method string, code int, msg string) *vk.APIError {
+	return &vk.APIError{Method: method, ErrorCode: code, ErrorMsg: msg}
+}
+
+// execute runs the calls of a script generated by vk.Client.Batch.
+func (s *Server) execute(ctx context.Context, params map[string]string) response {
+	if _, apiErr := s.call("execute", nil); apiErr != nil {
+		return response{Error: apiErr}
+	}
+
+	calls, err := parseScript(params["code"])
+	if err != nil {
+		return response{Error: apiError("execute", 12, err.Error())}
+	}
+
+	results := make([]interface{}, len(calls))
+	var errs []*vk.APIError
+	for i, c := range calls {
+		result, apiErr := s.call(c.method, c.params)
+		if apiErr != nil {
+			results[i] = false
+			errs = append(errs, apiErr)
+			continue
+		}
+		results[i] = result
+	}
+
+	return response{Response: results, ExecuteErrors: errs}
+}
+
+type scriptCall struct {
+	method string
+	params map[string]string
+}
+
+// parseScript decodes scripts of the form
+// return [API.method({"k":"v"}),API.method({...})];
+func parseScript(code string) ([]scriptCall, error) {
+	rest := strings.TrimSpace(code)
+	if !strings.HasPrefix(rest, "return [") || !strings.HasSuffix(rest, "];") {
+		return nil, fmt.Errorf("unsupported script")
+	}
+	rest = strings.TrimSuffix(strings.TrimPrefix(rest, "return ["), "];")
+
+	var calls []scriptCall
+	for rest != "" {
+		rest = strings.TrimPrefix(rest, ",")
+		if !strings.HasPrefix(rest, "API.") {
+			return nil, fmt.Errorf("unsupported script near %q", rest)
+		}
+		rest = strings.TrimPrefix(rest, "API.")
+
+		open := strings.Index(rest, "(")
+		if open < 0 {
+			return nil, fmt.Errorf("unsupported script near %q", rest)
+		}
+		method := rest[:open]
+		rest = rest[open+1:]
+
+		dec := json.NewDecoder(strings.NewReader(rest))
+		var params map[string]string
+		if err := dec.Decode(&params); err != nil {
+			return nil, err
+		}
+		rest = strings.TrimSpace(rest[dec.InputOffset():])
+		if !strings.HasPrefix(rest, ")") {
+			return nil, fmt.Errorf("unsupported script near %q", rest)
+		}
+		rest = rest[1:]
+
+		calls = append(calls, scriptCall{method: method, params: params})
+	}
+
+	return calls, nil
+}
+
+// call counts a method call and returns its response or error.
+func (s *Server) call(method string, params map[string]string) (interface{}, *vk.APIError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls[method]++
+
+	if queue := s.errors[method]; len(queue) > 0 {
+		injected := queue[0]
+		injected.remaining--
+		if injected.remaining <= 0 {
+			s.errors[method] = queue[1:]
+		}
+		return nil, apiError(method, injected.code, injected.msg)
+	}
+
+	if method == "execute" {
+		return nil, nil
+	}
+
+	return s.dispatch(method, params)
+}
+
+func int64Param(params map[string]string, name string) int64 {
+	v, _ := strconv.ParseInt(params[name], 10, 64)
+	return v
+}
+
+// page returns the slice of items selected by offset and count in the
+// common list response shape, without the items at hidden positions.
+func page[T any](items []T, params map[string]string, defaultCount int, hidden map[int]bool) map[string]interface{} {
+	offset, _ := strconv.Atoi(params["offset"])
+	count := defaultCount
+	if v, err := strconv.Atoi(params["count"]); err == nil {
+		count = v
+	}
+
+	selected := []T{}
+	if offset < len(items) {
+		end := offset + count
+		if end > len(items) {
+			end = len(items)
+		}
+		for i := offset; i < end; i++ {
+			if !hidden[i] {
+				selected = append(selected, items[i])
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"count": len(items),
+		"items": selected,
+	}
+}
+
+// dispatch must be called with s.mu held.
+func (s *Server) dispatch(method string, params map[string]string) (interface{}, *vk.APIError) {
+	privateErr := func(userID int64) *vk.APIError {
+		if s.private[userID] {
+			return apiError(method, vk.ErrorCodePrivateProfile, "This profile is private")
+		}
+		return nil
+	}
+
+	switch method {
+	case "users.get":
+		users := []map[string]interface{}{}
+		for _, idStr := range strings.Split(params["user_ids"], ",") {
+			id, _ := strconv.ParseInt(idStr, 10, 64)
+			if user, ok := s.users[id]; ok {
+				users = append(users, user)
+			}
+		}
+		return users, nil
+
+	case "groups.getById":
+		id := int64Param(params, "group_id")
+		group, ok := s.groups[id]
+		if !ok {
+			return nil, apiError(method, vk.ErrorCodeParam, "Invalid group id")
+		}
+		return []map[string]interface{}{group}, nil
+
+	case "friends.get":
+		userID := int64Param(params, "user_id")
+		if err := privateErr(userID); err != nil {
+			return nil, err
+		}
+		return page(s.friends[userID], params, 5000, s.hidden[method]), nil
+
+	case "groups.get":
+		userID := int64Param(params, "user_id")
+		if err := privateErr(userID); err != nil {
+			return nil, err
+		}
+		return page(s.userGroups[userID], params, 1000, s.hidden[method]), nil
+
+	case "users.getFollowers":
+		userID := int64Param(params, "user_id")
+		if err := privateErr(userID); err != nil {
+			return nil, err
+		}
+		return page(s.followers[userID], params, 100, s.hidden[method]), nil
+
+	case "groups.getMembers":
+		return page(s.members[int64Param(params, "group_id")], params, 1000, s.hidden[method]), nil
+
+	case "wall.get":
+		ownerID := int64Param(params, "owner_id")
+		if err := privateErr(ownerID); err != nil {
+			return nil, err
+		}
+		return page(wallOrder(s.walls[ownerID]), params, 20, s.hidden[method]), nil
+
+	case "photos.get":
+		ownerID := int64Param(params, "owner_id")
+		if err := privateErr(ownerID); err != nil {
+			return nil, err
+		}
+		key := photoKey{ownerID: ownerID, albumID: params["album_id"]}
+		return page(s.photos[key], params, 50, s.hidden[method]), nil
+
+	case "likes.getList":
+		key := LikeKey{
+			Type:    params["type"],
+			OwnerID: int64Param(params, "owner_id"),
+			ItemID:  int64Param(params, "item_id"),
+		}
+		return page(s.likes[key], params, 100, s.hidden[method]), nil
+
+	case "wall.getComments":
+		return s.wallComments(params), nil
+
+	case "photos.getComments":
+		key := commentKey{
+			itemType: "photo",
+			ownerID:  int64Param(params, "owner_id"),
+			itemID:   int64Param(params, "photo_id"),
+		}
+		return page(s.comments[key], params, 20, s.hidden[method]), nil
+
+	case "photos.getAlbums":
+		albums := s.albums[int64Param(params, "owner_id")]
+		return map[string]interface{}{"count": len(albums), "items": albums}, nil
+
+	case "board.getTopics":
+		return page(s.topics[int64Param(params, "group_id")], params, 40, s.hidden[method]), nil
+
+	case "board.getComments":
+		key := commentKey{
+			itemType: "topic",
+			ownerID:  -int64Param(params, "group_id"),
+			itemID:   int64Param(params, "topic_id"),
+		}
+		return page(s.comments[key], params, 20, s.hidden[method]), nil
+
+	case "photos.getAllComments":
+		ownerID := int64Param(params, "owner_id")
+		var comments []map[string]interface{}
+		for key, photos := range s.photos {
+			if key.ownerID != ownerID || (params["album_id"] != "" && key.albumID != params["album_id"]) {
+				continue
+			}
+			for _, photo := range photos {
+				photoID, _ := photo["id"].(int64)
+				for _, comment := range s.comments[commentKey{itemType: "photo", ownerID: ownerID, itemID: photoID}] {
+					comment = withID(comment, 0)
+					comment["pid"] = photoID
+					comments = append(comments, comment)
+				}
+			}
+		}
+		return page(comments, params, 20, s.hidden[method]), nil
+
+	default:
+		return nil, apiError(method, vk.ErrorCodeUnknownMethod, "Unknown method passed")
+	}
+}
+
+// wallComments serves wall.getComments: the replies to comment_id when it
+// is set, the top-level comments with inlined threads otherwise. Must be
+// called with s.mu held.
+func (s *Server) wallComments(params map[string]string) map[string]interface{} {
+	const method = "wall.getComments"
+	ownerID := int64Param(params, "owner_id")
+	postID := int64Param(params, "post_id")
+
+	if commentID := int64Param(params, "comment_id"); commentID != 0 {
+		replies := s.replies[threadKey{ownerID: ownerID, postID: postID, commentID: commentID}]
+		resp := page(replies, params, 10, s.hidden[method])
+		resp["current_level_count"] = len(replies)
+		return resp
+	}
+
+	threadItems, _ := strconv.Atoi(params["thread_items_count"])
+	comments := s.comments[commentKey{itemType: "post", ownerID: ownerID, itemID: postID}]
+	total := len(comments)
+
+	withThreads := make([]map[string]interface{}, len(comments))
+	for i, comment := range comments {
+		commentID, _ := comment["id"].(int64)
+		replies := s.replies[threadKey{ownerID: ownerID, postID: postID, commentID: commentID}]
+		total += len(replies)
+
+		inlined := replies
+		if len(inlined) > threadItems {
+			inlined = inlined[:threadItems]
+		}
+		comment = withID(comment, 0)
+		comment["thread"] = map[string]interface{}{
+			"count": len(replies),
+			"items": inlined,
+		}
+		withThreads[i] = comment
+	}
+
+	resp := page(withThreads, params, 10, s.hidden[method])
+	resp["count"] = total
+	resp["current_level_count"] = len(comments)
+	return resp
+}
+
+// wallOrder returns the posts of a wall in the order wall.get returns them.
+func wallOrder(wall []map[string]interface{}) []map[string]interface{} {
+	var pinned, rest []map[string]interface{}
+	for i := len(wall) - 1; i >= 0; i-- {
+		if isSet(wall[i]["is_pinned"]) {
+			pinned = append(pinned, wall[i])
+		} else {
+			rest = append(rest, wall[i])
+		}
+	}
+	return append(pinned, rest...)
+}
+
+// isSet reports whether a fixture flag such as "is_pinned" is set.
+func isSet(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	}
+	return false
+}